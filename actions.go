@@ -0,0 +1,166 @@
+package main
+
+import (
+	glob "github.com/ryanuber/go-glob"
+)
+
+// actionGroups expand the names that can be used in `actions` to the
+// elasticsearch action patterns they grant. they follow the built in
+// privileges of elasticsearch security. anything that isn't a group is
+// treated as an action name, which may contain globs
+var actionGroups = map[string][]string{
+	"all": {"*"},
+	"read": {
+		"indices:data/read/*",
+		"indices:admin/mappings/fields/get",
+		"indices:admin/validate/query",
+		"indices:admin/resolve/index",
+	},
+	"view_index_metadata": {
+		"indices:admin/aliases/get",
+		"indices:admin/aliases/exists",
+		"indices:admin/get",
+		"indices:admin/exists",
+		"indices:admin/types/exists",
+		"indices:admin/mappings/get",
+		"indices:admin/mappings/fields/get",
+		"indices:admin/shards/search_shards",
+		"indices:admin/validate/query",
+		"indices:admin/resolve/index",
+		"indices:admin/ilm/explain",
+		"indices:admin/data_stream/get",
+		"indices:monitor/settings/get",
+	},
+	"write": {"indices:data/write/*"},
+	"index": {
+		"indices:data/write/index",
+		"indices:data/write/update",
+		"indices:data/write/bulk",
+	},
+	"create": {
+		"indices:data/write/index",
+		"indices:data/write/bulk",
+	},
+	"delete": {
+		"indices:data/write/delete",
+		"indices:data/write/delete/byquery",
+		"indices:data/write/bulk",
+	},
+	"delete_index": {"indices:admin/delete", "indices:admin/data_stream/delete"},
+	"create_index": {"indices:admin/create", "indices:admin/data_stream/create"},
+	"monitor": {
+		"indices:monitor/*",
+		"cluster:monitor/*",
+	},
+	"manage": {
+		"indices:admin/*",
+		"indices:monitor/*",
+		"cluster:admin/*",
+		"cluster:monitor/*",
+	},
+}
+
+// managementActions change the cluster, its indices or their settings.
+// they need `can_manage`, or an index grant with an action covering them
+// on every index of the request
+var managementActions = []string{
+	"indices:admin/create",
+	"indices:admin/delete",
+	"indices:admin/open",
+	"indices:admin/close",
+	"indices:admin/mapping/put",
+	"indices:admin/aliases",
+	"indices:admin/resize",
+	"indices:admin/rollover",
+	// deleting a data stream deletes its backing indices
+	"indices:admin/data_stream/create",
+	"indices:admin/data_stream/delete",
+	// following a leader index creates the follower
+	"indices:admin/xpack/ccr/put_follow",
+	"indices:admin/settings/update",
+	"indices:admin/template/put",
+	"indices:admin/template/delete",
+	"indices:admin/index_template/put",
+	"indices:admin/index_template/delete",
+	"cluster:admin/component_template/put",
+	"cluster:admin/component_template/delete",
+	"cluster:admin/snapshot/*",
+	"cluster:admin/repository/*",
+	"cluster:admin/settings/update",
+	"cluster:admin/reroute",
+	"cluster:admin/script/put",
+	"cluster:admin/ilm/put",
+	"cluster:admin/ilm/delete",
+	"cluster:admin/ilm/start",
+	"cluster:admin/ilm/stop",
+	"cluster:admin/ilm/_move/post",
+	"indices:admin/ilm/remove_policy",
+	"indices:admin/ilm/retry",
+	"cluster:admin/ingest/pipeline/put",
+	"cluster:admin/ingest/pipeline/delete",
+	"indices:data/write/reindex",
+	"cluster:admin/reindex/rethrottle",
+	// sql queries name their indices in the query, where they can't be
+	// authorized, filtered or have their fields limited
+	"indices:data/read/sql*",
+}
+
+// isManagementAction reports whether the action needs management rights
+func isManagementAction(action string) bool {
+	for _, pattern := range managementActions {
+		if glob.Glob(pattern, action) {
+			return true
+		}
+	}
+	return false
+}
+
+// actionPermitted reports whether any of the granted action groups or
+// action names cover the action being performed
+func actionPermitted(action string, granted []string) bool {
+	if action == "" {
+		return false
+	}
+	for _, name := range granted {
+		patterns, ok := actionGroups[name]
+		if !ok {
+			patterns = []string{name}
+		}
+		for _, pattern := range patterns {
+			if glob.Glob(pattern, action) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// permits reports whether the index can be used for the action. the
+// `actions` and `rest_verbs` settings both grant access
+func (i Index) permits(method, action string) bool {
+	return stringInSlice(method, i.RESTverbs) || actionPermitted(action, i.Actions)
+}
+
+// permits reports whether the API can be used for the action. the
+// `actions` and `rest_verbs` settings both grant access
+func (a API) permits(method, action string) bool {
+	return stringInSlice(method, a.RESTverbs) || actionPermitted(action, a.Actions)
+}
+
+// denies reports whether the deny rule applies to the action. a rule
+// without REST verbs or actions denies everything
+func (i Index) denies(method, action string) bool {
+	if len(i.RESTverbs) == 0 && len(i.Actions) == 0 {
+		return true
+	}
+	return i.permits(method, action)
+}
+
+// denies reports whether the deny rule applies to the action. a rule
+// without REST verbs or actions denies everything
+func (a API) denies(method, action string) bool {
+	if len(a.RESTverbs) == 0 && len(a.Actions) == 0 {
+		return true
+	}
+	return a.permits(method, action)
+}
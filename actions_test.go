@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestActionPermitted(t *testing.T) {
+	cases := []struct {
+		action  string
+		granted []string
+		ok      bool
+	}{
+		{"indices:data/read/search", []string{"read"}, true},
+		{"indices:data/read/msearch", []string{"read"}, true},
+		{"indices:admin/mappings/fields/get", []string{"read"}, true},
+		{"indices:data/write/index", []string{"read"}, false},
+		{"indices:data/write/delete/byquery", []string{"read"}, false},
+		{"indices:data/write/delete/byquery", []string{"delete"}, true},
+		{"indices:data/write/update", []string{"write"}, true},
+		{"indices:admin/delete", []string{"write", "delete"}, false},
+		{"indices:admin/delete", []string{"delete_index"}, true},
+		{"indices:admin/settings/update", []string{"manage"}, true},
+		{"cluster:monitor/health", []string{"monitor"}, true},
+		{"cluster:admin/settings/update", []string{"monitor"}, false},
+		{"indices:data/read/search", []string{"indices:data/read/search"}, true},
+		{"indices:data/read/msearch", []string{"indices:data/read/search"}, false},
+		{"indices:data/read/msearch", []string{"indices:data/read/*"}, true},
+		{"cluster:admin/reroute", []string{"all"}, true},
+		{"", []string{"all"}, false},
+	}
+
+	for _, c := range cases {
+		if ok := actionPermitted(c.action, c.granted); ok != c.ok {
+			t.Errorf("%s with %v: got %v, expected %v", c.action, c.granted, ok, c.ok)
+		}
+	}
+}
+
+func TestIsManagementAction(t *testing.T) {
+	cases := []struct {
+		action     string
+		management bool
+	}{
+		{"indices:admin/create", true},
+		{"indices:admin/delete", true},
+		{"indices:admin/open", true},
+		{"indices:admin/close", true},
+		{"indices:admin/data_stream/create", true},
+		{"indices:admin/data_stream/delete", true},
+		{"indices:admin/mapping/put", true},
+		{"indices:admin/aliases", true},
+		{"indices:admin/resize", true},
+		{"indices:admin/rollover", true},
+		{"indices:admin/xpack/ccr/put_follow", true},
+		{"cluster:admin/reroute", true},
+		{"cluster:admin/script/put", true},
+		{"cluster:admin/snapshot/create", true},
+		{"indices:admin/data_stream/get", false},
+		{"indices:admin/aliases/get", false},
+		{"indices:admin/mappings/get", false},
+		{"cluster:admin/script/get", false},
+		{"indices:data/read/sql/translate", true},
+		{"indices:data/write/index", false},
+	}
+
+	for _, c := range cases {
+		if got := isManagementAction(c.action); got != c.management {
+			t.Errorf("%s: got management %v, expected %v", c.action, got, c.management)
+		}
+	}
+}
+
+func TestReadOnlyAnalyst(t *testing.T) {
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		ok     bool
+	}{
+		{"POST", "/test_deflek/_search", `{"query":{"match_all":{}}}`, true},
+		{"GET", "/test_deflek/_search", "", true},
+		{"POST", "/test_deflek/_count", `{"query":{"match_all":{}}}`, true},
+		{"GET", "/test_deflek/_mapping", "", true},
+		{"POST", "/test_deflek/_doc", `{"field":"value"}`, false},
+		{"PUT", "/test_deflek/_doc/1", `{"field":"value"}`, false},
+		{"POST", "/test_deflek/_delete_by_query", `{"query":{"match_all":{}}}`, false},
+		{"DELETE", "/test_deflek", "", false},
+		{"POST", "/secret_stuff/_search", `{"query":{"match_all":{}}}`, false},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, c.body, c.method, withGroups("CN=analysts"))
+		if err != nil {
+			t.Error("could not get context: ", err)
+		}
+
+		var p Prox
+		ok, err := p.checkRBAC(ctx)
+		if err != nil {
+			t.Errorf("%s %s: got error %v", c.method, c.path, err)
+		}
+		if ok != c.ok {
+			t.Errorf("%s %s: got %v, expected %v (%s)", c.method, c.path, ok, c.ok, ctx.trace.Reason)
+		}
+	}
+}
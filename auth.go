@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// identity is who a request is made by
+type identity struct {
+	user   string
+	groups []string
+	// the distinguished names of the groups, for role mappings
+	dns []string
+}
+
+// authenticator tells who made a request from the credentials it carries.
+// requests with missing or bad credentials get an error, and are answered
+// with a 401
+type authenticator interface {
+	authenticate(r *http.Request) (*identity, error)
+}
+
+// authError is why a request could not be authenticated, along with the
+// challenge telling the client how to authenticate
+type authError struct {
+	reason    string
+	challenge string
+	// the request has no credentials for the authenticator, so the next
+	// one of the chain can have a go
+	missing bool
+}
+
+func (e *authError) Error() string {
+	return e.reason
+}
+
+// newAuthenticator returns the chain of the named authenticators, tried in
+// the order they are named
+func newAuthenticator(C *Config, names []string) (authenticator, error) {
+	if len(names) == 0 {
+		return nil, errors.New("authenticators: at least one is required")
+	}
+	var chain authenticatorChain
+	for i, name := range names {
+		var a authenticator
+		var err error
+		switch name {
+		case "headers":
+			// the headers take every request, anonymous or not
+			if i != len(names)-1 {
+				return nil, errors.New("authenticators: headers must come last")
+			}
+			a, err = newHeaderAuthenticator(C)
+		case "jwt":
+			a, err = newJWTAuthenticator(C)
+		case "basic":
+			a, err = newBasicAuthenticator(C)
+		case "client_cert":
+			a, err = newClientCertAuthenticator(C)
+		default:
+			return nil, fmt.Errorf("authenticators: unknown authenticator %s", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, a)
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+// listenerAuthenticators returns the authenticators of the listener, which
+// are the JWT bearer tokens when enabled and else the user and group
+// headers, unless they are listed
+func (C *Config) listenerAuthenticators() []string {
+	if len(C.Authenticators) > 0 {
+		return C.Authenticators
+	}
+	if C.Authentication.JWT.Enabled {
+		return []string{"jwt"}
+	}
+	return []string{"headers"}
+}
+
+// tlsListenerAuthenticators returns the authenticators of the TLS listener,
+// which are the client certificates unless they are listed
+func (C *Config) tlsListenerAuthenticators() []string {
+	if len(C.TLSListener.Authenticators) > 0 {
+		return C.TLSListener.Authenticators
+	}
+	return []string{"client_cert"}
+}
+
+// authenticatorChain tries its authenticators in order, until one finds
+// its credentials on the request. requests without credentials for any of
+// them are denied with the challenges of all of them
+type authenticatorChain []authenticator
+
+func (chain authenticatorChain) authenticate(r *http.Request) (*identity, error) {
+	var missing *authError
+	var challenges []string
+	for _, a := range chain {
+		id, err := a.authenticate(r)
+		e, ok := err.(*authError)
+		if !ok || !e.missing {
+			if err == nil && chain.takesAuthorization() {
+				// credentials of a scheme the chain doesn't take, like a
+				// bearer token next to basic, are not for elasticsearch either
+				r.Header.Del("Authorization")
+			}
+			return id, err
+		}
+		if missing == nil {
+			missing = e
+		}
+		if e.challenge != "" {
+			challenges = append(challenges, e.challenge)
+		}
+	}
+	return nil, &authError{reason: missing.reason, challenge: strings.Join(challenges, ", "), missing: true}
+}
+
+// takesAuthorization reports whether any authenticator of the chain takes
+// its credentials from the Authorization header
+func (chain authenticatorChain) takesAuthorization() bool {
+	for _, a := range chain {
+		switch a.(type) {
+		case *jwtAuthenticator, *basicAuthenticator:
+			return true
+		}
+	}
+	return false
+}
+
+// headerAuthenticator trusts the user and group headers set by a SSO proxy,
+// checking their signature first when signatures are required
+type headerAuthenticator struct {
+	C *Config
+	// the secret shared with the SSO proxy, when signatures are required
+	secret []byte
+	// the networks of the trusted proxies, nil when every peer is trusted
+	trusted []*net.IPNet
+}
+
+func newHeaderAuthenticator(C *Config) (*headerAuthenticator, error) {
+	trusted, err := parseTrustedProxies(C.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	a := &headerAuthenticator{C: C, trusted: trusted}
+	if C.Authentication.HeaderSignature.Enabled {
+		secret, err := readHeaderSecret(C.Authentication.HeaderSignature.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		a.secret = secret
+	}
+	return a, nil
+}
+
+func (a *headerAuthenticator) authenticate(r *http.Request) (*identity, error) {
+	if !a.trustedPeer(r) {
+		stripIdentityHeaders(r, a.C)
+		return headerIdentity(r, a.C), nil
+	}
+	if a.secret != nil {
+		err := a.checkSignature(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return headerIdentity(r, a.C), nil
+}
+
+// parseTrustedProxies parses the CIDRs of the trusted proxies. single IPs
+// are taken as networks of their own
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted_proxies: invalid IP %s", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies: %v", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// trustedPeer reports whether the request came straight from a trusted
+// proxy
+func (a *headerAuthenticator) trustedPeer(r *http.Request) bool {
+	if a.trusted == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripIdentityHeaders removes the user, group and signature headers from
+// the request, so they can't be trusted by mistake or end up in the logs of
+// elasticsearch
+func stripIdentityHeaders(r *http.Request, C *Config) {
+	signatureHeader, timestampHeader := C.signatureHeaders()
+	for _, name := range []string{C.UserHeaderName, C.GroupHeaderName, signatureHeader, timestampHeader} {
+		if name != "" {
+			r.Header.Del(name)
+		}
+	}
+}
+
+// withIdentity attaches who made the request to it
+func withIdentity(r *http.Request, id *identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityContextKey, id))
+}
+
+// requestIdentity returns who made the request, as told by the
+// authenticator. requests that weren't authenticated are told by the user
+// and group headers
+func requestIdentity(r *http.Request, C *Config) *identity {
+	if id, ok := r.Context().Value(identityContextKey).(*identity); ok {
+		return id
+	}
+	return headerIdentity(r, C)
+}
+
+// unauthorized answers a request that could not be authenticated the way
+// elasticsearch security does
+func unauthorized(w http.ResponseWriter, trace *Trace, err error) {
+	if e, ok := err.(*authError); ok && e.challenge != "" {
+		w.Header().Set("WWW-Authenticate", e.challenge)
+	}
+	body, _ := json.Marshal(esErrorResponse{securityException(err.Error()), http.StatusUnauthorized})
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	n, _ := w.Write(body)
+	trace.Code = http.StatusUnauthorized
+	trace.Bytes = int64(n)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	networks, err := parseTrustedProxies([]string{"10.0.0.0/8", " 192.0.2.7", "::1", "fd00::/8"})
+	if err != nil {
+		t.Fatal("could not parse trusted proxies: ", err)
+	}
+	var got []string
+	for _, network := range networks {
+		got = append(got, network.String())
+	}
+	expected := []string{"10.0.0.0/8", "192.0.2.7/32", "::1/128", "fd00::/8"}
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Errorf("unexpected networks: (-want +got)\n%s", diff)
+	}
+
+	for _, proxies := range [][]string{{"10.0.0.0/33"}, {"proxy.example.com"}} {
+		if _, err := parseTrustedProxies(proxies); err == nil {
+			t.Errorf("%v: expected error", proxies)
+		}
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	c := getTestConfig()
+	c.TrustedProxies = []string{"10.0.0.0/8", "::1"}
+	a, err := newHeaderAuthenticator(c)
+	if err != nil {
+		t.Fatal("could not get authenticator: ", err)
+	}
+
+	cases := []struct {
+		remoteAddr string
+		user       string
+		groups     []string
+	}{
+		{"10.1.2.3:52000", "alice", []string{"group2"}},
+		{"[::1]:52000", "alice", []string{"group2"}},
+		{"[::ffff:10.1.2.3]:52000", "alice", []string{"group2"}},
+		{"192.0.2.7:52000", "", []string{"group1"}},
+		{"[fe80::1]:52000", "", []string{"group1"}},
+		{"", "", []string{"group1"}},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/test_deflek/_search", nil)
+		req.RemoteAddr = c.remoteAddr
+		req.Header.Set("X-Remote-User", "alice")
+		req.Header.Set("X-Remote-Groups", "CN=group2")
+
+		id, err := a.authenticate(req)
+		if err != nil {
+			t.Errorf("%s: %v", c.remoteAddr, err)
+			continue
+		}
+		if id.user != c.user {
+			t.Errorf("%s: got user %s, expected %s", c.remoteAddr, id.user, c.user)
+		}
+		if diff := cmp.Diff(c.groups, id.groups); diff != "" {
+			t.Errorf("%s: unexpected groups: (-want +got)\n%s", c.remoteAddr, diff)
+		}
+		if c.user == "" && (req.Header.Get("X-Remote-User") != "" || req.Header.Get("X-Remote-Groups") != "") {
+			t.Errorf("%s: identity headers of an untrusted peer left on the request", c.remoteAddr)
+		}
+	}
+}
+
+func TestStripIdentityHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range []string{"X-Remote-User", "X-Remote-Groups", "X-Remote-Signature", "X-Remote-Timestamp"} {
+			if r.Header.Get(name) != "" {
+				t.Errorf("%s forwarded to elasticsearch", name)
+			}
+		}
+		if r.Header.Get("X-Kibana-Tenant") == "" {
+			t.Error("other headers not forwarded")
+		}
+	}))
+	defer upstream.Close()
+
+	p := getTestProx(upstream.URL)
+	traces, _ := captureTraces(p)
+
+	req := httptest.NewRequest("GET", "/test_deflek/_search", nil)
+	req.Header.Set("X-Remote-User", "dustind")
+	req.Header.Set("X-Remote-Groups", "OU=thing,CN=group2,DC=something")
+	req.Header.Set("X-Remote-Signature", "00")
+	req.Header.Set("X-Remote-Timestamp", "0")
+	req.Header.Set("X-Kibana-Tenant", "group2")
+	w := httptest.NewRecorder()
+
+	p.handleRequest(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, expected %d", w.Code, http.StatusOK)
+	}
+	if _, ok := traces["dustind"]; !ok {
+		t.Error("request not traced for the user of the stripped headers")
+	}
+}
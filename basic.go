@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const basicChallenge = `Basic realm="deflek", charset="UTF-8"`
+
+const (
+	// how long checked credentials are trusted without bcrypt
+	basicCacheTTL = 5 * time.Minute
+	// the most checked credentials kept at once
+	basicCacheSize = 1024
+)
+
+// basicUser is a user of the users file
+type basicUser struct {
+	hash   []byte
+	groups []string
+}
+
+// basicAuthenticator authenticates requests with the user and password of
+// their Authorization header, checked against the bcrypt hashes of the
+// users file
+type basicAuthenticator struct {
+	C     *Config
+	users map[string]basicUser
+	// the passwords of unknown users are checked against this hash, so
+	// they take as long to deny as the ones of known users
+	unknown []byte
+	// the SHA-256 of the credentials that were checked already and when
+	// they expire, so scripts don't pay for bcrypt on every request
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]time.Time
+}
+
+func newBasicAuthenticator(C *Config) (*basicAuthenticator, error) {
+	file := C.Authentication.Basic.UsersFile
+	if file == "" {
+		return nil, errors.New("basic: users_file is required")
+	}
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("basic: %v", err)
+	}
+	users, err := parseUsersFile(raw)
+	if err != nil {
+		return nil, fmt.Errorf("basic: users_file %s: %v", file, err)
+	}
+	unknown, err := bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("basic: %v", err)
+	}
+
+	return &basicAuthenticator{
+		C:        C,
+		users:    users,
+		unknown:  unknown,
+		verified: make(map[[sha256.Size]byte]time.Time),
+	}, nil
+}
+
+// parseUsersFile reads the users of a htpasswd file, with a user:hash line
+// for every user, where the hash is bcrypt. a third field lists the groups
+// of the user, separated by commas. blank lines and lines starting with #
+// are skipped
+func parseUsersFile(raw []byte) (map[string]basicUser, error) {
+	users := make(map[string]basicUser)
+	for i, line := range bytes.Split(raw, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		fields := strings.SplitN(string(line), ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("line %d: expected user:hash:groups", i+1)
+		}
+		user, hash := fields[0], []byte(fields[1])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("line %d: user %s: only bcrypt hashes are supported", i+1, user)
+		}
+		if _, ok := users[user]; ok {
+			return nil, fmt.Errorf("line %d: user %s is listed twice", i+1, user)
+		}
+
+		var groups []string
+		if len(fields) == 3 {
+			for _, group := range strings.Split(fields[2], ",") {
+				group = strings.TrimSpace(group)
+				if group != "" {
+					groups = append(groups, group)
+				}
+			}
+		}
+		users[user] = basicUser{hash: hash, groups: groups}
+	}
+	return users, nil
+}
+
+func (a *basicAuthenticator) authenticate(r *http.Request) (*identity, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, &authError{reason: "missing authentication credentials for REST request [" + r.URL.Path + "]", challenge: basicChallenge, missing: true}
+	}
+	scheme := header
+	if i := strings.IndexByte(header, ' '); i >= 0 {
+		scheme = header[:i]
+	}
+	if !strings.EqualFold(scheme, "Basic") {
+		return nil, &authError{reason: "unsupported authentication scheme [" + scheme + "]", challenge: basicChallenge, missing: true}
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, &authError{reason: "invalid basic authentication header", challenge: basicChallenge}
+	}
+	if !a.check(user, password) {
+		return nil, &authError{reason: "unable to authenticate user [" + user + "] for REST request [" + r.URL.Path + "]", challenge: basicChallenge}
+	}
+
+	groups := a.users[user].groups
+	if len(groups) == 0 {
+		groups = []string{a.C.AnonymousGroup}
+	}
+	// the password is for deflek, elasticsearch has no use for it
+	r.Header.Del("Authorization")
+	return &identity{user: user, groups: groups}, nil
+}
+
+// check reports whether the password is the one of the user
+func (a *basicAuthenticator) check(user, password string) bool {
+	u, ok := a.users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(a.unknown, []byte(password))
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(user + ":" + password + ":" + string(u.hash)))
+	now := time.Now()
+	a.mu.Lock()
+	expires, verified := a.verified[sum]
+	if verified && !now.Before(expires) {
+		delete(a.verified, sum)
+		verified = false
+	}
+	a.mu.Unlock()
+	if verified {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(u.hash, []byte(password)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	a.cacheVerified(sum, now)
+	a.mu.Unlock()
+	return true
+}
+
+// cacheVerified records checked credentials, making room by dropping the
+// expired ones, or any one when none has expired. a.mu must be held
+func (a *basicAuthenticator) cacheVerified(sum [sha256.Size]byte, now time.Time) {
+	if len(a.verified) >= basicCacheSize {
+		for other, expires := range a.verified {
+			if !now.Before(expires) {
+				delete(a.verified, other)
+			}
+		}
+	}
+	for other := range a.verified {
+		if len(a.verified) < basicCacheSize {
+			break
+		}
+		delete(a.verified, other)
+	}
+	a.verified[sum] = now.Add(basicCacheTTL)
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testUsersFile(t *testing.T, passwords map[string]string, groups map[string]string) []byte {
+	var lines []string
+	lines = append(lines, "# users of deflek", "")
+	for user, password := range passwords {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, user+":"+string(hash)+":"+groups[user])
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// withBasicUsers enables HTTP Basic auth for oncall, cron and nobody
+func withBasicUsers(t *testing.T) testOption {
+	return func(f *testFixture) {
+		f.C.Authentication.Basic.UsersFile = writeTestFile(t, "users", testUsersFile(t,
+			map[string]string{"oncall": "hunter2", "cron": "s3cret:with:colons", "nobody": "nothing"},
+			map[string]string{"oncall": "group2, ops", "cron": "group2"},
+		))
+	}
+}
+
+func TestParseUsersFile(t *testing.T) {
+	users, err := parseUsersFile(testUsersFile(t,
+		map[string]string{"oncall": "hunter2", "nobody": "nothing"},
+		map[string]string{"oncall": "group2,, ops "},
+	))
+	if err != nil {
+		t.Fatal("could not parse users file: ", err)
+	}
+	if diff := cmp.Diff([]string{"group2", "ops"}, users["oncall"].groups); diff != "" {
+		t.Errorf("unexpected groups: (-want +got)\n%s", diff)
+	}
+	if len(users["nobody"].groups) != 0 || len(users) != 2 {
+		t.Errorf("unexpected users: %v", users)
+	}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	cases := []struct {
+		file string
+		err  string
+	}{
+		{"oncall", "line 1: expected user:hash:groups"},
+		{":" + string(hash), "line 1: expected user:hash:groups"},
+		{"\noncall:$apr1$salt$hash", "line 2: user oncall: only bcrypt hashes are supported"},
+		{"oncall:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "line 1: user oncall: only bcrypt hashes are supported"},
+		{"oncall:" + string(hash) + "\noncall:" + string(hash), "line 2: user oncall is listed twice"},
+	}
+	for _, c := range cases {
+		_, err := parseUsersFile([]byte(c.file))
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%q: got error %v, expected %s", c.file, err, c.err)
+		}
+	}
+}
+
+func TestBasicAuthenticate(t *testing.T) {
+	a, err := newBasicAuthenticator(getTestConfig(withBasicUsers(t)))
+	if err != nil {
+		t.Fatal("could not get authenticator: ", err)
+	}
+
+	cases := []struct {
+		name     string
+		user     string
+		password string
+		header   string
+		expect   *identity
+		err      string
+		missing  bool
+	}{
+		{"groups", "oncall", "hunter2", "", &identity{user: "oncall", groups: []string{"group2", "ops"}}, "", false},
+		{"colons", "cron", "s3cret:with:colons", "", &identity{user: "cron", groups: []string{"group2"}}, "", false},
+		{"anonymous group", "nobody", "nothing", "", &identity{user: "nobody", groups: []string{"group1"}}, "", false},
+		{"cached", "oncall", "hunter2", "", &identity{user: "oncall", groups: []string{"group2", "ops"}}, "", false},
+		{"bad password", "oncall", "hunter3", "", nil, "unable to authenticate user [oncall] for REST request [/test_deflek/_search]", false},
+		{"unknown user", "mallory", "hunter2", "", nil, "unable to authenticate user [mallory] for REST request [/test_deflek/_search]", false},
+		{"bad header", "", "", "Basic !!!", nil, "invalid basic authentication header", false},
+		{"bearer", "", "", "Bearer token", nil, "unsupported authentication scheme [Bearer]", true},
+		{"none", "", "", "", nil, "missing authentication credentials for REST request [/test_deflek/_search]", true},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/test_deflek/_search", nil)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.password)
+		} else if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+
+		id, err := a.authenticate(req)
+		if c.err != "" {
+			e, ok := err.(*authError)
+			if !ok || e.reason != c.err || e.missing != c.missing || e.challenge != basicChallenge {
+				t.Errorf("%s: got error %#v, expected %s", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if diff := cmp.Diff(c.expect, id, cmp.AllowUnexported(identity{})); diff != "" {
+			t.Errorf("%s: unexpected identity: (-want +got)\n%s", c.name, diff)
+		}
+		if req.Header.Get("Authorization") != "" {
+			t.Errorf("%s: credentials left on the request", c.name)
+		}
+	}
+}
+
+func TestBasicCache(t *testing.T) {
+	a, err := newBasicAuthenticator(getTestConfig(withBasicUsers(t)))
+	if err != nil {
+		t.Fatal("could not get authenticator: ", err)
+	}
+	if !a.check("oncall", "hunter2") || len(a.verified) != 1 {
+		t.Fatalf("credentials not cached: %v", a.verified)
+	}
+
+	// expired credentials are checked again
+	for sum := range a.verified {
+		a.verified[sum] = time.Now().Add(-time.Second)
+	}
+	if !a.check("oncall", "hunter2") {
+		t.Error("expired credentials not checked again")
+	}
+	for sum, expires := range a.verified {
+		if !time.Now().Before(expires) {
+			t.Errorf("expired credentials %x kept", sum)
+		}
+	}
+
+	// removed users aren't let in by the cache
+	delete(a.users, "oncall")
+	if a.check("oncall", "hunter2") {
+		t.Error("removed user authenticated from the cache")
+	}
+
+	// the cache doesn't grow past its size
+	for i := 0; i < basicCacheSize; i++ {
+		a.verified[[sha256.Size]byte{byte(i), byte(i >> 8)}] = time.Now().Add(time.Minute)
+	}
+	if !a.check("cron", "s3cret:with:colons") {
+		t.Error("could not authenticate cron")
+	}
+	if len(a.verified) > basicCacheSize {
+		t.Errorf("got %d cached credentials, expected at most %d", len(a.verified), basicCacheSize)
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	c := getTestConfig(withBasicUsers(t))
+	cases := []struct {
+		names []string
+		err   string
+	}{
+		{[]string{"basic", "headers"}, ""},
+		{[]string{"client_cert", "basic"}, ""},
+		{nil, "authenticators: at least one is required"},
+		{[]string{"headers", "basic"}, "authenticators: headers must come last"},
+		{[]string{"basic", "ldap"}, "authenticators: unknown authenticator ldap"},
+		{[]string{"jwt", "basic"}, "jwt: open /etc/deflek/jwt.pem"},
+	}
+	for _, tc := range cases {
+		_, err := newAuthenticator(c, tc.names)
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tc.err)) {
+			t.Errorf("%v: got error %v, expected %s", tc.names, err, tc.err)
+		}
+	}
+
+	c.Authentication.Basic.UsersFile = ""
+	if _, err := newAuthenticator(c, []string{"basic"}); err == nil {
+		t.Error("basic authenticator without a users file")
+	}
+
+	if names := c.listenerAuthenticators(); fmt.Sprint(names) != "[headers]" {
+		t.Errorf("got default authenticators %v", names)
+	}
+	c.Authentication.JWT.Enabled = true
+	if names := c.listenerAuthenticators(); fmt.Sprint(names) != "[jwt]" {
+		t.Errorf("got default authenticators %v with jwt enabled", names)
+	}
+	if names := c.tlsListenerAuthenticators(); fmt.Sprint(names) != "[client_cert]" {
+		t.Errorf("got default authenticators %v of the TLS listener", names)
+	}
+}
+
+func TestAuthenticatorChain(t *testing.T) {
+	keys := getTestJWTKeys(t)
+	c := getTestConfig(withJWT(t, keys), withBasicUsers(t))
+
+	a, err := newAuthenticator(c, []string{"jwt", "basic", "headers"})
+	if err != nil {
+		t.Fatal("could not get authenticator: ", err)
+	}
+	req := httptest.NewRequest("GET", "/test_deflek/_search", nil)
+	req.SetBasicAuth("oncall", "hunter2")
+	req.Header.Set("X-Remote-User", "mallory")
+	if id, err := a.authenticate(req); err != nil || id.user != "oncall" {
+		t.Errorf("got identity %v and error %v, expected oncall", id, err)
+	}
+	req = httptest.NewRequest("GET", "/test_deflek/_search", nil)
+	req.SetBasicAuth("oncall", "hunter3")
+	req.Header.Set("X-Remote-User", "mallory")
+	if _, err := a.authenticate(req); err == nil {
+		t.Error("bad password fell through to the headers")
+	}
+	req = httptest.NewRequest("GET", "/test_deflek/_search", nil)
+	req.Header.Set("X-Remote-User", "alice")
+	if id, err := a.authenticate(req); err != nil || id.user != "alice" {
+		t.Errorf("got identity %v and error %v, expected alice", id, err)
+	}
+
+	// credentials the chain doesn't take aren't forwarded either
+	a, err = newAuthenticator(c, []string{"basic", "headers"})
+	if err != nil {
+		t.Fatal("could not get authenticator: ", err)
+	}
+	req = httptest.NewRequest("GET", "/test_deflek/_search", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("X-Remote-User", "alice")
+	if id, err := a.authenticate(req); err != nil || id.user != "alice" {
+		t.Errorf("got identity %v and error %v, expected alice", id, err)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Error("bearer token left on the request")
+	}
+
+	a, err = newAuthenticator(c, []string{"jwt", "basic"})
+	if err != nil {
+		t.Fatal("could not get authenticator: ", err)
+	}
+	_, err = a.authenticate(httptest.NewRequest("GET", "/test_deflek/_search", nil))
+	e, ok := err.(*authError)
+	if !ok || e.reason != "missing authentication credentials for REST request [/test_deflek/_search]" {
+		t.Fatalf("got error %v for a request without credentials", err)
+	}
+	if expected := bearerChallenge + ", " + basicChallenge; e.challenge != expected {
+		t.Errorf("got challenge %s, expected %s", e.challenge, expected)
+	}
+}
+
+func TestBasicRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"authorization":"%s"}`, r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+
+	c := getTestConfig(withBasicUsers(t))
+	c.Target = upstream.URL
+	c.Authenticators = []string{"basic", "headers"}
+	p := NewProx(c)
+	traces, mu := captureTraces(p)
+
+	req := httptest.NewRequest("GET", "/test_deflek/_search", nil)
+	req.SetBasicAuth("cron", "s3cret:with:colons")
+	w := httptest.NewRecorder()
+	p.handleRequest(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != `{"authorization":""}` {
+		t.Errorf("got status %d and body %s", w.Code, w.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/test_deflek/_search", nil)
+	req.SetBasicAuth("cron", "hunter2")
+	w = httptest.NewRecorder()
+	p.handleRequest(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d for a bad password, expected 401", w.Code)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); got != basicChallenge {
+		t.Errorf("got challenge %s, expected %s", got, basicChallenge)
+	}
+
+	// requests without credentials are left to the headers
+	req = httptest.NewRequest("GET", "/test_deflek/_search", nil)
+	req.Header.Set("X-Remote-User", "alice")
+	req.Header.Set("X-Remote-Groups", "CN=group2")
+	w = httptest.NewRecorder()
+	p.handleRequest(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d for the headers, expected 200", w.Code)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if trace, ok := traces["cron"]; !ok || fmt.Sprint(trace["groups"]) != "[group2]" {
+		t.Errorf("no trace for cron in group2: %v", traces)
+	}
+	if _, ok := traces["alice"]; !ok {
+		t.Errorf("no trace for alice: %v", traces)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// the action each bulk operation performs
+var bulkActions = map[string]string{
+	"index":  "indices:data/write/index",
+	"create": "indices:data/write/index",
+	"update": "indices:data/write/update",
+	"delete": "indices:data/write/delete",
+}
+
+// bulkMeta is the metadata of a bulk action line
+type bulkMeta struct {
+	Index string `json:"_index,omitempty"`
+	Type  string `json:"_type,omitempty"`
+	ID    string `json:"_id,omitempty"`
+}
+
+// bulkItem is one operation of a bulk request, along with the raw
+// lines it was made of
+type bulkItem struct {
+	op     string
+	meta   bulkMeta
+	action string
+	lines  [][]byte
+}
+
+// parseBulk splits a bulk body into its operations. items without an
+// `_index` target the default index from the URL
+func parseBulk(body []byte, defaultIndex string) ([]bulkItem, error) {
+	var items []bulkItem
+
+	lines := bytes.Split(body, []byte("\n"))
+	for i := 0; i < len(lines); i++ {
+		if len(bytes.TrimSpace(lines[i])) == 0 {
+			continue
+		}
+
+		var header map[string]bulkMeta
+		err := json.Unmarshal(lines[i], &header)
+		if err != nil {
+			return nil, fmt.Errorf("malformed bulk action on line %d: %v", i+1, err)
+		}
+		if len(header) != 1 {
+			return nil, fmt.Errorf("malformed bulk action on line %d: expected one operation", i+1)
+		}
+
+		for op, meta := range header {
+			action, ok := bulkActions[op]
+			if !ok {
+				return nil, fmt.Errorf("unknown bulk operation %s on line %d", op, i+1)
+			}
+			if meta.Index == "" {
+				meta.Index = defaultIndex
+			}
+
+			item := bulkItem{op: op, meta: meta, action: action, lines: [][]byte{lines[i]}}
+			// everything but delete is followed by a source line
+			if op != "delete" {
+				i++
+				if i >= len(lines) {
+					return nil, fmt.Errorf("bulk %s on line %d is missing its source", op, i)
+				}
+				item.lines = append(item.lines, lines[i])
+			}
+			items = append(items, item)
+		}
+	}
+
+	return items, nil
+}
+
+// bulkPermitted authorizes each item of a bulk request against the
+// action it performs. in partial mode the denied items are removed from
+// the request and answered with errors in the bulk response
+func bulkPermitted(ctx *requestContext) (bool, error) {
+	items, err := parseBulk(ctx.body, ctx.es.params["index"])
+	if err != nil {
+		return false, err
+	}
+
+	var indices, deniedIndices []string
+	var permitted bytes.Buffer
+	denied := make([]bool, len(items))
+	for i, item := range items {
+		indices = append(indices, item.meta.Index)
+		if indexActionPermitted(ctx, item.meta.Index, item.action) {
+			for _, line := range item.lines {
+				permitted.Write(line)
+				permitted.WriteByte('\n')
+			}
+			continue
+		}
+		denied[i] = true
+		deniedIndices = append(deniedIndices, item.op+" "+item.meta.Index)
+	}
+	ctx.indices = indices
+	ctx.trace.Access = indices
+
+	if len(deniedIndices) == 0 {
+		return true, nil
+	}
+	if !ctx.C.PartialRequests.Bulk {
+		ctx.trace.Reason = "bulk items are not whitelisted: " + strings.Join(deniedIndices, ", ")
+		return false, nil
+	}
+
+	ctx.trace.Message = fmt.Sprintf("%d of %d bulk items denied: %s",
+		len(deniedIndices), len(items), strings.Join(deniedIndices, ", "))
+
+	if len(deniedIndices) == len(items) {
+		ctx.localResponse, err = spliceBulkResponse([]byte(`{"took":0,"items":[]}`), items, denied)
+		return true, err
+	}
+
+	setRequestBody(ctx, permitted.Bytes())
+	ctx.responseMutators = append(ctx.responseMutators, func(res *http.Response, body []byte) ([]byte, error) {
+		if res.StatusCode != http.StatusOK {
+			return body, nil
+		}
+		return spliceBulkResponse(body, items, denied)
+	})
+
+	return true, nil
+}
+
+// spliceBulkResponse puts an error for every denied item into the bulk
+// response, at the position the item had in the original request
+func spliceBulkResponse(body []byte, items []bulkItem, denied []bool) ([]byte, error) {
+	body, err := spliceResponseItems(body, "items", denied, func(i int) interface{} {
+		item := items[i]
+		return map[string]interface{}{
+			item.op: struct {
+				bulkMeta
+				Status int     `json:"status"`
+				Error  esError `json:"error"`
+			}{
+				bulkMeta: item.meta,
+				Status:   http.StatusForbidden,
+				Error: esError{
+					Type:   "security_exception",
+					Reason: "action [" + item.action + "] is unauthorized for index [" + item.meta.Index + "]",
+				},
+			},
+		}
+	})
+	if err != nil {
+		return body, err
+	}
+
+	var res map[string]json.RawMessage
+	err = json.Unmarshal(body, &res)
+	if err != nil {
+		return body, err
+	}
+	res["errors"] = json.RawMessage("true")
+
+	return json.Marshal(res)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// based on the docs example, with items for several indices
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-bulk.html
+const testBulkBody = `{ "index" : { "_index" : "logs-app", "_id" : "1" } }
+{ "field1" : "value1" }
+{ "delete" : { "_index" : "logs-app", "_id" : "2" } }
+{ "create" : { "_index" : "secret_stuff", "_id" : "3" } }
+{ "field1" : "value3" }
+{ "update" : { "_id" : "1", "_index" : "audit-2018" } }
+{ "doc" : {"field2" : "value2"} }
+{ "create" : { "_id" : "4" } }
+{ "field1" : "value4" }
+`
+
+func TestParseBulk(t *testing.T) {
+	items, err := parseBulk([]byte(testBulkBody), "audit-default")
+	if err != nil {
+		t.Fatal("could not parse bulk: ", err)
+	}
+
+	type parsed struct {
+		Op, Index, ID, Action string
+		Lines                 int
+	}
+	var got []parsed
+	for _, item := range items {
+		got = append(got, parsed{item.op, item.meta.Index, item.meta.ID, item.action, len(item.lines)})
+	}
+
+	expected := []parsed{
+		{"index", "logs-app", "1", "indices:data/write/index", 2},
+		{"delete", "logs-app", "2", "indices:data/write/delete", 1},
+		{"create", "secret_stuff", "3", "indices:data/write/index", 2},
+		{"update", "audit-2018", "1", "indices:data/write/update", 2},
+		{"create", "audit-default", "4", "indices:data/write/index", 2},
+	}
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Errorf("unexpected difference: (-want +got)\n%s", diff)
+	}
+}
+
+func TestParseBulkMalformed(t *testing.T) {
+	bodies := []string{
+		`{ "index" : { "_index" : "logs-app" } }`,
+		`{ "upsert" : { "_index" : "logs-app" } }` + "\n{}\n",
+		`not json` + "\n",
+	}
+	for _, body := range bodies {
+		if _, err := parseBulk([]byte(body), ""); err == nil {
+			t.Errorf("expected error for %s", body)
+		}
+	}
+}
+
+func TestBulkDenied(t *testing.T) {
+	ctx, err := getTestContext("/audit-default/_bulk", testBulkBody, "POST", withGroups("CN=shippers"))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+
+	var p Prox
+	ok, err := p.checkRBAC(ctx)
+	if ok || err != nil {
+		t.Error("bulk with forbidden items permitted or err: ", err)
+	}
+}
+
+func TestBulkPermitted(t *testing.T) {
+	body := `{ "index" : { "_index" : "logs-app", "_id" : "1" } }
+{ "field1" : "value1" }
+{ "delete" : { "_index" : "audit-2018", "_id" : "2" } }
+`
+	ctx, err := getTestContext("/_bulk", body, "POST", withGroups("CN=shippers"))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+
+	var p Prox
+	ok, err := p.checkRBAC(ctx)
+	if !ok || err != nil {
+		t.Errorf("bulk not permitted or err: %v (%s)", err, ctx.trace.Reason)
+	}
+}
+
+func TestBulkPartial(t *testing.T) {
+	ctx, err := getTestContext("/audit-default/_bulk", testBulkBody, "POST", withGroups("CN=shippers"))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ctx.C.PartialRequests.Bulk = true
+
+	var p Prox
+	ok, err := p.checkRBAC(ctx)
+	if !ok || err != nil {
+		t.Fatalf("partial bulk not permitted or err: %v (%s)", err, ctx.trace.Reason)
+	}
+
+	// index on logs-* and create on audit-* are allowed, but not
+	// delete on logs-* or update on audit-*
+	expectedBody := `{ "index" : { "_index" : "logs-app", "_id" : "1" } }
+{ "field1" : "value1" }
+{ "create" : { "_id" : "4" } }
+{ "field1" : "value4" }
+`
+	forwarded, _ := getBody(ctx.r)
+	if diff := cmp.Diff(expectedBody, string(forwarded)); diff != "" {
+		t.Errorf("unexpected forwarded body: (-want +got)\n%s", diff)
+	}
+
+	upstream := `{"took":3,"errors":false,"items":[` +
+		`{"index":{"_index":"logs-app","_id":"1","status":201}},` +
+		`{"create":{"_index":"audit-default","_id":"4","status":201}}]}`
+	res := &http.Response{StatusCode: http.StatusOK}
+	if len(ctx.responseMutators) != 1 {
+		t.Fatalf("expected one response mutator, got %d", len(ctx.responseMutators))
+	}
+	merged, err := ctx.responseMutators[0](res, []byte(upstream))
+	if err != nil {
+		t.Fatal("could not merge response: ", err)
+	}
+
+	var got struct {
+		Took   int
+		Errors bool
+		Items  []map[string]struct {
+			Index  string `json:"_index"`
+			ID     string `json:"_id"`
+			Status int
+			Error  *esError
+		}
+	}
+	err = json.Unmarshal(merged, &got)
+	if err != nil {
+		t.Fatal("could not decode merged response: ", err)
+	}
+	if !got.Errors || got.Took != 3 {
+		t.Errorf("got errors %v and took %d, expected true and 3", got.Errors, got.Took)
+	}
+
+	expected := []struct {
+		op     string
+		index  string
+		id     string
+		status int
+	}{
+		{"index", "logs-app", "1", 201},
+		{"delete", "logs-app", "2", 403},
+		{"create", "secret_stuff", "3", 403},
+		{"update", "audit-2018", "1", 403},
+		{"create", "audit-default", "4", 201},
+	}
+	if len(got.Items) != len(expected) {
+		t.Fatalf("got %d items, expected %d", len(got.Items), len(expected))
+	}
+	for i, e := range expected {
+		item, ok := got.Items[i][e.op]
+		if !ok {
+			t.Errorf("item %d: expected %s, got %v", i, e.op, got.Items[i])
+			continue
+		}
+		if item.Index != e.index || item.ID != e.id || item.Status != e.status {
+			t.Errorf("item %d: got %s/%s %d, expected %s/%s %d", i, item.Index, item.ID, item.Status, e.index, e.id, e.status)
+		}
+		if e.status == 403 && (item.Error == nil || item.Error.Type != "security_exception") {
+			t.Errorf("item %d: expected security_exception, got %v", i, item.Error)
+		}
+	}
+}
+
+func TestBulkPartialThroughProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		items, err := parseBulk(mustReadAll(t, r), "")
+		if err != nil {
+			t.Error("upstream could not parse bulk: ", err)
+		}
+		var res []string
+		for _, item := range items {
+			res = append(res, fmt.Sprintf(`{"%s":{"_index":"%s","status":201}}`, item.op, item.meta.Index))
+		}
+		fmt.Fprintf(w, `{"took":1,"errors":false,"items":[%s]}`, strings.Join(res, ","))
+	}))
+	defer upstream.Close()
+
+	p := getTestProx(upstream.URL)
+	p.config.PartialRequests.Bulk = true
+	captureTraces(p)
+
+	cases := []struct {
+		body     string
+		statuses []int
+	}{
+		{testBulkBody, []int{201, 403, 403, 403, 201}},
+		// nothing permitted, so elasticsearch is never asked
+		{`{ "delete" : { "_index" : "secret_stuff", "_id" : "1" } }` + "\n", []int{403}},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", "/audit-default/_bulk", strings.NewReader(c.body))
+		req.Header.Add("X-Remote-User", "shipper")
+		req.Header.Add("X-Remote-Groups", "CN=shippers")
+		w := httptest.NewRecorder()
+
+		p.handleRequest(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, expected 200", w.Code)
+		}
+		var got struct {
+			Items []map[string]struct{ Status int }
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &got)
+		if err != nil {
+			t.Fatal("could not decode response: ", err, w.Body.String())
+		}
+		var statuses []int
+		for _, item := range got.Items {
+			for _, v := range item {
+				statuses = append(statuses, v.Status)
+			}
+		}
+		if diff := cmp.Diff(c.statuses, statuses); diff != "" {
+			t.Errorf("unexpected item statuses: (-want +got)\n%s", diff)
+		}
+	}
+}
+
+func mustReadAll(t *testing.T, r *http.Request) []byte {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Error("could not read body: ", err)
+	}
+	return body
+}
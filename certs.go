@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// clientCertAuthenticator authenticates requests with the client
+// certificate they were made with, as verified by the TLS listener
+type clientCertAuthenticator struct {
+	C *Config
+}
+
+func newClientCertAuthenticator(C *Config) (*clientCertAuthenticator, error) {
+	switch C.Authentication.ClientCert.UserField {
+	case "", "cn", "dns", "email", "uri":
+	default:
+		return nil, fmt.Errorf("client_cert: unsupported user_field %s", C.Authentication.ClientCert.UserField)
+	}
+	return &clientCertAuthenticator{C: C}, nil
+}
+
+func (a *clientCertAuthenticator) authenticate(r *http.Request) (*identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, &authError{reason: "a verified client certificate is required", missing: true}
+	}
+	return a.identity(r.TLS.VerifiedChains[0][0])
+}
+
+// identity maps a client certificate to its user, taken from the subject
+// CN or the first SAN of the configured kind, and its groups, which are the
+// ones mapped to the user or else the OUs of the subject
+func (a *clientCertAuthenticator) identity(cert *x509.Certificate) (*identity, error) {
+	conf := a.C.Authentication.ClientCert
+	field := conf.UserField
+	if field == "" {
+		field = "cn"
+	}
+
+	var user string
+	switch field {
+	case "cn":
+		user = cert.Subject.CommonName
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			user = cert.DNSNames[0]
+		}
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			user = cert.EmailAddresses[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			user = cert.URIs[0].String()
+		}
+	}
+	if user == "" {
+		return nil, &authError{reason: "client certificate has no " + field + " to take the user from"}
+	}
+
+	groups, ok := conf.Groups[user]
+	if !ok {
+		groups = cert.Subject.OrganizationalUnit
+	}
+	if len(groups) == 0 {
+		groups = []string{a.C.AnonymousGroup}
+	}
+
+	return &identity{user: user, groups: groups}, nil
+}
+
+// listenerTLSConfig returns the TLS config of the TLS listener, which
+// requires client certificates signed by the client CAs
+func (C *Config) listenerTLSConfig() (*tls.Config, error) {
+	conf := C.TLSListener
+	if conf.CertFile == "" || conf.KeyFile == "" || conf.ClientCAFile == "" {
+		return nil, errors.New("tls_listener: cert_file, key_file and client_ca_file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls_listener: %v", err)
+	}
+	raw, err := ioutil.ReadFile(conf.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls_listener: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("tls_listener: no certificates in client_ca_file %s", conf.ClientCAFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
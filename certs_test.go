@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testCert is a certificate along with its key, signed by the test CA
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func issueTestCert(t *testing.T, template *x509.Certificate, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parent, signer := template, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+func (c *testCert) keyPEM() []byte {
+	der, _ := x509.MarshalECPrivateKey(c.key)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func newTestCA(t *testing.T, name string) *testCert {
+	return issueTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newTestClientCert(t *testing.T, ca *testCert, cn string, ous ...string) *testCert {
+	return issueTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn, OrganizationalUnit: ous},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/beats")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "logstash", OrganizationalUnit: []string{"shippers", "group2"}},
+		DNSNames:       []string{"logstash.example.com", "ls"},
+		EmailAddresses: []string{"logstash@example.com"},
+		URIs:           []*url.URL{spiffe},
+	}
+
+	cases := []struct {
+		field  string
+		groups map[string][]string
+		user   string
+		expect []string
+	}{
+		{"", nil, "logstash", []string{"shippers", "group2"}},
+		{"dns", nil, "logstash.example.com", []string{"shippers", "group2"}},
+		{"email", nil, "logstash@example.com", []string{"shippers", "group2"}},
+		{"uri", map[string][]string{"spiffe://example.com/beats": {"metrics"}}, "spiffe://example.com/beats", []string{"metrics"}},
+		{"cn", map[string][]string{"logstash": {}}, "logstash", []string{"group1"}},
+	}
+	for _, c := range cases {
+		var conf Config
+		conf.getConf("config.example.yaml")
+		conf.Authentication.ClientCert.UserField = c.field
+		conf.Authentication.ClientCert.Groups = c.groups
+		a, err := newClientCertAuthenticator(&conf)
+		if err != nil {
+			t.Fatal("could not get authenticator: ", err)
+		}
+
+		id, err := a.identity(cert)
+		if err != nil {
+			t.Errorf("%s: %v", c.field, err)
+			continue
+		}
+		if id.user != c.user {
+			t.Errorf("%s: got user %s, expected %s", c.field, id.user, c.user)
+		}
+		if diff := cmp.Diff(c.expect, id.groups); diff != "" {
+			t.Errorf("%s: unexpected groups: (-want +got)\n%s", c.field, diff)
+		}
+	}
+
+	var conf Config
+	conf.Authentication.ClientCert.UserField = "dns"
+	a, _ := newClientCertAuthenticator(&conf)
+	if _, err := a.identity(&x509.Certificate{Subject: pkix.Name{CommonName: "logstash"}}); err == nil {
+		t.Error("certificate without a DNS SAN got a user")
+	}
+	if _, err := a.authenticate(httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Error("request without a client certificate authenticated")
+	}
+	conf.Authentication.ClientCert.UserField = "serial"
+	if _, err := newClientCertAuthenticator(&conf); err == nil {
+		t.Error("unsupported user field accepted")
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{}`)
+	}))
+	defer upstream.Close()
+
+	ca := newTestCA(t, "deflek test CA")
+	serverCert := issueTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "deflek"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+
+	c := getTestConfig()
+	c.Target = upstream.URL
+	c.TLSListener.Enabled = true
+	c.TLSListener.CertFile = writeTestFile(t, "tls.crt", serverCert.certPEM())
+	c.TLSListener.KeyFile = writeTestFile(t, "tls.key", serverCert.keyPEM())
+	c.TLSListener.ClientCAFile = writeTestFile(t, "ca.crt", ca.certPEM())
+	tlsConfig, err := c.listenerTLSConfig()
+	if err != nil {
+		t.Fatal("could not get TLS config: ", err)
+	}
+
+	p := NewProx(c)
+	traces, mu := captureTraces(p)
+	listener := httptest.NewUnstartedServer(http.HandlerFunc(p.handleTLSRequest))
+	listener.TLS = tlsConfig
+	listener.StartTLS()
+	defer listener.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(clientCerts ...tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: clientCerts},
+		}}
+		req, _ := http.NewRequest("GET", listener.URL+"/test_deflek/_search", nil)
+		// the identity headers mean nothing to the TLS listener
+		req.Header.Set("X-Remote-User", "mallory")
+		return client.Do(req)
+	}
+
+	res, err := get(newTestClientCert(t, ca, "cron", "group2").tlsCertificate())
+	if err != nil {
+		t.Fatal("request with a client certificate failed: ", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, expected 200", res.StatusCode)
+	}
+	mu.Lock()
+	if trace, ok := traces["cron"]; !ok || fmt.Sprint(trace["groups"]) != "[group2]" {
+		t.Errorf("no trace for cron in group2: %v", traces)
+	}
+	mu.Unlock()
+
+	// the groups of logstash are configured, whatever its certificate says
+	res, err = get(newTestClientCert(t, ca, "logstash", "group2").tlsCertificate())
+	if err != nil {
+		t.Fatal("request with a client certificate failed: ", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d for a group without the index, expected 403", res.StatusCode)
+	}
+
+	if _, err := get(); err == nil {
+		t.Error("request without a client certificate succeeded")
+	}
+	other := newTestCA(t, "other CA")
+	if _, err := get(newTestClientCert(t, other, "logstash", "group2").tlsCertificate()); err == nil {
+		t.Error("request with a client certificate of another CA succeeded")
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/inconshreveable/log15"
+	glob "github.com/ryanuber/go-glob"
+)
+
+// indexCache is a periodically refreshed view of the indices and aliases
+// of the cluster, used to resolve index expressions to concrete indices
+type indexCache struct {
+	target *url.URL
+	client *http.Client
+
+	mu        sync.RWMutex
+	indexList []string
+	aliasMap  map[string]esAlias
+	// the aliases pointing at each index
+	indexAliases map[string][]string
+	refreshed    time.Time
+}
+
+// esAlias is an alias and the indices it points to. filtered aliases
+// only show the documents matching their filter
+type esAlias struct {
+	Indices  []string
+	Filtered bool
+}
+
+func newIndexCache(target *url.URL, transport http.RoundTripper) *indexCache {
+	return &indexCache{
+		target: target,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   30 * time.Second,
+		},
+	}
+}
+
+// get decodes the JSON response of an elasticsearch API
+func (c *indexCache) get(path string, v interface{}) error {
+	res, err := c.client.Get(strings.TrimSuffix(c.target.String(), "/") + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %d", path, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// refresh reloads the indices and aliases from the cluster
+func (c *indexCache) refresh() error {
+	var catIndices []struct {
+		Index string `json:"index"`
+	}
+	err := c.get("/_cat/indices?format=json&h=index", &catIndices)
+	if err != nil {
+		return err
+	}
+
+	var catAliases map[string]struct {
+		Aliases map[string]struct {
+			Filter json.RawMessage `json:"filter"`
+		} `json:"aliases"`
+	}
+	err = c.get("/_alias", &catAliases)
+	if err != nil {
+		return err
+	}
+
+	var indices []string
+	for _, index := range catIndices {
+		indices = append(indices, index.Index)
+	}
+	aliases := map[string]esAlias{}
+	for index, entry := range catAliases {
+		for name, alias := range entry.Aliases {
+			a := aliases[name]
+			a.Indices = append(a.Indices, index)
+			a.Filtered = a.Filtered || len(alias.Filter) > 0
+			aliases[name] = a
+		}
+	}
+	// the response is a map, so keep the indices of aliases in a stable order
+	for name := range aliases {
+		sort.Strings(aliases[name].Indices)
+	}
+
+	c.set(indices, aliases)
+	return nil
+}
+
+func (c *indexCache) set(indices []string, aliases map[string]esAlias) {
+	indexAliases := map[string][]string{}
+	for name, alias := range aliases {
+		for _, index := range alias.Indices {
+			indexAliases[index] = append(indexAliases[index], name)
+		}
+	}
+	for index := range indexAliases {
+		sort.Strings(indexAliases[index])
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.indexList = indices
+	c.aliasMap = aliases
+	c.indexAliases = indexAliases
+	c.refreshed = time.Now()
+}
+
+// run refreshes the cache forever
+func (c *indexCache) run(interval time.Duration, logger log.Logger) {
+	for {
+		err := c.refresh()
+		if err != nil {
+			logger.Warn("could not refresh indices from elasticsearch", log.Ctx{"err": err.Error()})
+		}
+		time.Sleep(interval)
+	}
+}
+
+// loaded reports whether the cache has a view of the cluster at all
+func (c *indexCache) loaded() bool {
+	if c == nil {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return !c.refreshed.IsZero()
+}
+
+// indices returns the concrete indices of the cluster. the slice is
+// replaced on refresh, never modified, so it's safe to keep using
+func (c *indexCache) indices() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.indexList
+}
+
+// aliases returns the aliases of the cluster and the indices they point to
+func (c *indexCache) aliases() map[string]esAlias {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.aliasMap
+}
+
+// alias looks up an alias by name
+func (c *indexCache) alias(name string) (esAlias, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	alias, ok := c.aliasMap[name]
+	return alias, ok
+}
+
+// aliasIfLoaded looks up an alias by name, when the cluster is known
+func (c *indexCache) aliasIfLoaded(name string) (esAlias, bool) {
+	if !c.loaded() {
+		return esAlias{}, false
+	}
+	return c.alias(name)
+}
+
+// aliasesOf returns the names of the aliases pointing at the index
+func (c *indexCache) aliasesOf(index string) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.indexAliases[index]
+}
+
+// hasWildcard reports whether an index expression needs resolving
+func hasWildcard(expressions []string) bool {
+	for _, expr := range expressions {
+		if expr == "_all" || strings.Contains(expr, "*") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveIndices expands wildcards, `_all` and exclusions in the index
+// expressions to the indices the action is permitted on. like
+// elasticsearch, an exclusion only applies after a wildcard. indices
+// named explicitly are kept as they are, to be authorized by name
+func resolveIndices(ctx *requestContext, expressions []string, action string) []string {
+	var resolved, exclusions []string
+	seen := map[string]bool{}
+	wildcard := false
+	for _, expr := range expressions {
+		switch {
+		case wildcard && strings.HasPrefix(expr, "-"):
+			exclusion := strings.TrimPrefix(expr, "-")
+			var kept []string
+			for _, name := range resolved {
+				if glob.Glob(exclusion, name) {
+					delete(seen, name)
+				} else {
+					kept = append(kept, name)
+				}
+			}
+			resolved = kept
+			exclusions = append(exclusions, expr)
+		case expr == "_all" || strings.Contains(expr, "*"):
+			wildcard = true
+			for _, name := range expandWildcard(ctx, expr, action) {
+				if !seen[name] {
+					seen[name] = true
+					resolved = append(resolved, name)
+				}
+			}
+		case !seen[expr]:
+			seen[expr] = true
+			resolved = append(resolved, expr)
+		}
+	}
+
+	// without a view of the cluster the resolved names can still be
+	// patterns, so elasticsearch has to apply the exclusions and deny
+	// rules to them
+	if !ctx.cluster.loaded() && hasWildcard(resolved) {
+		resolved = append(resolved, exclusions...)
+		for _, deniedIndex := range ctx.deniedIndices {
+			if deniedIndex.denies(ctx.r.Method, action) {
+				resolved = append(resolved, "-"+deniedIndex.Name)
+			}
+		}
+	}
+
+	return resolved
+}
+
+// expandWildcard lists the permitted indices matching the wildcard. without
+// a view of the cluster it falls back to the whitelisted index patterns
+func expandWildcard(ctx *requestContext, expr string, action string) []string {
+	if expr == "_all" {
+		expr = "*"
+	}
+
+	var names []string
+	if ctx.cluster.loaded() {
+		for _, name := range ctx.cluster.indices() {
+			if wildcardMatches(expr, name) && indexActionPermitted(ctx, name, action) {
+				names = append(names, name)
+			}
+		}
+
+		// like elasticsearch, wildcards match aliases too
+		aliases := ctx.cluster.aliases()
+		var aliasNames []string
+		for name := range aliases {
+			if wildcardMatches(expr, name) {
+				aliasNames = append(aliasNames, name)
+			}
+		}
+		sort.Strings(aliasNames)
+		for _, name := range aliasNames {
+			alias := aliases[name]
+			if !alias.Filtered {
+				for _, index := range alias.Indices {
+					if indexActionPermitted(ctx, index, action) {
+						names = append(names, index)
+					}
+				}
+				continue
+			}
+			// a filtered alias is only needed when its indices can't be
+			// reached directly, otherwise documents would show up twice
+			if ctx.granted(name, action, true) && !allPermitted(ctx, alias.Indices, action) {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+
+	for _, whitelistedIndex := range ctx.whitelistedIndices {
+		if !whitelistedIndex.permits(ctx.r.Method, action) {
+			continue
+		}
+		switch {
+		case wildcardMatches(expr, whitelistedIndex.Name):
+			names = append(names, whitelistedIndex.Name)
+		// the wildcard is narrower than the whitelisted pattern
+		case glob.Glob(whitelistedIndex.Name, expr):
+			names = append(names, expr)
+		}
+	}
+	return names
+}
+
+// wildcardMatches reports whether the wildcard covers the index. dot
+// prefixed indices, like .kibana, are only matched by wildcards that
+// start with a dot
+func wildcardMatches(expr, index string) bool {
+	if strings.HasPrefix(index, ".") && !strings.HasPrefix(expr, ".") {
+		return false
+	}
+	return glob.Glob(expr, index)
+}
+
+// isExclusion reports whether the index at i is an exclusion, rather
+// than an index that has to be authorized
+func isExclusion(indices []string, i int) bool {
+	return strings.HasPrefix(indices[i], "-") && hasWildcard(indices[:i])
+}
+
+// allPermitted reports whether the action is permitted on every index
+func allPermitted(ctx *requestContext, indices []string, action string) bool {
+	for _, index := range indices {
+		if !indexActionPermitted(ctx, index, action) {
+			return false
+		}
+	}
+	return len(indices) > 0
+}
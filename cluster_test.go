@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeCluster answers the APIs the index cache refreshes from
+func fakeCluster(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_cat/indices":
+			if r.URL.Query().Get("format") != "json" {
+				t.Errorf("_cat/indices requested without format=json")
+			}
+			fmt.Fprint(w, `[{"index":"test_deflek"},{"index":"test_deflek2"},{"index":"test_secret"},
+				{"index":"globby-1"},{"index":"globby-2"},{"index":"app-1"},{"index":"app-2"},
+				{"index":".kibana"},{"index":".security"}]`)
+		case "/_alias":
+			fmt.Fprint(w, `{"test_deflek":{"aliases":{"mixed":{}}},"test_secret":{"aliases":{"mixed":{},
+				"reports":{"filter":{"term":{"public":true}}}}},"globby-1":{"aliases":{"globby":{}}},
+				"globby-2":{"aliases":{"globby":{},"latest":{}}},"app-1":{"aliases":{"app":{}}},
+				"app-2":{"aliases":{"app":{}}},".kibana":{"aliases":{}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func getTestIndexCache(t *testing.T) *indexCache {
+	cluster := fakeCluster(t)
+	defer cluster.Close()
+
+	target, _ := url.Parse(cluster.URL)
+	cache := newIndexCache(target, newTraceTransport())
+	if cache.loaded() {
+		t.Error("index cache loaded before refresh")
+	}
+	err := cache.refresh()
+	if err != nil {
+		t.Fatal("could not refresh index cache: ", err)
+	}
+	return cache
+}
+
+func TestIndexCacheRefresh(t *testing.T) {
+	cache := getTestIndexCache(t)
+
+	if !cache.loaded() {
+		t.Error("index cache not loaded after refresh")
+	}
+
+	expectedIndices := []string{"test_deflek", "test_deflek2", "test_secret", "globby-1", "globby-2",
+		"app-1", "app-2", ".kibana", ".security"}
+	if diff := cmp.Diff(expectedIndices, cache.indices()); diff != "" {
+		t.Errorf("unexpected indices: (-want +got)\n%s", diff)
+	}
+
+	expectedAliases := map[string]esAlias{
+		"globby":  {Indices: []string{"globby-1", "globby-2"}},
+		"latest":  {Indices: []string{"globby-2"}},
+		"app":     {Indices: []string{"app-1", "app-2"}},
+		"mixed":   {Indices: []string{"test_deflek", "test_secret"}},
+		"reports": {Indices: []string{"test_secret"}, Filtered: true},
+	}
+	if diff := cmp.Diff(expectedAliases, cache.aliases()); diff != "" {
+		t.Errorf("unexpected aliases: (-want +got)\n%s", diff)
+	}
+
+	if diff := cmp.Diff([]string{"mixed", "reports"}, cache.aliasesOf("test_secret")); diff != "" {
+		t.Errorf("unexpected aliases of test_secret: (-want +got)\n%s", diff)
+	}
+}
+
+func TestIndexCacheRefreshError(t *testing.T) {
+	cluster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer cluster.Close()
+
+	target, _ := url.Parse(cluster.URL)
+	cache := newIndexCache(target, newTraceTransport())
+	if err := cache.refresh(); err == nil {
+		t.Error("expected refresh against an unavailable cluster to fail")
+	}
+	if cache.loaded() {
+		t.Error("index cache loaded after failed refresh")
+	}
+}
+
+func TestResolveWildcardPaths(t *testing.T) {
+	cache := getTestIndexCache(t)
+
+	cases := []struct {
+		method   string
+		path     string
+		expected string
+	}{
+		{"GET", "/_all/_search?q=tag:wow", "/test_deflek,test_deflek2,globby-1,globby-2/_search?q=tag:wow"},
+		{"GET", "/*/_search", "/test_deflek,test_deflek2,globby-1,globby-2/_search"},
+		{"GET", "/_search?size=0", "/test_deflek,test_deflek2,globby-1,globby-2/_search?size=0"},
+		{"GET", "/_mapping", "/test_deflek,test_deflek2,globby-1,globby-2/_mapping"},
+		{"GET", "/test*/_search", "/test_deflek,test_deflek2/_search"},
+		{"GET", "/log*,test*/_count", "/test_deflek,test_deflek2/_count"},
+		{"GET", "/globby-*,-globby-2/_search", "/globby-1/_search"},
+		{"GET", "/.*/_search", "/.kibana/_search"},
+		{"POST", "/test*/_search", "/test_deflek/_search"},
+		// indices named explicitly are authorized by name
+		{"GET", "/test_deflek,secret*/_search", "/test_deflek/_search"},
+		{"GET", "/test_deflek/_search", "/test_deflek/_search"},
+		// APIs that don't return data of indices aren't scoped to them
+		{"POST", "/_analyze", "/_analyze"},
+		{"POST", "/_refresh", "/_refresh"},
+		{"GET", "/_segments", "/_segments"},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, "", c.method)
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+		ctx.cluster = cache
+
+		ok, err := indexPermitted(ctx)
+		if !ok || err != nil {
+			t.Errorf("%s %s: not permitted or err: %v (%s)", c.method, c.path, err, ctx.trace.Reason)
+			continue
+		}
+		if got := ctx.r.URL.RequestURI(); got != c.expected {
+			t.Errorf("%s %s: got %s, expected %s", c.method, c.path, got, c.expected)
+		}
+	}
+}
+
+func TestResolveWildcardDenied(t *testing.T) {
+	cache := getTestIndexCache(t)
+
+	for _, path := range []string{
+		"/secret*/_search",
+		"/test_secret,test*/_search",
+		"/-test_deflek/_search",
+	} {
+		ctx, err := getTestContext(path, "", "GET")
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+		ctx.cluster = cache
+
+		ok, err := indexPermitted(ctx)
+		if ok || err != nil {
+			t.Errorf("GET %s: permitted or err: %v", path, err)
+		}
+	}
+
+	// the deny rule on globby-2 leaves nothing for the wildcard to match
+	ctx, err := getTestContext("/globby-2*/_search", "", "GET", withGroups("CN=group2,CN=contractors"))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ctx.cluster = cache
+
+	ok, err := indexPermitted(ctx)
+	if ok || err != nil {
+		t.Errorf("GET /globby-2*/_search: permitted or err: %v", err)
+	}
+}
+
+func TestResolveWildcardBody(t *testing.T) {
+	body := `{"index":"*","ignore":[404]}
+{"size":0}
+`
+	ctx, err := getTestContext("/*/_search", body, "GET")
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ctx.cluster = getTestIndexCache(t)
+
+	ok, err := indexPermitted(ctx)
+	if !ok || err != nil {
+		t.Fatalf("not permitted or err: %v (%s)", err, ctx.trace.Reason)
+	}
+
+	expected := `{"index":"test_deflek,test_deflek2,globby-1,globby-2","ignore":[404]}
+{"size":0}
+`
+	if diff := cmp.Diff(expected, string(ctx.body)); diff != "" {
+		t.Errorf("unexpected body: (-want +got)\n%s", diff)
+	}
+}
+
+func TestResolveIndicesFallback(t *testing.T) {
+	ctx, err := getTestContext("/_search", "", "GET")
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+
+	cases := []struct {
+		expressions []string
+		expected    []string
+	}{
+		{[]string{"_all"}, []string{"test_deflek", "test_deflek2", "globby-*"}},
+		{[]string{"globby-te*"}, []string{"globby-te*"}},
+		{[]string{"*", "-globby-secret"}, []string{"test_deflek", "test_deflek2", "globby-*", "-globby-secret"}},
+		{[]string{"*", "-globby-*"}, []string{"test_deflek", "test_deflek2"}},
+		{[]string{"secret*"}, nil},
+	}
+
+	for _, c := range cases {
+		got := resolveIndices(ctx, c.expressions, "indices:data/read/search")
+		if diff := cmp.Diff(c.expected, got); diff != "" {
+			t.Errorf("%v: unexpected indices: (-want +got)\n%s", c.expressions, diff)
+		}
+	}
+}
+
+func TestAliasPermitted(t *testing.T) {
+	cache := getTestIndexCache(t)
+
+	cases := []struct {
+		groups    string
+		path      string
+		permitted bool
+	}{
+		// granting the indices behind an alias grants the alias
+		{"CN=group2", "/globby/_search", true},
+		{"CN=group2", "/latest/_search", true},
+		// an alias can't be used to reach indices that aren't granted
+		{"CN=group2", "/mixed/_search", false},
+		{"CN=group2", "/reports/_search", false},
+		{"CN=group2", "/app/_search", false},
+
+		// granting an alias grants the indices behind it
+		{"CN=partners", "/app/_search", true},
+		{"CN=partners", "/app-1/_search", true},
+		{"CN=partners", "/app-1,app-2/_search", true},
+		// but not when the alias is filtered
+		{"CN=partners", "/reports/_search", true},
+		{"CN=partners", "/test_secret/_search", false},
+		{"CN=partners", "/mixed/_search", false},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, "", "GET", withGroups(c.groups))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+		ctx.cluster = cache
+
+		ok, err := indexPermitted(ctx)
+		if err != nil {
+			t.Errorf("%s %s: %v", c.groups, c.path, err)
+		}
+		if ok != c.permitted {
+			t.Errorf("%s %s: got permitted %v, expected %v (%s)", c.groups, c.path, ok, c.permitted, ctx.trace.Reason)
+		}
+	}
+}
+
+func TestResolveIndicesFallbackDenied(t *testing.T) {
+	ctx, err := getTestContext("/_search", "", "GET", withGroups("CN=group2,CN=contractors"))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+
+	// patterns are left to elasticsearch to expand, so it gets the deny
+	// rules as exclusions
+	got := resolveIndices(ctx, []string{"globby-*"}, "indices:data/read/search")
+	expected := []string{"globby-*", "-globby-2"}
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Errorf("unexpected indices: (-want +got)\n%s", diff)
+	}
+}
+
+func TestResolveWildcardAliases(t *testing.T) {
+	cache := getTestIndexCache(t)
+
+	cases := []struct {
+		groups   string
+		path     string
+		expected string
+	}{
+		// the filtered alias stands in for the index it can't reach
+		{"CN=partners", "/*/_search", "/app-1,app-2,reports/_search"},
+		{"CN=partners", "/_search", "/app-1,app-2,reports/_search"},
+		// wildcards matching an alias reach the indices behind it
+		{"CN=partners", "/ap*/_search", "/app-1,app-2/_search"},
+		{"CN=group2", "/glob*/_search", "/globby-1,globby-2/_search"},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, "", "GET", withGroups(c.groups))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+		ctx.cluster = cache
+
+		ok, err := indexPermitted(ctx)
+		if !ok || err != nil {
+			t.Errorf("%s %s: not permitted or err: %v (%s)", c.groups, c.path, err, ctx.trace.Reason)
+			continue
+		}
+		if got := ctx.r.URL.RequestURI(); got != c.expected {
+			t.Errorf("%s %s: got %s, expected %s", c.groups, c.path, got, c.expected)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the kinds of IDs handed out by elasticsearch that let a request carry on
+// with what another request started
+const (
+	scrollContext = "scroll"
+	pitContext    = "point in time"
+	asyncContext  = "async search"
+)
+
+// how long contexts are remembered when the request doesn't say, and the
+// slack given on top of the keep alive so they outlive elasticsearch's
+const (
+	defaultContextTTL = 5 * time.Minute
+	asyncContextTTL   = 5 * 24 * time.Hour
+	contextTTLSlack   = time.Minute
+)
+
+// searchContext is who a scroll, point in time or async search belongs to
+type searchContext struct {
+	owner string
+	// the indices a point in time was opened on
+	indices []string
+	expires time.Time
+}
+
+// contextStore remembers the owners of the scroll, point in time and async
+// search IDs elasticsearch handed out, so only they can use them. owners are
+// only kept in memory: they are lost when deflek restarts, and aren't shared
+// between the deflek instances behind a load balancer, so the IDs they
+// handed out are refused elsewhere
+type contextStore struct {
+	mu       sync.Mutex
+	contexts map[string]searchContext
+	swept    time.Time
+}
+
+func newContextStore() *contextStore {
+	return &contextStore{contexts: map[string]searchContext{}}
+}
+
+func searchContextKey(kind string, id string) string {
+	return kind + "\x00" + id
+}
+
+// add records the owner of the ID until the TTL runs out
+func (s *contextStore) add(kind string, id string, owner string, indices []string, ttl time.Duration) {
+	if s == nil || id == "" {
+		return
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.contexts[searchContextKey(kind, id)] = searchContext{owner: owner, indices: indices, expires: now.Add(ttl + contextTTLSlack)}
+
+	// forget expired contexts every now and then
+	if now.Sub(s.swept) > time.Minute {
+		for key, c := range s.contexts {
+			if now.After(c.expires) {
+				delete(s.contexts, key)
+			}
+		}
+		s.swept = now
+	}
+}
+
+// get returns the context of the ID, if it was handed out and hasn't expired
+func (s *contextStore) get(kind string, id string) (searchContext, bool) {
+	if s == nil {
+		return searchContext{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.contexts[searchContextKey(kind, id)]
+	if !ok || time.Now().After(c.expires) {
+		return searchContext{}, false
+	}
+	return c, true
+}
+
+// extend keeps the context of the ID for the TTL from now
+func (s *contextStore) extend(kind string, id string, ttl time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.contexts[searchContextKey(kind, id)]; ok {
+		c.expires = time.Now().Add(ttl + contextTTLSlack)
+		s.contexts[searchContextKey(kind, id)] = c
+	}
+}
+
+func (s *contextStore) remove(kind string, id string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.contexts, searchContextKey(kind, id))
+}
+
+// owner is who the request is made by, which is what contexts belong to
+func (ctx *requestContext) owner() string {
+	if user, _ := getUser(ctx.r, ctx.C); user != "" {
+		return "user " + user
+	}
+	return "groups " + strings.Join(getGroups(ctx.r, ctx.C), ",")
+}
+
+// parseTimeValue parses an elasticsearch time value, like `1m` or `30s`
+func parseTimeValue(value string) (time.Duration, bool) {
+	units := []struct {
+		suffix string
+		unit   time.Duration
+	}{
+		// longest first, so `ms` isn't taken for `s`
+		{"micros", time.Microsecond}, {"nanos", time.Nanosecond}, {"ms", time.Millisecond},
+		{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second},
+	}
+	value = strings.TrimSpace(value)
+	for _, u := range units {
+		if !strings.HasSuffix(value, u.suffix) {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(value, u.suffix), 10, 64)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		return time.Duration(n) * u.unit, true
+	}
+	return 0, false
+}
+
+// keepAlive returns how long the request asks elasticsearch to keep its
+// context around
+func keepAlive(value string, fallback time.Duration) time.Duration {
+	if ttl, ok := parseTimeValue(value); ok {
+		return ttl
+	}
+	return fallback
+}
+
+// contextRequest is the parts of request bodies naming contexts
+type contextRequest struct {
+	ScrollID interface{} `json:"scroll_id"`
+	Scroll   string      `json:"scroll"`
+	ID       string      `json:"id"`
+	Pit      *struct {
+		ID        string `json:"id"`
+		KeepAlive string `json:"keep_alive"`
+	} `json:"pit"`
+}
+
+func parseContextRequest(body []byte) contextRequest {
+	var req contextRequest
+	// bodies that aren't JSON don't name contexts
+	json.Unmarshal(body, &req)
+	return req
+}
+
+// scrollIDs returns the scroll IDs of a scroll request, from the path, the
+// query string or the body
+func (ctx *requestContext) scrollIDs() []string {
+	var ids []string
+	add := func(value string) {
+		for _, id := range strings.Split(value, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	add(ctx.es.params["scroll_id"])
+	add(ctx.r.URL.Query().Get("scroll_id"))
+	switch id := parseContextRequest(ctx.body).ScrollID.(type) {
+	case string:
+		add(id)
+	case []interface{}:
+		for _, item := range id {
+			if s, ok := item.(string); ok {
+				add(s)
+			}
+		}
+	}
+	return ids
+}
+
+// ownContext checks the caller owns the context of the ID
+func (ctx *requestContext) ownContext(kind string, id string) (searchContext, bool) {
+	c, ok := ctx.contexts.get(kind, id)
+	if !ok {
+		ctx.trace.Reason = kind + " " + id + " is unknown or expired"
+		return c, false
+	}
+	if c.owner != ctx.owner() {
+		ctx.trace.Reason = kind + " " + id + " belongs to " + c.owner
+		return c, false
+	}
+	return c, true
+}
+
+// contextsPermitted only lets scrolls, points in time and async searches be
+// used by who started them, and records the ones the request starts
+func contextsPermitted(ctx *requestContext) (bool, error) {
+	action := ctx.action()
+	query := ctx.r.URL.Query()
+
+	switch action {
+	case "indices:data/read/search":
+		if query.Get("scroll") != "" {
+			ctx.recordContext(scrollContext, "_scroll_id", keepAlive(query.Get("scroll"), defaultContextTTL))
+		}
+		if pit := parseContextRequest(ctx.body).Pit; pit != nil {
+			ctx.recordContext(pitContext, "pit_id", keepAlive(pit.KeepAlive, defaultContextTTL))
+		}
+
+	case "indices:data/read/scroll":
+		ids := ctx.scrollIDs()
+		if len(ids) == 0 {
+			ctx.trace.Reason = "scroll without a scroll ID"
+			return false, nil
+		}
+		for _, id := range ids {
+			if _, ok := ctx.ownContext(scrollContext, id); !ok {
+				return false, nil
+			}
+		}
+		scroll := query.Get("scroll")
+		if scroll == "" {
+			scroll = parseContextRequest(ctx.body).Scroll
+		}
+		ctx.recordContext(scrollContext, "_scroll_id", keepAlive(scroll, defaultContextTTL))
+
+	case "indices:data/read/scroll/clear":
+		ids := ctx.scrollIDs()
+		for _, id := range ids {
+			// clearing every scroll clears the ones of everybody else
+			if id == "_all" {
+				ok, err := canManage(ctx.r, ctx.C)
+				if err != nil || !ok {
+					ctx.trace.Reason = "clearing all scrolls requires can_manage"
+					return false, err
+				}
+				continue
+			}
+			if _, ok := ctx.ownContext(scrollContext, id); !ok {
+				return false, nil
+			}
+		}
+		ctx.releaseContexts(scrollContext, ids)
+
+	case "indices:data/read/open_point_in_time":
+		ctx.recordContext(pitContext, "id", keepAlive(query.Get("keep_alive"), defaultContextTTL))
+
+	case "indices:data/read/close_point_in_time":
+		id := parseContextRequest(ctx.body).ID
+		if _, ok := ctx.ownContext(pitContext, id); !ok {
+			return false, nil
+		}
+		ctx.releaseContexts(pitContext, []string{id})
+
+	case "indices:data/read/async_search/submit":
+		ctx.recordContext(asyncContext, "id", keepAlive(query.Get("keep_alive"), asyncContextTTL))
+
+	case "indices:data/read/async_search/get", "cluster:monitor/async_search/status":
+		if _, ok := ctx.ownContext(asyncContext, ctx.es.params["id"]); !ok {
+			return false, nil
+		}
+		if ttl, ok := parseTimeValue(query.Get("keep_alive")); ok {
+			ctx.contexts.extend(asyncContext, ctx.es.params["id"], ttl)
+		}
+
+	case "indices:data/read/async_search/delete":
+		id := ctx.es.params["id"]
+		if _, ok := ctx.ownContext(asyncContext, id); !ok {
+			return false, nil
+		}
+		ctx.releaseContexts(asyncContext, []string{id})
+	}
+
+	return true, nil
+}
+
+// contextIDs are the fields of responses holding the IDs of contexts. the
+// rest of the response, like the hits, is skipped when decoding
+type contextIDs struct {
+	ScrollID string `json:"_scroll_id"`
+	PitID    string `json:"pit_id"`
+	ID       string `json:"id"`
+}
+
+func (ids contextIDs) get(field string) string {
+	switch field {
+	case "_scroll_id":
+		return ids.ScrollID
+	case "pit_id":
+		return ids.PitID
+	}
+	return ids.ID
+}
+
+// recordContext remembers the caller as the owner of the ID elasticsearch
+// answers with in the field of the response
+func (ctx *requestContext) recordContext(kind string, field string, ttl time.Duration) {
+	owner := ctx.owner()
+	var indices []string
+	for i, index := range ctx.indices {
+		if !isExclusion(ctx.indices, i) {
+			indices = append(indices, index)
+		}
+	}
+	ctx.responseMutators = append(ctx.responseMutators, func(res *http.Response, body []byte) ([]byte, error) {
+		if res.StatusCode != http.StatusOK {
+			return body, nil
+		}
+		var ids contextIDs
+		json.Unmarshal(body, &ids)
+		if id := ids.get(field); id != "" {
+			ctx.contexts.add(kind, id, owner, indices, ttl)
+		}
+		return body, nil
+	})
+}
+
+// releaseContexts forgets the IDs once elasticsearch let go of them
+func (ctx *requestContext) releaseContexts(kind string, ids []string) {
+	ctx.responseMutators = append(ctx.responseMutators, func(res *http.Response, body []byte) ([]byte, error) {
+		if res.StatusCode == http.StatusOK {
+			for _, id := range ids {
+				ctx.contexts.remove(kind, id)
+			}
+		}
+		return body, nil
+	})
+}
+
+// pitSearchPermitted authorizes a search on a point in time, which has no
+// indices of its own and runs on the indices the point in time was opened
+// on
+func pitSearchPermitted(ctx *requestContext, id string) (bool, error) {
+	c, ok := ctx.ownContext(pitContext, id)
+	if !ok {
+		return false, nil
+	}
+	if len(ctx.es.indices) > 0 {
+		ctx.trace.Reason = "searches on a point in time can't name indices"
+		return false, nil
+	}
+
+	ctx.indices = c.indices
+	ctx.trace.Access = c.indices
+	for _, index := range c.indices {
+		if !indexActionPermitted(ctx, index, ctx.action()) {
+			ctx.trace.Reason = indexDenialReason(ctx, index, ctx.action())
+			return false, nil
+		}
+	}
+
+	ok, err := fieldLevelSecurity(ctx, c.indices)
+	if err != nil || !ok {
+		return false, err
+	}
+	return documentLevelSecurity(ctx, c.indices)
+}
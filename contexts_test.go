@@ -0,0 +1,235 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseTimeValue(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"1m", time.Minute, true},
+		{"30s", 30 * time.Second, true},
+		{"500ms", 500 * time.Millisecond, true},
+		{"5d", 5 * 24 * time.Hour, true},
+		{"1h", time.Hour, true},
+		{"", 0, false},
+		{"1y", 0, false},
+		{"-1m", 0, false},
+	}
+
+	for _, c := range cases {
+		got, ok := parseTimeValue(c.value)
+		if got != c.expected || ok != c.ok {
+			t.Errorf("%s: got %v %v, expected %v %v", c.value, got, ok, c.expected, c.ok)
+		}
+	}
+}
+
+// respond runs the response mutators of the request on a response
+func respond(t *testing.T, ctx *requestContext, body string) {
+	res := &http.Response{StatusCode: http.StatusOK}
+	data := []byte(body)
+	for _, mutate := range ctx.responseMutators {
+		var err error
+		data, err = mutate(res, data)
+		if err != nil {
+			t.Fatal("could not mutate response: ", err)
+		}
+	}
+}
+
+// withContextStore records the owners of contexts in the store
+func withContextStore(store *contextStore) testOption {
+	return func(f *testFixture) {
+		f.store = store
+	}
+}
+
+func TestScrollOwnership(t *testing.T) {
+	store := newContextStore()
+	var p Prox
+
+	ctx, err := getTestContext("/test_deflek/_search?scroll=1m", "", "GET", withUser("alice"), withGroups("CN=group2"), withContextStore(store))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ok, err := p.checkRBAC(ctx)
+	if err != nil || !ok {
+		t.Fatalf("scroll search denied: %v (%s)", err, ctx.trace.Reason)
+	}
+	respond(t, ctx, `{"_scroll_id":"c2Nhbg==","hits":{"hits":[]}}`)
+
+	cases := []struct {
+		user      string
+		body      string
+		permitted bool
+	}{
+		{"alice", `{"scroll":"1m","scroll_id":"c2Nhbg=="}`, true},
+		{"bob", `{"scroll":"1m","scroll_id":"c2Nhbg=="}`, false},
+		{"alice", `{"scroll":"1m","scroll_id":"unknown"}`, false},
+		{"alice", `{"scroll":"1m"}`, false},
+	}
+	for _, c := range cases {
+		ctx, err := getTestContext("/_search/scroll", c.body, "POST", withUser(c.user), withGroups("CN=group2"), withContextStore(store))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+		ok, err := p.checkRBAC(ctx)
+		if err != nil {
+			t.Errorf("%s %s: %v", c.user, c.body, err)
+		}
+		if ok != c.permitted {
+			t.Errorf("%s %s: got permitted %v, expected %v (%s)", c.user, c.body, ok, c.permitted, ctx.trace.Reason)
+		}
+	}
+
+	// continuing a scroll can hand out a new scroll ID
+	ctx, err = getTestContext("/_search/scroll/c2Nhbg==?scroll=1m", "", "GET", withUser("alice"), withGroups("CN=group2"), withContextStore(store))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ok, err = p.checkRBAC(ctx)
+	if err != nil || !ok {
+		t.Fatalf("scroll continuation denied: %v (%s)", err, ctx.trace.Reason)
+	}
+	respond(t, ctx, `{"_scroll_id":"bmV3","hits":{"hits":[]}}`)
+	if c, ok := store.get(scrollContext, "bmV3"); !ok || c.owner != "user alice" {
+		t.Errorf("new scroll ID not recorded for alice: %+v", c)
+	}
+
+	// clearing
+	ctx, err = getTestContext("/_search/scroll", `{"scroll_id":["c2Nhbg==","bmV3"]}`, "DELETE", withUser("bob"), withGroups("CN=group2"), withContextStore(store))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	if ok, _ := contextsPermitted(ctx); ok {
+		t.Error("bob cleared the scrolls of alice")
+	}
+	ctx, err = getTestContext("/_search/scroll", `{"scroll_id":["c2Nhbg==","bmV3"]}`, "DELETE", withUser("alice"), withGroups("CN=group2"), withContextStore(store))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	if ok, _ := contextsPermitted(ctx); !ok {
+		t.Errorf("alice could not clear her scrolls: %s", ctx.trace.Reason)
+	}
+	respond(t, ctx, `{"succeeded":true,"num_freed":2}`)
+	if _, ok := store.get(scrollContext, "c2Nhbg=="); ok {
+		t.Error("cleared scroll still recorded")
+	}
+
+	// clearing every scroll needs can_manage
+	ctx, err = getTestContext("/_search/scroll/_all", "", "DELETE", withUser("alice"), withGroups("CN=group1"), withContextStore(store))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	if ok, _ := contextsPermitted(ctx); ok {
+		t.Error("cleared all scrolls without can_manage")
+	}
+	ctx, err = getTestContext("/_search/scroll/_all", "", "DELETE", withUser("alice"), withGroups("CN=group2"), withContextStore(store))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	if ok, _ := contextsPermitted(ctx); !ok {
+		t.Errorf("could not clear all scrolls with can_manage: %s", ctx.trace.Reason)
+	}
+}
+
+func TestPitOwnership(t *testing.T) {
+	store := newContextStore()
+	var p Prox
+
+	ctx, err := getTestContext("/test_deflek/_pit?keep_alive=1m", "", "POST", withUser("alice"), withGroups("CN=group2"), withContextStore(store))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ok, err := indexPermitted(ctx)
+	if err != nil || !ok {
+		t.Fatalf("opening point in time denied: %v (%s)", err, ctx.trace.Reason)
+	}
+	if ok, _ := contextsPermitted(ctx); !ok {
+		t.Fatalf("opening point in time denied: %s", ctx.trace.Reason)
+	}
+	respond(t, ctx, `{"id":"cGl0"}`)
+	store.add(pitContext, "c2VjcmV0", "user alice", []string{"secret_stuff"}, time.Minute)
+
+	cases := []struct {
+		user      string
+		path      string
+		body      string
+		permitted bool
+	}{
+		{"alice", "/_search", `{"pit":{"id":"cGl0","keep_alive":"1m"}}`, true},
+		{"bob", "/_search", `{"pit":{"id":"cGl0","keep_alive":"1m"}}`, false},
+		{"alice", "/test_deflek/_search", `{"pit":{"id":"cGl0"}}`, false},
+		// the indices are authorized again
+		{"alice", "/_search", `{"pit":{"id":"c2VjcmV0"}}`, false},
+	}
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, c.body, "POST", withUser(c.user), withGroups("CN=group2"), withContextStore(store))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+		ok, err := p.checkRBAC(ctx)
+		if err != nil {
+			t.Errorf("%s %s: %v", c.user, c.body, err)
+		}
+		if ok != c.permitted {
+			t.Errorf("%s %s: got permitted %v, expected %v (%s)", c.user, c.body, ok, c.permitted, ctx.trace.Reason)
+		}
+		// searches on a point in time can't be scoped to indices
+		if ok && ctx.r.URL.Path != "/_search" {
+			t.Errorf("%s %s: got path %s", c.user, c.body, ctx.r.URL.Path)
+		}
+	}
+
+	ctx, err = getTestContext("/_pit", `{"id":"cGl0"}`, "DELETE", withUser("bob"), withGroups("CN=group2"), withContextStore(store))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	if ok, _ := contextsPermitted(ctx); ok {
+		t.Error("bob closed the point in time of alice")
+	}
+}
+
+func TestAsyncSearchOwnership(t *testing.T) {
+	store := newContextStore()
+
+	ctx, err := getTestContext("/test_deflek/_async_search?keep_alive=1d", "{}", "POST", withUser("alice"), withGroups("CN=group2"), withContextStore(store))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	if ok, _ := contextsPermitted(ctx); !ok {
+		t.Fatalf("async search denied: %s", ctx.trace.Reason)
+	}
+	respond(t, ctx, `{"id":"YXN5bmM=","is_running":true}`)
+
+	for _, c := range []struct {
+		user      string
+		method    string
+		path      string
+		permitted bool
+	}{
+		{"alice", "GET", "/_async_search/YXN5bmM=", true},
+		{"alice", "GET", "/_async_search/status/YXN5bmM=", true},
+		{"bob", "GET", "/_async_search/YXN5bmM=", false},
+		{"bob", "DELETE", "/_async_search/YXN5bmM=", false},
+		{"alice", "GET", "/_async_search/b3RoZXI=", false},
+	} {
+		ctx, err := getTestContext(c.path, "", c.method, withUser(c.user), withGroups("CN=group2"), withContextStore(store))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+		ok, err := contextsPermitted(ctx)
+		if err != nil {
+			t.Errorf("%s %s %s: %v", c.user, c.method, c.path, err)
+		}
+		if ok != c.permitted {
+			t.Errorf("%s %s %s: got permitted %v, expected %v (%s)", c.user, c.method, c.path, ok, c.permitted, ctx.trace.Reason)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateMathNow is the clock date math index names are evaluated with.
+// tests replace it to get stable names
+var dateMathNow = time.Now
+
+// isDateMath reports whether the index name is a date math expression,
+// like <logs-{now/d}>
+func isDateMath(name string) bool {
+	return strings.HasPrefix(name, "<") && strings.HasSuffix(name, ">")
+}
+
+// resolveDateMathIndices evaluates the date math expressions among the
+// index names, leaving other names as they are
+func resolveDateMathIndices(indices []string) ([]string, error) {
+	var resolved []string
+	for _, index := range indices {
+		if !isDateMath(index) {
+			resolved = append(resolved, index)
+			continue
+		}
+		name, err := resolveDateMath(index, dateMathNow())
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, name)
+	}
+	return resolved, nil
+}
+
+// resolveDateMath evaluates a date math index name the way elasticsearch
+// does: <static_name{date_math_expr{date_format|time_zone}}>, where
+// everything but the static name is optional and `\` escapes braces
+func resolveDateMath(expr string, now time.Time) (string, error) {
+	if !isDateMath(expr) {
+		return expr, nil
+	}
+	inner := expr[1 : len(expr)-1]
+
+	var name strings.Builder
+	for i := 0; i < len(inner); i++ {
+		switch c := inner[i]; c {
+		case '\\':
+			if i+1 < len(inner) {
+				i++
+				name.WriteByte(inner[i])
+			}
+		case '{':
+			end := closingBrace(inner, i)
+			if end < 0 {
+				return "", fmt.Errorf("invalid date math expression %s: missing }", expr)
+			}
+			evaluated, err := evalDateMath(inner[i+1:end], now)
+			if err != nil {
+				return "", fmt.Errorf("invalid date math expression %s: %v", expr, err)
+			}
+			name.WriteString(evaluated)
+			i = end
+		case '}':
+			return "", fmt.Errorf("invalid date math expression %s: unexpected }", expr)
+		default:
+			name.WriteByte(c)
+		}
+	}
+
+	return name.String(), nil
+}
+
+// closingBrace finds the brace closing the one at start, which may
+// contain a nested {format|time_zone}
+func closingBrace(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// evalDateMath evaluates the part between braces, like now/d or
+// now/M{yyyy.MM|+01:00}
+func evalDateMath(math string, now time.Time) (string, error) {
+	format, zone := "yyyy.MM.dd", ""
+	if i := strings.IndexByte(math, '{'); i >= 0 {
+		if !strings.HasSuffix(math, "}") {
+			return "", fmt.Errorf("malformed format in %s", math)
+		}
+		format = math[i+1 : len(math)-1]
+		math = math[:i]
+		if j := strings.IndexByte(format, '|'); j >= 0 {
+			format, zone = format[:j], format[j+1:]
+		}
+		if format == "" {
+			format = "yyyy.MM.dd"
+		}
+	}
+
+	loc, err := parseTimeZone(zone)
+	if err != nil {
+		return "", err
+	}
+	t := now.In(loc)
+
+	if !strings.HasPrefix(math, "now") {
+		return "", fmt.Errorf("%s must start with now", math)
+	}
+	ops := math[len("now"):]
+	for len(ops) > 0 {
+		op := ops[0]
+		ops = ops[1:]
+		switch op {
+		case '+', '-':
+			n := 0
+			for n < len(ops) && ops[n] >= '0' && ops[n] <= '9' {
+				n++
+			}
+			if n == 0 || n == len(ops) {
+				return "", fmt.Errorf("malformed date math %s", math)
+			}
+			amount, _ := strconv.Atoi(ops[:n])
+			if op == '-' {
+				amount = -amount
+			}
+			t, err = addDateUnit(t, ops[n], amount)
+			ops = ops[n+1:]
+		case '/':
+			if len(ops) == 0 {
+				return "", fmt.Errorf("malformed date math %s", math)
+			}
+			t, err = roundDateUnit(t, ops[0])
+			ops = ops[1:]
+		default:
+			return "", fmt.Errorf("unexpected %q in date math %s", op, math)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return formatDate(t, format)
+}
+
+func parseTimeZone(zone string) (*time.Location, error) {
+	if zone == "" || zone == "Z" || zone == "UTC" {
+		return time.UTC, nil
+	}
+	if zone[0] == '+' || zone[0] == '-' {
+		offset, err := time.Parse("-07:00", zone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone %s", zone)
+		}
+		_, seconds := offset.Zone()
+		return time.FixedZone(zone, seconds), nil
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %s", zone)
+	}
+	return loc, nil
+}
+
+func addDateUnit(t time.Time, unit byte, n int) (time.Time, error) {
+	switch unit {
+	case 'y':
+		return t.AddDate(n, 0, 0), nil
+	case 'M':
+		return t.AddDate(0, n, 0), nil
+	case 'w':
+		return t.AddDate(0, 0, 7*n), nil
+	case 'd':
+		return t.AddDate(0, 0, n), nil
+	case 'h', 'H':
+		return t.Add(time.Duration(n) * time.Hour), nil
+	case 'm':
+		return t.Add(time.Duration(n) * time.Minute), nil
+	case 's':
+		return t.Add(time.Duration(n) * time.Second), nil
+	}
+	return t, fmt.Errorf("unknown date math unit %q", unit)
+}
+
+func roundDateUnit(t time.Time, unit byte) (time.Time, error) {
+	y, M, d := t.Date()
+	h, m, s := t.Clock()
+	loc := t.Location()
+	switch unit {
+	case 'y':
+		return time.Date(y, time.January, 1, 0, 0, 0, 0, loc), nil
+	case 'M':
+		return time.Date(y, M, 1, 0, 0, 0, 0, loc), nil
+	case 'w':
+		// weeks start on monday
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, M, d-offset, 0, 0, 0, 0, loc), nil
+	case 'd':
+		return time.Date(y, M, d, 0, 0, 0, 0, loc), nil
+	case 'h', 'H':
+		return time.Date(y, M, d, h, 0, 0, 0, loc), nil
+	case 'm':
+		return time.Date(y, M, d, h, m, 0, 0, loc), nil
+	case 's':
+		return time.Date(y, M, d, h, m, s, 0, loc), nil
+	}
+	return t, fmt.Errorf("unknown date math unit %q", unit)
+}
+
+// formatDate formats the date with the subset of joda/java date patterns
+// that make sense in index names. text in single quotes is literal
+func formatDate(t time.Time, format string) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(format); {
+		c := format[i]
+		if c == '\'' {
+			end := strings.IndexByte(format[i+1:], '\'')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated quote in date format %s", format)
+			}
+			out.WriteString(format[i+1 : i+1+end])
+			i += end + 2
+			continue
+		}
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			out.WriteByte(c)
+			i++
+			continue
+		}
+
+		n := 1
+		for i+n < len(format) && format[i+n] == c {
+			n++
+		}
+		i += n
+
+		var value int
+		switch c {
+		case 'y', 'Y', 'u':
+			value = t.Year()
+			if n == 2 {
+				value %= 100
+			}
+		case 'M':
+			value = int(t.Month())
+		case 'd':
+			value = t.Day()
+		case 'H':
+			value = t.Hour()
+		case 'm':
+			value = t.Minute()
+		case 's':
+			value = t.Second()
+		default:
+			return "", fmt.Errorf("unsupported date format %s", format)
+		}
+		out.WriteString(fmt.Sprintf("%0*d", n, value))
+	}
+	return out.String(), nil
+}
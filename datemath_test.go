@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolveDateMath(t *testing.T) {
+	now := time.Date(2024, time.March, 22, 23, 30, 15, 0, time.UTC)
+
+	cases := []struct {
+		expr     string
+		expected string
+	}{
+		// the examples from the elasticsearch docs
+		{"<logstash-{now/d}>", "logstash-2024.03.22"},
+		{"<logstash-{now/M}>", "logstash-2024.03.01"},
+		{"<logstash-{now/M{yyyy.MM}}>", "logstash-2024.03"},
+		{"<logstash-{now/M-1M{yyyy.MM}}>", "logstash-2024.02"},
+		{"<logstash-{now/d{yyyy.MM.dd|+12:00}}>", "logstash-2024.03.23"},
+		{"<logstash-{now/d{YYYY.MM.dd}}>", "logstash-2024.03.22"},
+		{"<elastic\\{ON\\}-{now/M}>", "elastic{ON}-2024.03.01"},
+
+		{"<logs-{now-2d/d}>", "logs-2024.03.20"},
+		{"<logs-{now+1h{yyyy.MM.dd.HH}}>", "logs-2024.03.23.00"},
+		{"<logs-{now/w}>", "logs-2024.03.18"},
+		{"<logs-{now/y{yy}}>", "logs-24"},
+		{"<logs-{now{yyyy'w'MM}}>", "logs-2024w03"},
+		{"<logs-{now{yyyy.MM.dd|America/New_York}}>", "logs-2024.03.22"},
+		{"<logs>", "logs"},
+		{"logs", "logs"},
+	}
+
+	for _, c := range cases {
+		got, err := resolveDateMath(c.expr, now)
+		if err != nil {
+			t.Errorf("%s: %v", c.expr, err)
+			continue
+		}
+		if got != c.expected {
+			t.Errorf("%s: got %s, expected %s", c.expr, got, c.expected)
+		}
+	}
+}
+
+func TestResolveDateMathInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"<logs-{now/d>",
+		"<logs-}>",
+		"<logs-{yesterday}>",
+		"<logs-{now/q}>",
+		"<logs-{now+1}>",
+		"<logs-{now{yyyy.QQ}}>",
+		"<logs-{now{yyyy|Mars/Olympus}}>",
+	} {
+		if got, err := resolveDateMath(expr, time.Now()); err == nil {
+			t.Errorf("%s: expected error, got %s", expr, got)
+		}
+	}
+}
+
+// use a fixed clock for date math in the test
+func withDateMathNow(t *testing.T, now time.Time) {
+	dateMathNow = func() time.Time { return now }
+	t.Cleanup(func() { dateMathNow = time.Now })
+}
+
+func TestDateMathPermitted(t *testing.T) {
+	withDateMathNow(t, time.Date(2024, time.March, 22, 12, 0, 0, 0, time.UTC))
+
+	cases := []struct {
+		method    string
+		path      string
+		body      string
+		permitted bool
+		expected  string
+	}{
+		{"GET", "/%3Cglobby-%7Bnow%2Fd%7D%3E/_search?q=x", "", true, "/globby-2024.03.22/_search?q=x"},
+		{"GET", "/test_deflek,%3Cglobby-%7Bnow%2Fd-1d%7D%3E/_count", "", true, "/test_deflek,globby-2024.03.21/_count"},
+		{"GET", "/%3Csecret-%7Bnow%2Fd%7D%3E/_search", "", false, ""},
+		{"GET", "/%3Cglobby-%7Bnow%2Fq%7D%3E/_search", "", false, ""},
+
+		{"POST", "/_msearch", "{\"index\":\"<test_deflek{now{|+01:00}}>\"}\n{}\n", false, ""},
+		{"POST", "/_msearch", "{\"index\":\"<test_deflek>\"}\n{}\n", true, "/_msearch"},
+		{"POST", "/_msearch", "{\"index\":\"<.kibana>\"}\n{}\n{\"index\":\"<secret-{now/d}>\"}\n{}\n", false, ""},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, c.body, c.method)
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		ok, _ := indexPermitted(ctx)
+		if ok != c.permitted {
+			t.Errorf("%s %s: got permitted %v, expected %v (%s)", c.method, c.path, ok, c.permitted, ctx.trace.Reason)
+			continue
+		}
+		if ok {
+			if got := ctx.r.URL.RequestURI(); got != c.expected {
+				t.Errorf("%s %s: got %s, expected %s", c.method, c.path, got, c.expected)
+			}
+		}
+	}
+}
+
+func TestExtractDateMathIndices(t *testing.T) {
+	withDateMathNow(t, time.Date(2024, time.March, 22, 12, 0, 0, 0, time.UTC))
+
+	indices, err := extractBodyIndices("indices:data/read/msearch", []byte("{\"index\":\"<logs-{now/d}>,other\"}\n{}\n"))
+	if err != nil {
+		t.Fatal("could not extract indices: ", err)
+	}
+	if len(indices) != 2 || indices[0] != "logs-2024.03.22" || indices[1] != "other" {
+		t.Errorf("unexpected indices: %v", indices)
+	}
+}
+
+func TestDateMathBody(t *testing.T) {
+	withDateMathNow(t, time.Date(2024, time.March, 22, 12, 0, 0, 0, time.UTC))
+
+	cases := []struct {
+		path     string
+		body     string
+		expected string
+	}{
+		{"/_msearch", "{\"index\":\"<globby-{now/d}>,test_deflek\"}\n{}\n", "{\"index\":\"globby-2024.03.22,test_deflek\"}\n{}\n"},
+		{"/_mget", `{"docs":[{"_index":"<globby-{now/d-1d}>","_id":"1"}]}`, `{"docs":[{"_index":"globby-2024.03.21","_id":"1"}]}`},
+		{"/globby-1/_search", `{"query":{"match":{"title":"<now>"}}}`, `{"query":{"match":{"title":"<now>"}}}`},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, c.body, "GET")
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		ok, err := indexPermitted(ctx)
+		if err != nil || !ok {
+			t.Errorf("%s %s: denied: %v (%s)", c.path, c.body, err, ctx.trace.Reason)
+			continue
+		}
+		if got := string(ctx.body); got != c.expected {
+			t.Errorf("%s: got body %s, expected %s", c.path, got, c.expected)
+		}
+	}
+}
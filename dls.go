@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	glob "github.com/ryanuber/go-glob"
+)
+
+// searchActions have their query wrapped in the document filter
+var searchActions = map[string]bool{
+	"indices:data/read/search":              true,
+	"indices:data/read/async_search/submit": true,
+	"indices:data/write/delete/byquery":     true,
+	"indices:data/write/update/byquery":     true,
+}
+
+// documentlessReads read from indices without returning their documents,
+// or continue a search that was filtered when it was started, so there is
+// nothing to wrap the document filter around
+var documentlessReads = map[string]bool{
+	"indices:data/read/field_caps":                  true,
+	"indices:data/read/field_stats":                 true,
+	"indices:data/read/xpack/rollup/get/index/caps": true,
+	"indices:data/read/open_point_in_time":          true,
+	"indices:data/read/close_point_in_time":         true,
+	"indices:data/read/scroll":                      true,
+	"indices:data/read/scroll/clear":                true,
+	"indices:data/read/async_search/get":            true,
+	"indices:data/read/async_search/delete":         true,
+}
+
+// unfilteredRead reports whether the action reads documents without a
+// query the document filter could be wrapped around, like get, explain or
+// eql, so it's denied on filtered indices. reads are unfiltered unless
+// they are known to be filtered, so new APIs don't get around the filter
+func unfilteredRead(action string) bool {
+	return strings.HasPrefix(action, "indices:data/read/") && !searchActions[action] && !documentlessReads[action]
+}
+
+// documentFilters returns the document filters of the whitelisted indices
+// granting the action on the index. restricted is false when any of them
+// grants the whole index
+func documentFilters(ctx *requestContext, index string, action string) (filters []interface{}, restricted bool) {
+	user, _ := getUser(ctx.r, ctx.C)
+	groups := getGroups(ctx.r, ctx.C)
+
+	for _, whitelistedIndex := range ctx.whitelistedIndices {
+		if !whitelistedIndex.permits(ctx.r.Method, action) || !grantCovers(ctx, whitelistedIndex, index) {
+			continue
+		}
+		if whitelistedIndex.DocumentFilter == nil {
+			return nil, false
+		}
+		filters = append(filters, templateFilter(whitelistedIndex.DocumentFilter, user, groups))
+	}
+	return filters, true
+}
+
+// grantCovers reports whether the whitelisted index grants the index, by
+// name or through an alias in front of it
+func grantCovers(ctx *requestContext, whitelistedIndex Index, index string) bool {
+	if glob.Glob(whitelistedIndex.Name, ctx.logicalIndex(index)) {
+		return true
+	}
+	if !whitelistedIndex.Alias || !ctx.cluster.loaded() {
+		return false
+	}
+	for _, name := range ctx.cluster.aliasesOf(index) {
+		alias, _ := ctx.cluster.alias(name)
+		if !alias.Filtered && glob.Glob(whitelistedIndex.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// documentFiltered reports whether the action only sees part of the index
+func documentFiltered(ctx *requestContext, index string, action string) bool {
+	for _, name := range dlsIndices(ctx, []string{index}, action) {
+		if _, restricted := documentFilters(ctx, name, action); restricted {
+			return true
+		}
+	}
+	return false
+}
+
+// dlsIndices replaces the aliases that aren't granted by name with the
+// indices behind them, since those are what the document filters are for
+func dlsIndices(ctx *requestContext, indices []string, action string) []string {
+	var names []string
+	for _, index := range indices {
+		if ctx.cluster.loaded() && !ctx.granted(index, action, true) {
+			if alias, ok := ctx.cluster.alias(index); ok && !alias.Filtered {
+				names = append(names, alias.Indices...)
+				continue
+			}
+		}
+		names = append(names, index)
+	}
+	return names
+}
+
+// documentFilterQuery builds the query limiting a request over the
+// indices to the documents the user may see, or nil when it may see all
+// of them. indices with different filters are told apart by `_index`
+func documentFilterQuery(ctx *requestContext, indices []string, action string) interface{} {
+	type filterGroup struct {
+		indices    []string
+		filter     interface{}
+		restricted bool
+	}
+	var order []string
+	groups := map[string]*filterGroup{}
+	anyRestricted := false
+
+	for _, index := range dlsIndices(ctx, indices, action) {
+		filters, restricted := documentFilters(ctx, index, action)
+		var filter interface{}
+		switch {
+		case !restricted:
+		case len(filters) == 0:
+			filter = map[string]interface{}{"match_none": map[string]interface{}{}}
+		case len(filters) == 1:
+			filter = filters[0]
+		default:
+			filter = map[string]interface{}{"bool": map[string]interface{}{
+				"should":               filters,
+				"minimum_should_match": 1,
+			}}
+		}
+		anyRestricted = anyRestricted || restricted
+
+		key, _ := json.Marshal(filter)
+		group, ok := groups[string(key)]
+		if !ok {
+			group = &filterGroup{filter: filter, restricted: restricted}
+			groups[string(key)] = group
+			order = append(order, string(key))
+		}
+		group.indices = append(group.indices, index)
+	}
+
+	if !anyRestricted {
+		return nil
+	}
+	if len(order) == 1 {
+		return groups[order[0]].filter
+	}
+
+	var should []interface{}
+	for _, key := range order {
+		group := groups[key]
+		clause := indexClause(ctx, group.indices)
+		if group.restricted {
+			clause = map[string]interface{}{"bool": map[string]interface{}{
+				"filter": []interface{}{clause, group.filter},
+			}}
+		}
+		should = append(should, clause)
+	}
+	return map[string]interface{}{"bool": map[string]interface{}{
+		"should":               should,
+		"minimum_should_match": 1,
+	}}
+}
+
+// indexClause matches the documents of the indices
+func indexClause(ctx *requestContext, indices []string) interface{} {
+	var names []string
+	var clauses []interface{}
+	for _, index := range indices {
+		if hasWildcard([]string{index}) {
+			clauses = append(clauses, map[string]interface{}{"wildcard": map[string]interface{}{"_index": index}})
+			continue
+		}
+		if alias, ok := ctx.cluster.aliasIfLoaded(index); ok {
+			names = append(names, alias.Indices...)
+			continue
+		}
+		names = append(names, index)
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		clauses = append(clauses, map[string]interface{}{"terms": map[string]interface{}{"_index": names}})
+	}
+	if len(clauses) == 1 {
+		return clauses[0]
+	}
+	return map[string]interface{}{"bool": map[string]interface{}{
+		"should":               clauses,
+		"minimum_should_match": 1,
+	}}
+}
+
+// templateFilter converts the filter from the yaml config into something
+// that can be encoded as JSON, substituting {{user}} and {{groups}}. a
+// value that is only {{groups}} becomes the list of groups
+func templateFilter(v interface{}, user string, groups []string) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, value := range v {
+			m[fmt.Sprint(key)] = templateFilter(value, user, groups)
+		}
+		return m
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for key, value := range v {
+			m[key] = templateFilter(value, user, groups)
+		}
+		return m
+	case []interface{}:
+		var l []interface{}
+		for _, value := range v {
+			l = append(l, templateFilter(value, user, groups))
+		}
+		return l
+	case string:
+		if v == "{{groups}}" {
+			var l []interface{}
+			for _, group := range groups {
+				l = append(l, group)
+			}
+			return l
+		}
+		v = strings.Replace(v, "{{user}}", user, -1)
+		return strings.Replace(v, "{{groups}}", strings.Join(groups, ","), -1)
+	}
+	return v
+}
+
+// filterSearchBody wraps the query of a search body in the document
+// filter. searches that could get around the filter are refused with
+// a reason
+func filterSearchBody(body []byte, q interface{}, filter interface{}) ([]byte, string, error) {
+	search := map[string]json.RawMessage{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		err := json.Unmarshal(body, &search)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	for _, key := range []string{"aggs", "aggregations"} {
+		if raw, ok := search[key]; ok && hasGlobalAggregation(raw) {
+			return nil, "global aggregations can't be used on filtered indices", nil
+		}
+	}
+	if _, ok := search["suggest"]; ok {
+		return nil, "suggesters can't be used on filtered indices", nil
+	}
+
+	var query interface{} = map[string]interface{}{"match_all": map[string]interface{}{}}
+	if raw, ok := search["query"]; ok {
+		query = raw
+	}
+	if q != nil {
+		query = q
+	}
+
+	wrapped, err := json.Marshal(map[string]interface{}{"bool": map[string]interface{}{
+		"must":   []interface{}{query},
+		"filter": []interface{}{filter},
+	}})
+	if err != nil {
+		return nil, "", err
+	}
+	search["query"] = wrapped
+
+	filtered, err := json.Marshal(search)
+	return filtered, "", err
+}
+
+// hasGlobalAggregation reports whether any of the aggregations, or their
+// sub aggregations, is a global aggregation, which ignores the query
+func hasGlobalAggregation(raw json.RawMessage) bool {
+	var aggs map[string]map[string]json.RawMessage
+	if json.Unmarshal(raw, &aggs) != nil {
+		// not something elasticsearch would run either
+		return false
+	}
+	for _, agg := range aggs {
+		if _, ok := agg["global"]; ok {
+			return true
+		}
+		for _, key := range []string{"aggs", "aggregations"} {
+			if sub, ok := agg[key]; ok && hasGlobalAggregation(sub) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// queryStringParams are the URL parameters of the `q` query, and the
+// query_string options they are
+var queryStringParams = map[string]string{
+	"df":               "default_field",
+	"default_operator": "default_operator",
+	"analyzer":         "analyzer",
+	"analyze_wildcard": "analyze_wildcard",
+	"lenient":          "lenient",
+}
+
+// takeQueryString removes the `q` query from the URL, returning it as a
+// query_string query so the document filter can be wrapped around it
+func takeQueryString(ctx *requestContext) interface{} {
+	query := ctx.r.URL.Query()
+	q := query.Get("q")
+	if q == "" {
+		return nil
+	}
+	queryString := map[string]interface{}{"query": q}
+	for param, option := range queryStringParams {
+		if value := query.Get(param); value != "" {
+			queryString[option] = value
+			query.Del(param)
+		}
+	}
+	query.Del("q")
+	ctx.r.URL.RawQuery = query.Encode()
+
+	return map[string]interface{}{"query_string": queryString}
+}
+
+// documentLevelSecurity limits the request to the documents the user may
+// see on the indices it is on
+func documentLevelSecurity(ctx *requestContext, indices []string) (bool, error) {
+	action := ctx.action()
+	filter := documentFilterQuery(ctx, indices, action)
+	if filter == nil {
+		return true, nil
+	}
+
+	if unfilteredRead(action) {
+		ctx.trace.Reason = action + " can't be used on filtered indices " + strings.Join(indices, ",")
+		return false, nil
+	}
+	// documentless reads, and writes of documents named by ID
+	if !searchActions[action] {
+		return true, nil
+	}
+
+	// the body can be given in the URL too, which would go unfiltered
+	if ctx.r.URL.Query().Get("source") != "" {
+		ctx.trace.Reason = "the source parameter can't be used on filtered indices"
+		return false, nil
+	}
+
+	body, reason, err := filterSearchBody(ctx.body, takeQueryString(ctx), filter)
+	if err != nil {
+		return false, err
+	}
+	if reason != "" {
+		ctx.trace.Reason = reason
+		return false, nil
+	}
+	setRequestBody(ctx, body)
+
+	return true, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDocumentLevelSecurity(t *testing.T) {
+	cases := []struct {
+		groups   string
+		method   string
+		path     string
+		body     string
+		expected string
+		uri      string
+	}{
+		{
+			"CN=team-a", "GET", "/tickets/_search", `{"query":{"match":{"title":"x"}},"size":5}`,
+			`{"query":{"bool":{"filter":[{"terms":{"team":["team-a"]}}],"must":[{"match":{"title":"x"}}]}},"size":5}`,
+			"/tickets/_search",
+		},
+		{
+			"CN=team-a", "GET", "/tickets/_count", "",
+			`{"query":{"bool":{"filter":[{"terms":{"team":["team-a"]}}],"must":[{"match_all":{}}]}}}`,
+			"/tickets/_count",
+		},
+		{
+			"CN=team-a", "GET", "/notes/_search?q=title:x&df=body&scroll=1m", "",
+			`{"query":{"bool":{"filter":[{"term":{"owner":"dustind"}}],"must":[{"query_string":{"default_field":"body","query":"title:x"}}]}}}`,
+			"/notes/_search?scroll=1m",
+		},
+		{
+			"CN=team-a", "POST", "/notes/_delete_by_query", `{"query":{"range":{"age":{"gt":30}}}}`,
+			`{"query":{"bool":{"filter":[{"term":{"owner":"dustind"}}],"must":[{"range":{"age":{"gt":30}}}]}}}`,
+			"/notes/_delete_by_query",
+		},
+		// indices with different filters are told apart by _index
+		{
+			"CN=team-a", "GET", "/tickets,notes/_search", `{}`,
+			`{"query":{"bool":{"filter":[{"bool":{"minimum_should_match":1,"should":[` +
+				`{"bool":{"filter":[{"terms":{"_index":["tickets"]}},{"terms":{"team":["team-a"]}}]}},` +
+				`{"bool":{"filter":[{"terms":{"_index":["notes"]}},{"term":{"owner":"dustind"}}]}}]}}],"must":[{"match_all":{}}]}}}`,
+			"/tickets,notes/_search",
+		},
+		// unfiltered indices are left whole
+		{
+			"CN=team-a,CN=group2", "GET", "/tickets,test_deflek/_search", `{}`,
+			`{"query":{"bool":{"filter":[{"bool":{"minimum_should_match":1,"should":[` +
+				`{"bool":{"filter":[{"terms":{"_index":["tickets"]}},{"terms":{"team":["team-a","group2"]}}]}},` +
+				`{"terms":{"_index":["test_deflek"]}}]}}],"must":[{"match_all":{}}]}}}`,
+			"/tickets,test_deflek/_search",
+		},
+		// reads without documents
+		{
+			"CN=team-a", "GET", "/tickets/_field_caps?fields=*", "",
+			"",
+			"/tickets/_field_caps?fields=*",
+		},
+		// nothing to filter
+		{
+			"CN=group2", "GET", "/test_deflek/_search?q=x", `{"size":0}`,
+			`{"size":0}`,
+			"/test_deflek/_search?q=x",
+		},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, c.body, c.method, withGroups(c.groups))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		ok, err := indexPermitted(ctx)
+		if !ok || err != nil {
+			t.Errorf("%s %s: not permitted or err: %v (%s)", c.method, c.path, err, ctx.trace.Reason)
+			continue
+		}
+		forwarded, _ := getBody(ctx.r)
+		if diff := cmp.Diff(c.expected, string(forwarded)); diff != "" {
+			t.Errorf("%s %s: unexpected body: (-want +got)\n%s", c.method, c.path, diff)
+		}
+		if got := ctx.r.URL.RequestURI(); got != c.uri {
+			t.Errorf("%s %s: got %s, expected %s", c.method, c.path, got, c.uri)
+		}
+	}
+}
+
+func TestDocumentLevelSecurityDenied(t *testing.T) {
+	cases := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"GET", "/tickets/_doc/1", ""},
+		{"GET", "/tickets/_explain/1", `{"query":{"match_all":{}}}`},
+		{"GET", "/tickets/_search/template", `{"id":"template"}`},
+		{"GET", "/tickets/_search?source={}", ""},
+		{"GET", "/tickets/_search", `{"aggs":{"all":{"global":{}}}}`},
+		{"GET", "/tickets/_search", `{"aggs":{"teams":{"terms":{"field":"team"},"aggs":{"all":{"global":{}}}}}}`},
+		{"GET", "/tickets/_search", `{"suggest":{"s":{"text":"x","term":{"field":"title"}}}}`},
+		{"POST", "/_mget", `{"docs":[{"_index":"tickets","_id":"1"}]}`},
+		{"POST", "/tickets/_eql/search", `{"query":"any where true"}`},
+		{"POST", "/tickets/_graph/explore", `{"vertices":[{"field":"title"}]}`},
+		{"POST", "/tickets/_rollup_search", `{"size":0}`},
+		{"POST", "/tickets/_msearch/template", "{}\n{\"id\":\"template\"}\n"},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, c.body, c.method, withGroups("CN=team-a"))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		ok, err := indexPermitted(ctx)
+		if ok || err != nil {
+			t.Errorf("%s %s %s: permitted or err: %v", c.method, c.path, c.body, err)
+		}
+	}
+}
+
+func TestDocumentLevelSecurityMsearch(t *testing.T) {
+	body := `{"index":"tickets"}
+{"query":{"match":{"title":"x"}}}
+{"index":"notes"}
+{}
+`
+	ctx, err := getTestContext("/_msearch", body, "POST", withGroups("CN=team-a"))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+
+	ok, err := indexPermitted(ctx)
+	if !ok || err != nil {
+		t.Fatalf("msearch not permitted or err: %v (%s)", err, ctx.trace.Reason)
+	}
+
+	expected := `{"index":"tickets"}
+{"query":{"bool":{"filter":[{"terms":{"team":["team-a"]}}],"must":[{"match":{"title":"x"}}]}}}
+{"index":"notes"}
+{"query":{"bool":{"filter":[{"term":{"owner":"dustind"}}],"must":[{"match_all":{}}]}}}
+`
+	forwarded, _ := getBody(ctx.r)
+	if diff := cmp.Diff(expected, string(forwarded)); diff != "" {
+		t.Errorf("unexpected forwarded body: (-want +got)\n%s", diff)
+	}
+}
+
+func TestTemplateFilter(t *testing.T) {
+	filter := map[interface{}]interface{}{
+		"bool": map[interface{}]interface{}{
+			"should": []interface{}{
+				map[interface{}]interface{}{"term": map[interface{}]interface{}{"owner": "{{user}}"}},
+				map[interface{}]interface{}{"terms": map[interface{}]interface{}{"team": "{{groups}}"}},
+				map[interface{}]interface{}{"term": map[interface{}]interface{}{"path": "/home/{{user}}/{{groups}}"}},
+			},
+			"minimum_should_match": 1,
+		},
+	}
+
+	expected := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"should": []interface{}{
+				map[string]interface{}{"term": map[string]interface{}{"owner": "alice"}},
+				map[string]interface{}{"terms": map[string]interface{}{"team": []interface{}{"a", "b"}}},
+				map[string]interface{}{"term": map[string]interface{}{"path": "/home/alice/a,b"}},
+			},
+			"minimum_should_match": 1,
+		},
+	}
+
+	got := templateFilter(filter, "alice", []string{"a", "b"})
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Errorf("unexpected filter: (-want +got)\n%s", diff)
+	}
+}
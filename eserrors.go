@@ -0,0 +1,25 @@
+package main
+
+// esError is an error in the shape elasticsearch uses, so clients like
+// Kibana can display errors from deflek the same way they do their own
+type esError struct {
+	RootCause []esError `json:"root_cause,omitempty"`
+	Type      string    `json:"type"`
+	Reason    string    `json:"reason"`
+}
+
+// securityException is what elasticsearch security answers for
+// unauthorized requests
+func securityException(reason string) esError {
+	cause := esError{Type: "security_exception", Reason: reason}
+	err := cause
+	err.RootCause = []esError{cause}
+	return err
+}
+
+// esErrorResponse is the body of the responses elasticsearch fails requests
+// with
+type esErrorResponse struct {
+	Error  esError `json:"error"`
+	Status int     `json:"status"`
+}
@@ -4,6 +4,8 @@ import (
 	"net/http"
 	"net/url"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestExtractURIindices(t *testing.T) {
@@ -41,7 +43,7 @@ func TestExtractBodyMsearch(t *testing.T) {
 {"query" : {"match_all" : {}}}
 `
 
-	indices, err := extractBodyIndices("_msearch", []byte(body))
+	indices, err := extractBodyIndices("indices:data/read/msearch", []byte(body))
 	if err != nil {
 		t.Error("failed to extract body: ", err)
 	}
@@ -77,7 +79,7 @@ func TestExtractBodyMget(t *testing.T) {
 }
 `
 
-	indices, err := extractBodyIndices("_mget", []byte(body))
+	indices, err := extractBodyIndices("indices:data/read/mget", []byte(body))
 	if err != nil {
 		t.Error("failed to extract body: ", err)
 	}
@@ -91,6 +93,48 @@ func TestExtractBodyMget(t *testing.T) {
 	}
 }
 
+func TestExtractBodyAliasesReindex(t *testing.T) {
+	cases := []struct {
+		action string
+		body   string
+		expect []string
+	}{
+		{"indices:admin/aliases",
+			`{"actions":[{"add":{"index":"a","alias":"b"}},{"remove":{"indices":["c","d"],"aliases":"e,f"}},{"remove_index":{"index":"g"}}]}`,
+			[]string{"a", "g", "c", "d", "b", "e", "f"}},
+		{"indices:data/write/reindex",
+			`{"source":{"index":["a","b"],"query":{"term":{"index":"x"}}},"dest":{"index":"c"}}`,
+			[]string{"a", "b", "c"}},
+	}
+	for _, c := range cases {
+		indices, err := extractBodyIndices(c.action, []byte(c.body))
+		if err != nil {
+			t.Errorf("%s: failed to extract body: %v", c.action, err)
+		}
+		if diff := cmp.Diff(c.expect, indices); diff != "" {
+			t.Errorf("%s: unexpected indices: (-want +got)\n%s", c.action, diff)
+		}
+	}
+}
+
+// elasticsearch reads bodies with comments, which would hide their indices
+func TestExtractBodyInvalid(t *testing.T) {
+	cases := []struct {
+		action string
+		body   string
+	}{
+		{"indices:data/write/reindex", `{"source":{/* c */"index":"secret_stuff"},"dest":{"index":"test_deflek"}}`},
+		{"indices:admin/aliases", `{"actions":[{"add":{"index":"secret_stuff",/* c */"alias":"mine"}}]}`},
+		{"indices:data/read/mget", "{\"docs\":[{\"_index\":\"secret_stuff\"}]} # c"},
+		{"indices:data/read/msearch", "{\"index\":\"secret_stuff\"} // c\n{}\n"},
+	}
+	for _, c := range cases {
+		if indices, err := extractBodyIndices(c.action, []byte(c.body)); err == nil {
+			t.Errorf("%s %s: got indices %v, expected an error", c.action, c.body, indices)
+		}
+	}
+}
+
 func TestExtractBodyBulk(t *testing.T) {
 	// based on the docs example. modified to include two indices
 	// https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-bulk.html
@@ -103,7 +147,7 @@ func TestExtractBodyBulk(t *testing.T) {
 { "doc" : {"field2" : "value2"} }
 `
 
-	indices, err := extractBodyIndices("_bulk", []byte(body))
+	indices, err := extractBodyIndices("indices:data/write/bulk", []byte(body))
 	if err != nil {
 		t.Error("failed to extract body: ", err)
 	}
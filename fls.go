@@ -0,0 +1,732 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	glob "github.com/ryanuber/go-glob"
+)
+
+// fieldPolicy decides which fields of an index can be seen, from the
+// grants of the index that limit its fields. a field is visible when
+// any of the grants allows it
+type fieldPolicy struct {
+	grants []Index
+}
+
+// hasFieldRules reports whether the index grant limits fields
+func (i Index) hasFieldRules() bool {
+	return len(i.AllowedFields) > 0 || len(i.DeniedFields) > 0
+}
+
+// fieldPolicyFor returns the field policy of the index for the action, or
+// nil when a grant of the index shows every field
+func fieldPolicyFor(ctx *requestContext, index string, action string) *fieldPolicy {
+	policy := &fieldPolicy{}
+	for _, name := range dlsIndices(ctx, []string{index}, action) {
+		for _, whitelistedIndex := range ctx.whitelistedIndices {
+			if !whitelistedIndex.permits(ctx.r.Method, action) || !grantCovers(ctx, whitelistedIndex, name) {
+				continue
+			}
+			if !whitelistedIndex.hasFieldRules() {
+				return nil
+			}
+			policy.grants = append(policy.grants, whitelistedIndex)
+		}
+	}
+	return policy
+}
+
+// fieldPolicies returns the policies of the indices that limit fields
+func fieldPolicies(ctx *requestContext, indices []string, action string) []*fieldPolicy {
+	var policies []*fieldPolicy
+	for _, index := range indices {
+		if policy := fieldPolicyFor(ctx, index, action); policy != nil {
+			policies = append(policies, policy)
+		}
+	}
+	return policies
+}
+
+// fieldMatches reports whether the pattern covers the field. a pattern
+// naming an object covers the fields in it, like `user` does `user.name`
+func fieldMatches(pattern, field string) bool {
+	return glob.Glob(pattern, field) || glob.Glob(pattern+".*", field)
+}
+
+func fieldMatchesAny(patterns []string, field string) bool {
+	for _, pattern := range patterns {
+		if fieldMatches(pattern, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// metaFields are the metadata of documents, which are always visible
+var metaFields = map[string]bool{
+	"_id": true, "_index": true, "_type": true, "_routing": true, "_score": true,
+	"_doc": true, "_ignored": true, "_seq_no": true, "_primary_term": true, "_version": true,
+}
+
+// allows reports whether the field can be seen
+func (p *fieldPolicy) allows(field string) bool {
+	if metaFields[field] {
+		return true
+	}
+	for _, grant := range p.grants {
+		if (len(grant.AllowedFields) == 0 || fieldMatchesAny(grant.AllowedFields, field)) &&
+			!fieldMatchesAny(grant.DeniedFields, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsPattern reports whether every field a wildcard field reference
+// could expand to can be seen
+func (p *fieldPolicy) allowsPattern(pattern string) bool {
+	if !strings.Contains(pattern, "*") {
+		return p.allows(pattern)
+	}
+	for _, grant := range p.grants {
+		allowed := len(grant.AllowedFields) == 0
+		for _, a := range grant.AllowedFields {
+			if glob.Glob(a, pattern) {
+				allowed = true
+			}
+		}
+		for _, d := range grant.DeniedFields {
+			if glob.Glob(pattern, d) || glob.Glob(d, pattern) {
+				allowed = false
+			}
+		}
+		if allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceFilter is what a single grant means for `_source` filtering
+func (p *fieldPolicy) sourceFilter() (includes, excludes []string, ok bool) {
+	if len(p.grants) != 1 {
+		return nil, nil, false
+	}
+	return p.grants[0].AllowedFields, p.grants[0].DeniedFields, true
+}
+
+func (p *fieldPolicy) key() string {
+	key, _ := json.Marshal(p.grants)
+	return string(key)
+}
+
+// commonPolicy returns the policy shared by all the indices of a request,
+// if they have one
+func commonPolicy(ctx *requestContext, indices []string, action string) *fieldPolicy {
+	var common *fieldPolicy
+	for _, index := range indices {
+		policy := fieldPolicyFor(ctx, index, action)
+		if policy == nil || (common != nil && common.key() != policy.key()) {
+			return nil
+		}
+		common = policy
+	}
+	return common
+}
+
+// fieldKeyedQueries are the queries that take the field name as the key
+// of their body, like {"term":{"user":"kimchy"}}
+var fieldKeyedQueries = map[string]bool{
+	"term": true, "terms": true, "term_set": true, "match": true, "match_phrase": true,
+	"match_phrase_prefix": true, "match_bool_prefix": true, "prefix": true, "wildcard": true,
+	"regexp": true, "fuzzy": true, "range": true, "intervals": true, "span_term": true,
+	"common": true, "geo_distance": true, "geo_bounding_box": true, "geo_polygon": true,
+	"geo_shape": true,
+}
+
+// queryOptions are the keys of field keyed queries that aren't fields
+var queryOptions = map[string]bool{
+	"boost": true, "_name": true, "distance": true, "distance_type": true,
+	"validation_method": true, "ignore_unmapped": true, "type": true, "relation": true,
+}
+
+// queryStringFields finds the `field:` references in lucene query syntax
+var queryStringFields = regexp.MustCompile(`(?:^|[\s(+!-])([\w.*@-]+):`)
+
+// fieldReferences collects the fields a search body refers to, and
+// whether it runs scripts, which can read any field
+func fieldReferences(v interface{}, parent string, fields *[]string) (scripted bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		// aggregations share names with queries, but name their field
+		_, aggregation := v["field"]
+		keyed := fieldKeyedQueries[parent] && !aggregation
+		for key, value := range v {
+			switch {
+			case key == "script" || key == "_script" || key == "script_fields" || key == "runtime_mappings":
+				scripted = true
+			case keyed && !queryOptions[key]:
+				*fields = append(*fields, key)
+			case key == "field" || key == "default_field" || key == "path":
+				if s, ok := value.(string); ok {
+					*fields = append(*fields, s)
+				}
+			case key == "fields":
+				if l, ok := value.([]interface{}); ok {
+					for _, field := range l {
+						if s, ok := field.(string); ok {
+							// multi_match boosts fields with title^2
+							*fields = append(*fields, strings.SplitN(s, "^", 2)[0])
+						}
+					}
+				}
+			case key == "query" && (parent == "query_string" || parent == "simple_query_string"):
+				if s, ok := value.(string); ok {
+					for _, match := range queryStringFields.FindAllStringSubmatch(s, -1) {
+						*fields = append(*fields, match[1])
+					}
+				}
+			case key == "sort":
+				scripted = sortReferences(value, fields) || scripted
+				continue
+			}
+			scripted = fieldReferences(value, key, fields) || scripted
+		}
+	case []interface{}:
+		for _, value := range v {
+			scripted = fieldReferences(value, parent, fields) || scripted
+		}
+	}
+	return scripted
+}
+
+// sortReferences collects the fields sorted on. sort values show up in
+// the hits, so they are references too
+func sortReferences(v interface{}, fields *[]string) (scripted bool) {
+	sorts, ok := v.([]interface{})
+	if !ok {
+		sorts = []interface{}{v}
+	}
+	for _, s := range sorts {
+		switch s := s.(type) {
+		case string:
+			*fields = append(*fields, s)
+		case map[string]interface{}:
+			for field, options := range s {
+				if field == "_script" {
+					scripted = true
+					continue
+				}
+				*fields = append(*fields, field)
+				scripted = fieldReferences(options, field, fields) || scripted
+			}
+		}
+	}
+	return scripted
+}
+
+// forbiddenReference returns a reason when the search body refers to
+// fields some of the policies don't allow
+func forbiddenReference(search map[string]interface{}, policies []*fieldPolicy) string {
+	var fields []string
+	scripted := false
+	for key, value := range search {
+		switch key {
+		// these select what is returned, and are filtered instead
+		case "_source", "stored_fields", "docvalue_fields", "fields", "highlight":
+			continue
+		case "sort":
+			scripted = sortReferences(value, &fields) || scripted
+		case "script_fields", "runtime_mappings":
+			scripted = true
+		default:
+			scripted = fieldReferences(value, key, &fields) || scripted
+		}
+	}
+
+	if scripted {
+		return "scripts can't be used on indices with field level security"
+	}
+	for _, field := range fields {
+		for _, policy := range policies {
+			if !policy.allowsPattern(field) {
+				return "field " + field + " is not permitted"
+			}
+		}
+	}
+	return ""
+}
+
+// fullTextQueries search every field unless they name the fields to search
+var fullTextQueries = map[string]bool{
+	"query_string": true, "simple_query_string": true, "multi_match": true,
+}
+
+// namesFields reports whether a full text query names the fields it searches
+func namesFields(query map[string]interface{}) bool {
+	if fields, ok := query["fields"].([]interface{}); ok && len(fields) > 0 {
+		return true
+	}
+	_, ok := query["default_field"].(string)
+	return ok
+}
+
+// pinFullTextQueries limits the full text queries that don't name their
+// fields to the fields the policy allows. reports whether any query was
+// pinned, or a reason when one can't be
+func pinFullTextQueries(v interface{}, common *fieldPolicy) (bool, string) {
+	pinned := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if query, ok := value.(map[string]interface{}); ok && fullTextQueries[key] && !namesFields(query) {
+				// fields can only be listed for a policy of allowed fields
+				var allowed, denied []string
+				if common != nil {
+					allowed, denied, ok = common.sourceFilter()
+				}
+				if common == nil || !ok || len(allowed) == 0 || len(denied) > 0 {
+					return false, key + " queries need their fields named on indices with field level security"
+				}
+				fields := make([]interface{}, 0, len(allowed))
+				for _, field := range allowed {
+					fields = append(fields, field)
+				}
+				query["fields"] = fields
+				pinned = true
+			}
+			p, reason := pinFullTextQueries(value, common)
+			if reason != "" {
+				return false, reason
+			}
+			pinned = pinned || p
+		}
+	case []interface{}:
+		for _, value := range v {
+			p, reason := pinFullTextQueries(value, common)
+			if reason != "" {
+				return false, reason
+			}
+			pinned = pinned || p
+		}
+	}
+	return pinned, ""
+}
+
+// filterFieldList drops the fields that can't be seen from lists like
+// stored_fields and docvalue_fields. wildcards are left to the response
+func filterFieldList(v interface{}, policy *fieldPolicy) interface{} {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	kept := []interface{}{}
+	for _, entry := range list {
+		field, _ := entry.(string)
+		if m, ok := entry.(map[string]interface{}); ok {
+			field, _ = m["field"].(string)
+		}
+		if strings.Contains(field, "*") || policy.allows(field) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// restrictSource adds the fields of the policy to `_source` filtering
+func restrictSource(v interface{}, policy *fieldPolicy) interface{} {
+	allowed, denied, ok := policy.sourceFilter()
+	if !ok {
+		return v
+	}
+
+	var includes, excludes []interface{}
+	switch v := v.(type) {
+	case nil:
+	case bool:
+		if !v {
+			return v
+		}
+	case string:
+		includes = append(includes, v)
+	case []interface{}:
+		includes = v
+	case map[string]interface{}:
+		for _, key := range []string{"includes", "include"} {
+			switch l := v[key].(type) {
+			case string:
+				includes = append(includes, l)
+			case []interface{}:
+				includes = append(includes, l...)
+			}
+		}
+		for _, key := range []string{"excludes", "exclude"} {
+			switch l := v[key].(type) {
+			case string:
+				excludes = append(excludes, l)
+			case []interface{}:
+				excludes = append(excludes, l...)
+			}
+		}
+	}
+
+	// the fields asked for are kept, the response strips what's left
+	if len(includes) == 0 {
+		for _, field := range allowed {
+			includes = append(includes, field)
+		}
+	}
+	for _, field := range denied {
+		excludes = append(excludes, field)
+	}
+
+	source := map[string]interface{}{}
+	if len(includes) > 0 {
+		source["includes"] = includes
+	}
+	if len(excludes) > 0 {
+		source["excludes"] = excludes
+	}
+	return source
+}
+
+// restrictSearchBody refuses searches on fields that can't be seen, and
+// limits what the search returns to fields that can
+func restrictSearchBody(body []byte, policies []*fieldPolicy, common *fieldPolicy, rewrite bool) ([]byte, string, error) {
+	search := map[string]interface{}{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		err := decoder.Decode(&search)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	pinned, reason := pinFullTextQueries(search, common)
+	if reason != "" {
+		return nil, reason, nil
+	}
+	if reason := forbiddenReference(search, policies); reason != "" {
+		return nil, reason, nil
+	}
+	if !rewrite || common == nil {
+		if pinned {
+			restricted, err := marshalJSON(search)
+			return restricted, "", err
+		}
+		return body, "", nil
+	}
+
+	if source := restrictSource(search["_source"], common); source != nil {
+		search["_source"] = source
+	}
+	for _, key := range []string{"stored_fields", "docvalue_fields", "fields"} {
+		if value, ok := search[key]; ok {
+			search[key] = filterFieldList(value, common)
+		}
+	}
+
+	restricted, err := marshalJSON(search)
+	return restricted, "", err
+}
+
+// fieldReadActions return documents, so their responses get stripped
+var fieldReadActions = map[string]bool{
+	"indices:data/read/search":              true,
+	"indices:data/read/msearch":             true,
+	"indices:data/read/scroll":              true,
+	"indices:data/read/get":                 true,
+	"indices:data/read/mget":                true,
+	"indices:data/read/async_search/submit": true,
+	"indices:data/read/async_search/get":    true,
+}
+
+// fieldlessReads open, close or clear search contexts without returning
+// documents, so they have no fields to limit
+var fieldlessReads = map[string]bool{
+	"indices:data/read/open_point_in_time":  true,
+	"indices:data/read/close_point_in_time": true,
+	"indices:data/read/scroll/clear":        true,
+	"indices:data/read/async_search/delete": true,
+}
+
+// unfieldedRead reports whether the action reads from indices in a way
+// that can't be limited to fields, like term vectors, explain, graph or
+// field capabilities, so it's denied on indices with field level
+// security. reads are unfielded unless they are known to be limited, so
+// new APIs don't get around the field rules
+func unfieldedRead(action string) bool {
+	return strings.HasPrefix(action, "indices:data/read/") && !searchActions[action] && !fieldReadActions[action] && !fieldlessReads[action]
+}
+
+// hasFieldRules reports whether any of the grants of the request limit
+// fields, which means responses have to be inspected
+func (ctx *requestContext) hasFieldRules() bool {
+	for _, whitelistedIndex := range ctx.whitelistedIndices {
+		if whitelistedIndex.hasFieldRules() {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldLevelSecurity limits the request to the fields the user may see
+// on the indices it is on, and strips the rest from the response
+func fieldLevelSecurity(ctx *requestContext, indices []string) (bool, error) {
+	if !ctx.hasFieldRules() {
+		return true, nil
+	}
+	action := ctx.action()
+	policies := fieldPolicies(ctx, indices, action)
+	if len(policies) == 0 {
+		return true, nil
+	}
+	if unfieldedRead(action) {
+		ctx.trace.Reason = action + " can't be used on indices with field level security " + strings.Join(indices, ",")
+		return false, nil
+	}
+	if ctx.r.URL.Query().Get("source") != "" {
+		ctx.trace.Reason = "the source parameter can't be used on indices with field level security"
+		return false, nil
+	}
+
+	if searchActions[action] {
+		reason, err := restrictSearchParams(ctx, policies)
+		if err != nil {
+			return false, err
+		}
+		if reason != "" {
+			ctx.trace.Reason = reason
+			return false, nil
+		}
+
+		// counts share the action of searches, but don't take `_source`
+		count := ctx.es != nil && ctx.es.api == "_count"
+		rewrite := (action == "indices:data/read/search" && !count) || action == "indices:data/read/async_search/submit"
+		body, reason, err := restrictSearchBody(ctx.body, policies, commonPolicy(ctx, indices, action), rewrite)
+		if err != nil {
+			return false, err
+		}
+		if reason != "" {
+			ctx.trace.Reason = reason
+			return false, nil
+		}
+		if !bytes.Equal(body, ctx.body) {
+			setRequestBody(ctx, body)
+		}
+	}
+
+	if action == "indices:data/read/get" {
+		restrictGetParams(ctx, commonPolicy(ctx, indices, action))
+	}
+
+	return true, nil
+}
+
+// fieldParams are the URL parameters of searches naming fields, as comma
+// separated lists
+var fieldParams = []string{
+	"sort", "stored_fields", "docvalue_fields", "_source", "_source_includes", "_source_include", "suggest_field",
+}
+
+// restrictSearchParams moves the `q` query of the URL into the body, where
+// its fields are checked along with the rest of the body, and refuses the
+// URL parameters naming fields that can't be seen
+func restrictSearchParams(ctx *requestContext, policies []*fieldPolicy) (string, error) {
+	if q := takeQueryString(ctx); q != nil {
+		body, err := setJSONField(ctx.body, "query", q)
+		if err != nil {
+			return "", err
+		}
+		setRequestBody(ctx, body)
+	}
+
+	query := ctx.r.URL.Query()
+	for _, param := range fieldParams {
+		for _, value := range query[param] {
+			for _, field := range strings.Split(value, ",") {
+				field = strings.TrimSpace(field)
+				if param == "sort" {
+					if i := strings.LastIndexByte(field, ':'); i >= 0 {
+						field = field[:i]
+					}
+				}
+				if field == "" || (param == "_source" && (field == "true" || field == "false")) {
+					continue
+				}
+				for _, policy := range policies {
+					if !policy.allowsPattern(field) {
+						return "field " + field + " is not permitted", nil
+					}
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// restrictGetParams limits the fields of a get to the ones that can be
+// seen, through its URL parameters
+func restrictGetParams(ctx *requestContext, policy *fieldPolicy) {
+	if policy == nil {
+		return
+	}
+	query := ctx.r.URL.Query()
+	if storedFields := query.Get("stored_fields"); storedFields != "" {
+		var kept []string
+		for _, field := range strings.Split(storedFields, ",") {
+			if strings.Contains(field, "*") || policy.allows(field) {
+				kept = append(kept, field)
+			}
+		}
+		query.Set("stored_fields", strings.Join(kept, ","))
+	}
+	if allowed, denied, ok := policy.sourceFilter(); ok {
+		if len(allowed) > 0 && query.Get("_source_includes") == "" && query.Get("_source") == "" {
+			query.Set("_source_includes", strings.Join(allowed, ","))
+		}
+		if len(denied) > 0 {
+			excludes := denied
+			if existing := query.Get("_source_excludes"); existing != "" {
+				excludes = append([]string{existing}, denied...)
+			}
+			query.Set("_source_excludes", strings.Join(excludes, ","))
+		}
+	}
+	ctx.r.URL.RawQuery = query.Encode()
+}
+
+// stripFields is a response mutator removing the fields that can't be
+// seen from every document in the response, by the index of the document
+func (ctx *requestContext) stripFields(res *http.Response, body []byte) ([]byte, error) {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	err := decoder.Decode(&v)
+	if err != nil {
+		// not JSON, like a HEAD response, so there are no fields in it
+		return body, nil
+	}
+
+	// the _source API answers with nothing but the source
+	if ctx.es != nil && ctx.es.api == "_source" && len(ctx.es.indices) == 1 {
+		if policy := fieldPolicyFor(ctx, ctx.es.indices[0], ctx.action()); policy != nil {
+			v = stripObject(v, "", policy)
+		}
+		return marshalJSON(v)
+	}
+
+	stripDocuments(ctx, v, nil)
+	return marshalJSON(v)
+}
+
+// marshalJSON encodes like json.Marshal, without escaping HTML, so the
+// strings of documents go back the way elasticsearch sent them
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(v)
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), err
+}
+
+// stripDocuments walks the response for documents, which are found under
+// an object with the `_index` they came from
+func stripDocuments(ctx *requestContext, v interface{}, policy *fieldPolicy) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if index, ok := v["_index"].(string); ok {
+			policy = fieldPolicyFor(ctx, index, ctx.action())
+		}
+		if policy != nil {
+			if source, ok := v["_source"]; ok {
+				v["_source"] = stripObject(source, "", policy)
+			}
+			for _, key := range []string{"fields", "highlight", "term_vectors"} {
+				if fields, ok := v[key].(map[string]interface{}); ok {
+					for field := range fields {
+						if !policy.allows(field) {
+							delete(fields, field)
+						}
+					}
+				}
+			}
+		}
+		for key, value := range v {
+			if key != "_source" && key != "fields" {
+				stripDocuments(ctx, value, policy)
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			stripDocuments(ctx, value, policy)
+		}
+	}
+}
+
+// stripObject removes the fields that can't be seen from a source
+// document. objects are kept as long as anything in them is visible
+func stripObject(v interface{}, path string, policy *fieldPolicy) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field := key
+			if path != "" {
+				field = path + "." + key
+			}
+			value := v[key]
+			switch value.(type) {
+			case map[string]interface{}, []interface{}:
+				stripped := stripObject(value, field, policy)
+				if isEmptyObject(stripped) && !policy.allows(field) {
+					delete(v, key)
+				} else {
+					v[key] = stripped
+				}
+			default:
+				if !policy.allows(field) {
+					delete(v, key)
+				}
+			}
+		}
+		return v
+	case []interface{}:
+		kept := []interface{}{}
+		for _, value := range v {
+			switch value.(type) {
+			case map[string]interface{}, []interface{}:
+				stripped := stripObject(value, path, policy)
+				if !isEmptyObject(stripped) || policy.allows(path) {
+					kept = append(kept, stripped)
+				}
+			default:
+				if policy.allows(path) {
+					kept = append(kept, value)
+				}
+			}
+		}
+		return kept
+	}
+	return v
+}
+
+func isEmptyObject(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFieldLevelSecurityRequests(t *testing.T) {
+	cases := []struct {
+		method   string
+		path     string
+		body     string
+		expected string
+		uri      string
+	}{
+		{
+			"GET", "/customers/_search", `{"query":{"match":{"name":"x"}},"size":5}`,
+			`{"_source":{"excludes":["ssn","billing"]},"query":{"match":{"name":"x"}},"size":5}`,
+			"/customers/_search",
+		},
+		{
+			"GET", "/customers/_search", `{"_source":["name","ssn"],"stored_fields":["ssn","name"],"docvalue_fields":[{"field":"billing.card"},"age"]}`,
+			`{"_source":{"excludes":["ssn","billing"],"includes":["name","ssn"]},"docvalue_fields":["age"],"stored_fields":["name"]}`,
+			"/customers/_search",
+		},
+		{
+			"GET", "/orders/_search", `{"query":{"bool":{"filter":[{"term":{"status":"open"}},{"range":{"items.count":{"gte":2}}}]}},"sort":["order_id"]}`,
+			`{"_source":{"includes":["order_id","status","customer.name","items"]},"query":{"bool":{"filter":[{"term":{"status":"open"}},{"range":{"items.count":{"gte":2}}}]}},"sort":["order_id"]}`,
+			"/orders/_search",
+		},
+		{
+			"GET", "/orders/_search", `{"aggs":{"by_status":{"terms":{"field":"status","size":10}}},"_source":false}`,
+			`{"_source":false,"aggs":{"by_status":{"terms":{"field":"status","size":10}}}}`,
+			"/orders/_search",
+		},
+		{
+			"GET", "/customers/_doc/1?stored_fields=ssn,name", "", "",
+			"/customers/_doc/1?_source_excludes=ssn%2Cbilling&stored_fields=name",
+		},
+		// counts fetch no documents, so they don't take _source
+		{
+			"GET", "/customers/_count", `{"query":{"match":{"name":"x"}}}`,
+			`{"query":{"match":{"name":"x"}}}`,
+			"/customers/_count",
+		},
+		// the q parameter is checked in the body, and full text queries
+		// without fields are pinned to the allowed ones
+		{
+			"GET", "/orders/_search?q=status:open&sort=order_id:asc", "",
+			`{"_source":{"includes":["order_id","status","customer.name","items"]},"query":{"query_string":{"fields":["order_id","status","customer.name","items"],"query":"status:open"}}}`,
+			"/orders/_search?sort=order_id%3Aasc",
+		},
+		{
+			"GET", "/orders/_count", `{"query":{"multi_match":{"query":"x"}}}`,
+			`{"query":{"multi_match":{"fields":["order_id","status","customer.name","items"],"query":"x"}}}`,
+			"/orders/_count",
+		},
+		// different policies, so only the response is stripped
+		{
+			"GET", "/customers,orders/_search", `{"query":{"match":{"status":"open"}}}`,
+			`{"query":{"match":{"status":"open"}}}`,
+			"/customers,orders/_search",
+		},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, c.body, c.method, withGroups("CN=support"))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		ok, err := indexPermitted(ctx)
+		if !ok || err != nil {
+			t.Errorf("%s %s %s: not permitted or err: %v (%s)", c.method, c.path, c.body, err, ctx.trace.Reason)
+			continue
+		}
+		forwarded, _ := getBody(ctx.r)
+		if diff := cmp.Diff(c.expected, string(forwarded)); diff != "" {
+			t.Errorf("%s %s: unexpected body: (-want +got)\n%s", c.method, c.path, diff)
+		}
+		if got := ctx.r.URL.RequestURI(); got != c.uri {
+			t.Errorf("%s %s: got %s, expected %s", c.method, c.path, got, c.uri)
+		}
+		if len(ctx.responseMutators) != 1 {
+			t.Errorf("%s %s: expected the response to be stripped", c.method, c.path)
+		}
+	}
+}
+
+func TestFieldLevelSecurityDenied(t *testing.T) {
+	cases := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"GET", "/customers/_search", `{"query":{"term":{"ssn":"123"}}}`},
+		{"GET", "/customers/_search", `{"query":{"term":{"billing.card":{"value":"4111"}}}}`},
+		{"GET", "/customers/_search", `{"query":{"exists":{"field":"ssn"}}}`},
+		{"GET", "/customers/_search", `{"query":{"query_string":{"query":"name:x AND ssn:123"}}}`},
+		{"GET", "/customers/_search", `{"query":{"multi_match":{"query":"x","fields":["name","ss*^2"]}}}`},
+		{"GET", "/customers/_search", `{"query":{"bool":{"must_not":[{"range":{"billing.total":{"gt":10}}}]}}}`},
+		{"GET", "/customers/_search", `{"sort":[{"ssn":"asc"}]}`},
+		{"GET", "/customers/_search", `{"aggs":{"a":{"terms":{"field":"name"},"aggs":{"b":{"max":{"field":"billing.total"}}}}}}`},
+		{"GET", "/customers/_search", `{"query":{"script":{"script":"doc['ssn'].value == 1"}}}`},
+		{"GET", "/customers/_search", `{"script_fields":{"s":{"script":"doc['ssn']"}}}`},
+		{"GET", "/orders/_search", `{"query":{"match":{"customer.address":"x"}}}`},
+		{"GET", "/orders/_search", `{"query":{"query_string":{"query":"x","default_field":"*"}}}`},
+		{"GET", "/customers/_search?q=ssn:123-45-6789", ""},
+		{"GET", "/customers/_search?q=123-45-6789&df=ssn", ""},
+		{"GET", "/customers/_search?q=123-45-6789", ""},
+		{"GET", "/customers/_search?sort=ssn:asc", ""},
+		{"GET", "/customers/_search?stored_fields=name,ssn", ""},
+		{"GET", "/customers/_search?docvalue_fields=billing.card", ""},
+		{"GET", "/customers/_search?_source_includes=ssn", ""},
+		{"GET", "/customers/_count?q=ssn:123", ""},
+		{"GET", "/customers/_search", `{"query":{"simple_query_string":{"query":"123-45-6789"}}}`},
+		{"GET", "/customers/_search", `{"query":{"multi_match":{"query":"123-45-6789"}}}`},
+		{"GET", "/customers,orders/_search", `{"query":{"query_string":{"query":"x"}}}`},
+		{"GET", "/customers/_explain/1", `{"query":{"match_all":{}}}`},
+		{"GET", "/customers/_termvectors/1", ""},
+		{"POST", "/_msearch", "{\"index\":\"customers\"}\n{\"query\":{\"term\":{\"ssn\":\"1\"}}}\n"},
+		{"POST", "/customers/_graph/explore", `{"vertices":[{"field":"ssn"}]}`},
+		{"POST", "/customers/_eql/search", `{"query":"any where ssn == \"123-45-6789\""}`},
+		{"POST", "/customers/_rollup_search", `{"size":0,"aggs":{"s":{"terms":{"field":"ssn"}}}}`},
+		{"GET", "/customers/_field_caps?fields=*", ""},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, c.body, c.method, withGroups("CN=support"))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		ok, err := indexPermitted(ctx)
+		if ok || err != nil {
+			t.Errorf("%s %s %s: permitted or err: %v", c.method, c.path, c.body, err)
+		}
+	}
+}
+
+func TestStripFields(t *testing.T) {
+	cases := []struct {
+		path     string
+		body     string
+		response string
+		expected string
+	}{
+		{
+			"/customers,orders/_search", "",
+			`{"took":1,"hits":{"total":2,"hits":[` +
+				`{"_index":"customers","_id":"1","_source":{"name":"a<b","ssn":"123","billing":{"card":"4111"},"tags":[{"ssn":"1","x":1}]},` +
+				`"highlight":{"ssn":["<em>123</em>"],"name":["a"]},"fields":{"ssn":["123"],"age":[3]}},` +
+				`{"_index":"orders","_id":"2","_source":{"order_id":7,"secret":true,"customer":{"name":"c","address":"d"},"items":[{"sku":1}]},` +
+				`"inner_hits":{"lines":{"hits":{"hits":[{"_index":"orders","_id":"2","_nested":{"field":"lines","offset":0},"_source":{"price":3,"status":"x"}}]}}}}]}}`,
+			`{"hits":{"hits":[` +
+				`{"_id":"1","_index":"customers","_source":{"name":"a<b","tags":[{"ssn":"1","x":1}]},"fields":{"age":[3]},"highlight":{"name":["a"]}},` +
+				`{"_id":"2","_index":"orders","_source":{"customer":{"name":"c"},"items":[{"sku":1}],"order_id":7},` +
+				`"inner_hits":{"lines":{"hits":{"hits":[{"_id":"2","_index":"orders","_nested":{"field":"lines","offset":0},"_source":{"status":"x"}}]}}}}],"total":2},"took":1}`,
+		},
+		{
+			"/_mget", `{"docs":[{"_index":"customers","_id":"1"}]}`,
+			`{"docs":[{"_index":"customers","_id":"1","found":true,"_source":{"ssn":1,"name":2}},{"_index":"customers","_id":"2","found":false}]}`,
+			`{"docs":[{"_id":"1","_index":"customers","_source":{"name":2},"found":true},{"_id":"2","_index":"customers","found":false}]}`,
+		},
+		{
+			"/_msearch", "{\"index\":\"orders\"}\n{}\n",
+			`{"responses":[{"hits":{"hits":[{"_index":"orders","_id":"1","_source":{"status":"open","total":1.50}}]}}]}`,
+			`{"responses":[{"hits":{"hits":[{"_id":"1","_index":"orders","_source":{"status":"open"}}]}}]}`,
+		},
+		{
+			"/customers/_source/1", "",
+			`{"name":"a","ssn":"123","billing":{"card":1}}`,
+			`{"name":"a"}`,
+		},
+		// scrolls are stripped by the index of each hit
+		{
+			"/_search/scroll", `{"scroll_id":"c2Nhbg=="}`,
+			`{"hits":{"hits":[{"_index":"customers","_id":"1","_source":{"ssn":"123","total":1.50}},{"_index":"test_deflek","_id":"1","_source":{"ssn":"123"}}]}}`,
+			`{"hits":{"hits":[{"_id":"1","_index":"customers","_source":{"total":1.50}},{"_id":"1","_index":"test_deflek","_source":{"ssn":"123"}}]}}`,
+		},
+	}
+
+	for _, c := range cases {
+		method := "GET"
+		if c.body != "" {
+			method = "POST"
+		}
+		// test_deflek is granted by group2 without field rules
+		ctx, err := getTestContext(c.path, c.body, method, withGroups("CN=support,CN=group2"))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		stripped, err := ctx.stripFields(nil, []byte(c.response))
+		if err != nil {
+			t.Errorf("%s: %v", c.path, err)
+			continue
+		}
+		if diff := cmp.Diff(c.expected, string(stripped)); diff != "" {
+			t.Errorf("%s: unexpected response: (-want +got)\n%s", c.path, diff)
+		}
+	}
+}
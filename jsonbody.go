@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// indexRewrite returns the index expressions replacing one in a body. an
+// expression is usually replaced by itself
+type indexRewrite func(index string) []string
+
+// jsonEdit replaces the bytes between start and end of a document
+type jsonEdit struct {
+	start, end int
+	value      []byte
+}
+
+// the fields naming indices in the bodies of requests, by action. `*`
+// matches every field of an object or element of an array. bulk and
+// multi search bodies are NDJSON, and only their action and header lines
+// are rewritten
+var bodyIndexFields = map[string][][]string{
+	"indices:data/write/bulk":            {{"*", "_index"}},
+	"indices:data/read/msearch":          {{"index"}, {"indices"}},
+	"indices:data/read/msearch/template": {{"index"}, {"indices"}},
+	"indices:data/read/mget":             {{"docs", "*", "_index"}},
+	"indices:data/read/mtv":              {{"docs", "*", "_index"}},
+	"indices:admin/aliases": {
+		{"actions", "*", "*", "index"}, {"actions", "*", "*", "indices"},
+		{"actions", "*", "*", "alias"}, {"actions", "*", "*", "aliases"},
+	},
+	"indices:data/write/reindex": {{"source", "index"}, {"dest", "index"}},
+}
+
+// rewriteBodyIndices rewrites the index names in the fields of the body
+// that name indices for the action. everything else in the body keeps its
+// bytes. reports whether anything was rewritten
+func rewriteBodyIndices(action string, body []byte, rewrite indexRewrite) ([]byte, bool, error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return body, false, nil
+	}
+
+	paths, ok := bodyIndexFields[action]
+	if !ok {
+		// bodies of other APIs name indices in a top level `index`, when
+		// they are JSON at all
+		if !jsonDocuments(body) {
+			return body, false, nil
+		}
+		paths = [][]string{{"index"}}
+	}
+
+	switch action {
+	case "indices:data/write/bulk":
+		return rewriteBulkLines(body, paths, rewrite)
+	case "indices:data/read/msearch", "indices:data/read/msearch/template":
+		return rewriteMsearchLines(body, paths, rewrite)
+	}
+
+	if bytes.Contains(bytes.TrimSpace(body), []byte("\n")) && !json.Valid(body) {
+		// NDJSON bodies of APIs that aren't known to be NDJSON
+		return rewriteLines(body, func([]byte) bool { return true }, paths, rewrite)
+	}
+	return rewriteJSONFields(body, paths, rewrite)
+}
+
+// rewriteBulkLines rewrites the action lines of a bulk body, skipping the
+// sources following them
+func rewriteBulkLines(body []byte, paths [][]string, rewrite indexRewrite) ([]byte, bool, error) {
+	source := false
+	return rewriteLines(body, func(line []byte) bool {
+		if len(bytes.TrimSpace(line)) == 0 {
+			return false
+		}
+		if source {
+			source = false
+			return false
+		}
+		// everything but delete is followed by a source line
+		var header map[string]json.RawMessage
+		if json.Unmarshal(line, &header) == nil {
+			_, isDelete := header["delete"]
+			source = !isDelete
+		}
+		return true
+	}, paths, rewrite)
+}
+
+// rewriteMsearchLines rewrites the header lines of a multi search body,
+// which alternate with the search bodies the same way parseMsearch reads
+// them
+func rewriteMsearchLines(body []byte, paths [][]string, rewrite indexRewrite) ([]byte, bool, error) {
+	started := false
+	n := 0
+	return rewriteLines(body, func(line []byte) bool {
+		if !started && len(bytes.TrimSpace(line)) == 0 {
+			return false
+		}
+		started = true
+		n++
+		return n%2 == 1
+	}, paths, rewrite)
+}
+
+// rewriteLines rewrites the fields of the lines of an NDJSON body picked
+// by selected, keeping the other lines and the line breaks as they are
+func rewriteLines(body []byte, selected func(line []byte) bool, paths [][]string, rewrite indexRewrite) ([]byte, bool, error) {
+	lines := bytes.Split(body, []byte("\n"))
+	rewritten := false
+	for i, line := range lines {
+		if !selected(line) || len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		mutated, ok, err := rewriteJSONFields(line, paths, rewrite)
+		if err != nil {
+			return body, false, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		if ok {
+			lines[i] = mutated
+			rewritten = true
+		}
+	}
+	if !rewritten {
+		return body, false, nil
+	}
+	return bytes.Join(lines, []byte("\n")), true, nil
+}
+
+// jsonDocuments reports whether the body is a JSON document, or lines of
+// them
+func jsonDocuments(body []byte) bool {
+	if json.Valid(body) {
+		return true
+	}
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 && !json.Valid(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// rewriteJSONFields rewrites the index names in the fields of a JSON
+// document at the paths, replacing only the values that changed. documents
+// that aren't valid JSON are an error, since elasticsearch reads some of
+// them, like ones with comments, and the indices in them would go unseen
+func rewriteJSONFields(doc []byte, paths [][]string, rewrite indexRewrite) ([]byte, bool, error) {
+	if !json.Valid(doc) {
+		return doc, false, fmt.Errorf("not valid JSON")
+	}
+
+	var edits []jsonEdit
+	for _, path := range paths {
+		err := collectEdits(doc, skipJSONSpace(doc, 0), path, rewrite, &edits)
+		if err != nil {
+			return doc, false, err
+		}
+	}
+	if len(edits) == 0 {
+		return doc, false, nil
+	}
+	return applyEdits(doc, edits), true, nil
+}
+
+// collectEdits follows the path from the value at offset i, and collects
+// the edits rewriting the index names found at its end
+func collectEdits(doc []byte, i int, path []string, rewrite indexRewrite, edits *[]jsonEdit) error {
+	if len(path) == 0 {
+		return rewriteIndexValue(doc, i, rewrite, edits)
+	}
+
+	switch {
+	case doc[i] == '{':
+		_, err := eachJSONField(doc, i, func(key string, start, end int) error {
+			if path[0] != "*" && path[0] != key {
+				return nil
+			}
+			return collectEdits(doc, start, path[1:], rewrite, edits)
+		})
+		return err
+	case doc[i] == '[' && path[0] == "*":
+		_, err := eachJSONElement(doc, i, func(start, end int) error {
+			return collectEdits(doc, start, path[1:], rewrite, edits)
+		})
+		return err
+	}
+	return nil
+}
+
+// rewriteIndexValue rewrites a string of comma separated index names, or
+// an array of them
+func rewriteIndexValue(doc []byte, i int, rewrite indexRewrite, edits *[]jsonEdit) error {
+	switch doc[i] {
+	case '"':
+		end, err := skipJSONValue(doc, i)
+		if err != nil {
+			return err
+		}
+		value, changed, err := rewriteIndexString(doc[i:end], rewrite)
+		if err != nil || !changed {
+			return err
+		}
+		encoded, err := marshalJSON(strings.Join(value, ","))
+		if err != nil {
+			return err
+		}
+		*edits = append(*edits, jsonEdit{i, end, encoded})
+	case '[':
+		_, err := eachJSONElement(doc, i, func(start, end int) error {
+			if doc[start] != '"' {
+				return nil
+			}
+			value, changed, err := rewriteIndexString(doc[start:end], rewrite)
+			if err != nil || !changed || len(value) == 0 {
+				return err
+			}
+			// an element can be replaced by several, as array elements
+			var encoded [][]byte
+			for _, index := range value {
+				e, err := marshalJSON(index)
+				if err != nil {
+					return err
+				}
+				encoded = append(encoded, e)
+			}
+			*edits = append(*edits, jsonEdit{start, end, bytes.Join(encoded, []byte(","))})
+			return nil
+		})
+		return err
+	}
+	return nil
+}
+
+// rewriteIndexString rewrites every index of a JSON string holding comma
+// separated index names
+func rewriteIndexString(raw []byte, rewrite indexRewrite) ([]string, bool, error) {
+	var value string
+	err := json.Unmarshal(raw, &value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var indices []string
+	for _, index := range strings.Split(value, ",") {
+		indices = append(indices, rewrite(index)...)
+	}
+	return indices, strings.Join(indices, ",") != value, nil
+}
+
+// applyEdits replaces the parts of the document the edits are for
+func applyEdits(doc []byte, edits []jsonEdit) []byte {
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start < edits[j].start })
+
+	var out bytes.Buffer
+	last := 0
+	for _, edit := range edits {
+		// paths matching the same value would edit it twice
+		if edit.start < last {
+			continue
+		}
+		out.Write(doc[last:edit.start])
+		out.Write(edit.value)
+		last = edit.end
+	}
+	out.Write(doc[last:])
+	return out.Bytes()
+}
+
+// setJSONField sets a top level field of a JSON object, keeping the rest
+// of the object as it is. an empty document is taken as an empty object
+func setJSONField(doc []byte, key string, value interface{}) ([]byte, error) {
+	encoded, err := marshalJSON(value)
+	if err != nil {
+		return doc, err
+	}
+
+	i := skipJSONSpace(doc, 0)
+	if i == len(doc) {
+		encodedKey, _ := marshalJSON(key)
+		return []byte("{" + string(encodedKey) + ":" + string(encoded) + "}"), nil
+	}
+	if !json.Valid(doc) || doc[i] != '{' {
+		return doc, fmt.Errorf("not a JSON object")
+	}
+
+	var edits []jsonEdit
+	_, err = eachJSONField(doc, i, func(k string, start, end int) error {
+		if k == key {
+			edits = append(edits, jsonEdit{start, end, encoded})
+		}
+		return nil
+	})
+	if err != nil {
+		return doc, err
+	}
+	if len(edits) > 0 {
+		return applyEdits(doc, edits), nil
+	}
+
+	// add the field at the start of the object
+	encodedKey, _ := marshalJSON(key)
+	field := string(encodedKey) + ":" + string(encoded)
+	if j := skipJSONSpace(doc, i+1); doc[j] != '}' {
+		field += ","
+	}
+	return applyEdits(doc, []jsonEdit{{i + 1, i + 1, []byte(field)}}), nil
+}
+
+// skipJSONSpace returns the offset of the first byte at or after i that
+// isn't whitespace
+func skipJSONSpace(doc []byte, i int) int {
+	for i < len(doc) && (doc[i] == ' ' || doc[i] == '\t' || doc[i] == '\n' || doc[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+// skipJSONValue returns the offset just past the JSON value at offset i
+func skipJSONValue(doc []byte, i int) (int, error) {
+	if i >= len(doc) {
+		return i, fmt.Errorf("unexpected end of JSON")
+	}
+
+	switch doc[i] {
+	case '"':
+		for j := i + 1; j < len(doc); j++ {
+			switch doc[j] {
+			case '\\':
+				j++
+			case '"':
+				return j + 1, nil
+			}
+		}
+		return len(doc), fmt.Errorf("unterminated JSON string")
+	case '{':
+		return eachJSONField(doc, i, func(string, int, int) error { return nil })
+	case '[':
+		return eachJSONElement(doc, i, func(int, int) error { return nil })
+	}
+
+	// numbers, true, false and null run until a delimiter
+	j := i
+	for j < len(doc) && !bytes.ContainsRune([]byte(",]} \t\n\r"), rune(doc[j])) {
+		j++
+	}
+	if j == i {
+		return i, fmt.Errorf("unexpected %q in JSON", doc[i])
+	}
+	return j, nil
+}
+
+// eachJSONField calls fn with the key and value offsets of every field of
+// the object at offset i, and returns the offset just past the object
+func eachJSONField(doc []byte, i int, fn func(key string, start, end int) error) (int, error) {
+	i = skipJSONSpace(doc, i+1)
+	if i < len(doc) && doc[i] == '}' {
+		return i + 1, nil
+	}
+	for i < len(doc) {
+		keyEnd, err := skipJSONValue(doc, i)
+		if err != nil {
+			return i, err
+		}
+		var key string
+		if err := json.Unmarshal(doc[i:keyEnd], &key); err != nil {
+			return i, err
+		}
+
+		i = skipJSONSpace(doc, keyEnd)
+		if i >= len(doc) || doc[i] != ':' {
+			return i, fmt.Errorf("expected : after JSON key")
+		}
+		start := skipJSONSpace(doc, i+1)
+		end, err := skipJSONValue(doc, start)
+		if err != nil {
+			return i, err
+		}
+		if err := fn(key, start, end); err != nil {
+			return i, err
+		}
+
+		i = skipJSONSpace(doc, end)
+		if i < len(doc) && doc[i] == '}' {
+			return i + 1, nil
+		}
+		if i >= len(doc) || doc[i] != ',' {
+			return i, fmt.Errorf("expected , or } in JSON object")
+		}
+		i = skipJSONSpace(doc, i+1)
+	}
+	return i, fmt.Errorf("unterminated JSON object")
+}
+
+// eachJSONElement calls fn with the offsets of every element of the array
+// at offset i, and returns the offset just past the array
+func eachJSONElement(doc []byte, i int, fn func(start, end int) error) (int, error) {
+	i = skipJSONSpace(doc, i+1)
+	if i < len(doc) && doc[i] == ']' {
+		return i + 1, nil
+	}
+	for i < len(doc) {
+		end, err := skipJSONValue(doc, i)
+		if err != nil {
+			return i, err
+		}
+		if err := fn(i, end); err != nil {
+			return i, err
+		}
+
+		i = skipJSONSpace(doc, end)
+		if i < len(doc) && doc[i] == ']' {
+			return i + 1, nil
+		}
+		if i >= len(doc) || doc[i] != ',' {
+			return i, fmt.Errorf("expected , or ] in JSON array")
+		}
+		i = skipJSONSpace(doc, i+1)
+	}
+	return i, fmt.Errorf("unterminated JSON array")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// expandStar rewrites `*` like a resolved wildcard
+func expandStar(index string) []string {
+	if index == "*" {
+		return []string{"test_deflek", "globby-*"}
+	}
+	return []string{index}
+}
+
+func TestRewriteBodyIndices(t *testing.T) {
+	cases := []struct {
+		action   string
+		body     string
+		expected string
+	}{
+		// only the header lines of a multi search are rewritten
+		{"indices:data/read/msearch",
+			"{\"index\" : \"*\", \"ignore\":[404]}\n{\"query\":{\"query_string\":{\"query\":\"*\"}}}\n{}\n{\"index\":\"*\"}\n",
+			"{\"index\" : \"test_deflek,globby-*\", \"ignore\":[404]}\n{\"query\":{\"query_string\":{\"query\":\"*\"}}}\n{}\n{\"index\":\"*\"}\n"},
+		{"indices:data/read/msearch",
+			"{\"index\":[\"*\", \"other\"]}\n{}\n",
+			"{\"index\":[\"test_deflek\",\"globby-*\", \"other\"]}\n{}\n"},
+		// and the action lines of a bulk, not the sources
+		{"indices:data/write/bulk",
+			"{\"index\":{\"_index\":\"*\"}}\n{\"index\":{\"_index\":\"*\"}}\n{\"delete\":{\"_index\":\"*\"}}\n{\"create\":{\"_index\":\"a,*\"}}\n{\"_index\":\"*\"}\n",
+			"{\"index\":{\"_index\":\"test_deflek,globby-*\"}}\n{\"index\":{\"_index\":\"*\"}}\n{\"delete\":{\"_index\":\"test_deflek,globby-*\"}}\n{\"create\":{\"_index\":\"a,test_deflek,globby-*\"}}\n{\"_index\":\"*\"}\n"},
+		{"indices:data/read/mget",
+			`{"docs":[{"_index":"*","_id":"*"},{"_id":"1"}]}`,
+			`{"docs":[{"_index":"test_deflek,globby-*","_id":"*"},{"_id":"1"}]}`},
+		{"indices:admin/aliases",
+			`{"actions":[{"add":{"indices":["*"],"alias":"all","filter":{"term":{"user":"*"}}}}]}`,
+			`{"actions":[{"add":{"indices":["test_deflek","globby-*"],"alias":"all","filter":{"term":{"user":"*"}}}}]}`},
+		// other APIs name indices in a top level `index`
+		{"indices:data/read/search",
+			`{"index":"*", "query": {"wildcard": {"index": "*"}}}`,
+			`{"index":"test_deflek,globby-*", "query": {"wildcard": {"index": "*"}}}`},
+		{"indices:data/read/search", `{"query":"*"}`, `{"query":"*"}`},
+		{"indices:data/read/search", `not json "*"`, `not json "*"`},
+	}
+
+	for _, c := range cases {
+		got, _, err := rewriteBodyIndices(c.action, []byte(c.body), expandStar)
+		if err != nil {
+			t.Errorf("%s %s: %v", c.action, c.body, err)
+		}
+		if diff := cmp.Diff(c.expected, string(got)); diff != "" {
+			t.Errorf("%s: unexpected body: (-want +got)\n%s", c.action, diff)
+		}
+	}
+}
+
+func TestSetJSONField(t *testing.T) {
+	cases := []struct {
+		doc      string
+		expected string
+	}{
+		{``, `{"index":"a"}`},
+		{`{}`, `{"index":"a"}`},
+		{`{ }`, `{"index":"a" }`},
+		{`{"ignore" : [404]}`, `{"index":"a","ignore" : [404]}`},
+		{`{"index" : "*", "ignore":[404]}`, `{"index" : "a", "ignore":[404]}`},
+	}
+
+	for _, c := range cases {
+		got, err := setJSONField([]byte(c.doc), "index", "a")
+		if err != nil {
+			t.Errorf("%s: %v", c.doc, err)
+		}
+		if string(got) != c.expected {
+			t.Errorf("%s: got %s, expected %s", c.doc, got, c.expected)
+		}
+		if !json.Valid(got) {
+			t.Errorf("%s: got invalid JSON %s", c.doc, got)
+		}
+	}
+
+	if _, err := setJSONField([]byte(`[]`), "index", "a"); err == nil {
+		t.Error("expected error setting a field of an array")
+	}
+}
+
+// queries containing "*" survive rewriting the indices untouched
+func FuzzRewriteBodyIndicesQuery(f *testing.F) {
+	for _, seed := range []string{"*", `"*"`, `\"*\"`, `index:"*"`, `{"index":"*"}`, "*\n*", ""} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, query string) {
+		encoded, err := json.Marshal(query)
+		if err != nil {
+			t.Skip()
+		}
+
+		search := []byte(`{"query":{"query_string":{"query":` + string(encoded) + `}},"index":` + string(encoded) + `}`)
+		body := append([]byte("{\"index\":\"*\"}\n"), search...)
+		body = append(body, '\n')
+		got, _, err := rewriteBodyIndices("indices:data/read/msearch", body, expandStar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := append([]byte("{\"index\":\"test_deflek,globby-*\"}\n"), search...)
+		expected = append(expected, '\n')
+		if !bytes.Equal(expected, got) {
+			t.Errorf("got %q, expected %q", got, expected)
+		}
+
+		doc := []byte(`{"index":"*","query":{"wildcard":{"name":` + string(encoded) + `}}}`)
+		got, _, err = rewriteBodyIndices("indices:data/read/search", doc, expandStar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = []byte(`{"index":"test_deflek,globby-*","query":{"wildcard":{"name":` + string(encoded) + `}}}`)
+		if !bytes.Equal(expected, got) {
+			t.Errorf("got %q, expected %q", got, expected)
+		}
+	})
+}
+
+// arbitrary documents never break the scanner, are an error unless they
+// are valid JSON, stay valid JSON, and keep their bytes when nothing is
+// rewritten
+func FuzzRewriteJSONFields(f *testing.F) {
+	for _, seed := range []string{
+		`{"index":"*"}`, `{"docs":[{"_index":"*"},1,"*",null]}`, `{"index":["*",1,{"a":"*"}]}`,
+		`{"index":"a*"}`, `{ "index" : [ ] }`, `[{"index":"*"}]`, `{"index":`, `"*"`, `{}`,
+	} {
+		f.Add([]byte(seed))
+	}
+
+	paths := [][]string{{"index"}, {"docs", "*", "_index"}, {"*", "_index"}}
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		got, _, err := rewriteJSONFields(doc, paths, expandStar)
+		if json.Valid(doc) != (err == nil) {
+			t.Fatalf("%q: %v", doc, err)
+		}
+		if err != nil {
+			return
+		}
+		if !json.Valid(got) {
+			t.Errorf("%q: rewritten to invalid JSON %q", doc, got)
+		}
+
+		same, rewritten, err := rewriteJSONFields(doc, paths, func(index string) []string { return []string{index} })
+		if err != nil || rewritten || !bytes.Equal(doc, same) {
+			t.Errorf("%q: changed without rewriting anything: %q %v", doc, same, err)
+		}
+
+		start := skipJSONSpace(doc, 0)
+		end, err := skipJSONValue(doc, start)
+		if err != nil || skipJSONSpace(doc, end) != len(doc) {
+			t.Errorf("%q: scanned to %d of %d: %v", doc, end, len(doc), err)
+		}
+	})
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+)
+
+// the algorithms bearer tokens can be signed with
+var jwtAlgorithms = map[string]bool{"HS256": true, "RS256": true, "ES256": true}
+
+// HS256 secrets shorter than its hash are easy to guess
+const minHMACSecret = 32
+
+const bearerChallenge = `Bearer realm="deflek"`
+
+// jwtKey is a key bearer tokens are checked with. the key of a key file
+// has no ID
+type jwtKey struct {
+	id  string
+	key interface{}
+}
+
+// jwtAuthenticator authenticates requests with the bearer token in their
+// Authorization header
+type jwtAuthenticator struct {
+	C      *Config
+	parser *jwt.Parser
+	keys   []jwtKey
+}
+
+func newJWTAuthenticator(C *Config) (*jwtAuthenticator, error) {
+	conf := C.Authentication.JWT
+	algorithms := conf.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = []string{"RS256", "ES256"}
+	}
+	for _, alg := range algorithms {
+		if !jwtAlgorithms[alg] {
+			return nil, fmt.Errorf("jwt: unsupported algorithm %s", alg)
+		}
+	}
+	if conf.KeyFile == "" && conf.JWKSFile == "" {
+		return nil, errors.New("jwt: key_file or jwks_file is required")
+	}
+
+	a := &jwtAuthenticator{
+		C: C,
+		// the claims are checked after the signature, with clock skew
+		parser: &jwt.Parser{ValidMethods: algorithms, UseJSONNumber: true, SkipClaimsValidation: true},
+	}
+	if conf.KeyFile != "" {
+		raw, err := ioutil.ReadFile(conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: %v", err)
+		}
+		key, err := parseKeyFile(raw)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: key_file %s: %v", conf.KeyFile, err)
+		}
+		a.keys = append(a.keys, jwtKey{key: key})
+	}
+	if conf.JWKSFile != "" {
+		raw, err := ioutil.ReadFile(conf.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: %v", err)
+		}
+		keys, err := parseJWKS(raw)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: jwks_file %s: %v", conf.JWKSFile, err)
+		}
+		a.keys = append(a.keys, keys...)
+	}
+
+	return a, nil
+}
+
+// parseKeyFile reads a PEM public key or certificate. anything that isn't
+// PEM is the secret of HS256
+func parseKeyFile(raw []byte) (interface{}, error) {
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		secret := bytes.TrimSpace(raw)
+		if len(secret) < minHMACSecret {
+			return nil, fmt.Errorf("not a PEM key, and too short for a HS256 secret of at least %d bytes", minHMACSecret)
+		}
+		return secret, nil
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return key, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 EC keys are supported")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// jsonWebKey is a key of a JWKS file
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// parseJWKS reads the signing keys of a JSON Web Key Set. keys of types
+// that can't sign the supported algorithms are skipped
+func parseJWKS(raw []byte) ([]jwtKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := json.Unmarshal(raw, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []jwtKey
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.key()
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", jwk.Kid, err)
+		}
+		if key != nil {
+			keys = append(keys, jwtKey{id: jwk.Kid, key: key})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no supported signing keys")
+	}
+	return keys, nil
+}
+
+// key returns the public key or secret of the JWK, or nil when it isn't a
+// supported one
+func (k jsonWebKey) key() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBase64URL(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBase64URL(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if len(n) == 0 || !exponent.IsInt64() || exponent.Int64() < 2 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, nil
+		}
+		x, err := decodeBase64URL(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBase64URL(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on P-256")
+		}
+		return key, nil
+
+	case "oct":
+		secret, err := decodeBase64URL(k.K)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret) < minHMACSecret {
+			return nil, fmt.Errorf("HS256 secrets need at least %d bytes", minHMACSecret)
+		}
+		return secret, nil
+	}
+	return nil, nil
+}
+
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+// keyFits reports whether the key can check signatures of the algorithm,
+// so a public key can't be used as a HS256 secret
+func keyFits(alg string, key interface{}) bool {
+	switch key := key.(type) {
+	case []byte:
+		return alg == "HS256"
+	case *rsa.PublicKey:
+		return alg == "RS256"
+	case *ecdsa.PublicKey:
+		return alg == "ES256" && key.Curve == elliptic.P256()
+	}
+	return false
+}
+
+// key returns the key the token is checked with: the one with its key ID,
+// else the key of the key file, else the only key there is
+func (a *jwtAuthenticator) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	alg := token.Method.Alg()
+	for _, k := range a.keys {
+		if k.id == kid && keyFits(alg, k.key) {
+			return k.key, nil
+		}
+	}
+	for _, k := range a.keys {
+		if k.id == "" && keyFits(alg, k.key) {
+			return k.key, nil
+		}
+	}
+	if kid == "" && len(a.keys) == 1 && keyFits(alg, a.keys[0].key) {
+		return a.keys[0].key, nil
+	}
+
+	if kid != "" {
+		return nil, fmt.Errorf("no %s key with key ID %s", alg, kid)
+	}
+	return nil, fmt.Errorf("no %s key", alg)
+}
+
+func (a *jwtAuthenticator) authenticate(r *http.Request) (*identity, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return nil, &authError{reason: "missing authentication credentials for REST request [" + r.URL.Path + "]", challenge: bearerChallenge, missing: true}
+	}
+	scheme, token := header, ""
+	if i := strings.IndexByte(header, ' '); i >= 0 {
+		scheme, token = header[:i], strings.TrimSpace(header[i+1:])
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, &authError{reason: "unsupported authentication scheme [" + scheme + "]", challenge: bearerChallenge, missing: true}
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(token, claims, a.key)
+	if err == nil {
+		err = a.validClaims(claims)
+	}
+	if err != nil {
+		return nil, &authError{reason: "invalid bearer token: " + err.Error(), challenge: bearerChallenge + `, error="invalid_token"`}
+	}
+	id, err := a.identity(claims)
+	if err != nil {
+		return nil, &authError{reason: "invalid bearer token: " + err.Error(), challenge: bearerChallenge + `, error="invalid_token"`}
+	}
+
+	// the token is for deflek, elasticsearch has no use for it
+	r.Header.Del("Authorization")
+	return id, nil
+}
+
+// validClaims checks the token is in its validity period, and was issued
+// by the configured issuer for the configured audience
+func (a *jwtAuthenticator) validClaims(claims jwt.MapClaims) error {
+	conf := a.C.Authentication.JWT
+	now := float64(time.Now().UnixNano()) / float64(time.Second)
+	skew := float64(conf.ClockSkew)
+
+	exp, ok, err := numericClaim(claims, "exp")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("token has no exp claim")
+	}
+	if now > exp+skew {
+		return errors.New("token is expired")
+	}
+	nbf, ok, err := numericClaim(claims, "nbf")
+	if err != nil {
+		return err
+	}
+	if ok && now < nbf-skew {
+		return errors.New("token is not valid yet")
+	}
+
+	if conf.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != conf.Issuer {
+			return fmt.Errorf("token is not issued by %s", conf.Issuer)
+		}
+	}
+	if conf.Audience != "" && !hasAudience(claims["aud"], conf.Audience) {
+		return fmt.Errorf("token is not for audience %s", conf.Audience)
+	}
+	return nil
+}
+
+// numericClaim returns a claim holding seconds since the epoch, like exp
+func numericClaim(claims jwt.MapClaims, name string) (float64, bool, error) {
+	value, ok := claims[name]
+	if !ok {
+		return 0, false, nil
+	}
+	if n, ok := value.(json.Number); ok {
+		f, err := n.Float64()
+		if err == nil {
+			return f, true, nil
+		}
+	}
+	return 0, false, fmt.Errorf("%s claim is not a number", name)
+}
+
+// hasAudience reports whether the aud claim, a string or a list of them,
+// has the audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claim returns the claim at the path, where dots name claims nested in
+// objects. claims named with dots, like URLs, are found as they are
+func claim(claims map[string]interface{}, path string) interface{} {
+	if value, ok := claims[path]; ok {
+		return value
+	}
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// identity maps the claims of a token to its user and groups. groups are a
+// list, or a string of space delimited groups
+func (a *jwtAuthenticator) identity(claims jwt.MapClaims) (*identity, error) {
+	conf := a.C.Authentication.JWT
+	userClaim := conf.UserClaim
+	if userClaim == "" {
+		userClaim = "sub"
+	}
+	groupsClaim := conf.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+
+	user, _ := claim(claims, userClaim).(string)
+	if user == "" {
+		return nil, fmt.Errorf("token has no %s claim", userClaim)
+	}
+
+	var groups []string
+	switch value := claim(claims, groupsClaim).(type) {
+	case string:
+		groups = strings.Fields(value)
+	case []interface{}:
+		for _, group := range value {
+			if group, ok := group.(string); ok && group != "" {
+				groups = append(groups, group)
+			}
+		}
+	}
+	if len(groups) == 0 {
+		groups = []string{a.C.AnonymousGroup}
+	}
+
+	return &identity{user: user, groups: groups}, nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt"
+	"github.com/google/go-cmp/cmp"
+)
+
+const testHMACSecret = "0123456789abcdef0123456789abcdef"
+
+// testJWTKeys are the keys tokens are signed with in tests
+type testJWTKeys struct {
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	keyPEM []byte
+}
+
+func getTestJWTKeys(t *testing.T) testJWTKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	return testJWTKeys{
+		rsa:    rsaKey,
+		ec:     ecKey,
+		keyPEM: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+	}
+}
+
+// jwks is a JWKS file with the EC key as `ec` and the RSA key as `rsa`
+func (k testJWTKeys) jwks() []byte {
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	k.ec.X.FillBytes(x)
+	k.ec.Y.FillBytes(y)
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "EC", "kid": "ec", "use": "sig", "crv": "P-256", "x": encode(x), "y": encode(y)},
+		{"kty": "RSA", "kid": "rsa", "n": encode(k.rsa.N.Bytes()), "e": encode(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": encode(make([]byte, 32))},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "", "e": ""},
+	}})
+	return jwks
+}
+
+func writeTestFile(t *testing.T, name string, content []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := ioutil.WriteFile(path, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// withJWT enables JWT authentication with the keys
+func withJWT(t *testing.T, keys testJWTKeys) testOption {
+	return func(f *testFixture) {
+		jwtConf := &f.C.Authentication.JWT
+		jwtConf.Enabled = true
+		jwtConf.Algorithms = []string{"RS256", "ES256"}
+		jwtConf.KeyFile = writeTestFile(t, "key.pem", keys.keyPEM)
+		jwtConf.JWKSFile = writeTestFile(t, "jwks.json", keys.jwks())
+		jwtConf.Issuer = "https://sso.example.com"
+		jwtConf.Audience = "deflek"
+		jwtConf.GroupsClaim = "realm_access.roles"
+		jwtConf.ClockSkew = 30
+	}
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func testClaims(change func(jwt.MapClaims)) jwt.MapClaims {
+	claims := jwt.MapClaims{
+		"sub":          "alice",
+		"iss":          "https://sso.example.com",
+		"aud":          []string{"kibana", "deflek"},
+		"exp":          time.Now().Add(time.Hour).Unix(),
+		"realm_access": map[string]interface{}{"roles": []string{"group2", "team-a"}},
+	}
+	if change != nil {
+		change(claims)
+	}
+	return claims
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	keys := getTestJWTKeys(t)
+	a, err := newJWTAuthenticator(getTestConfig(withJWT(t, keys)))
+	if err != nil {
+		t.Fatal("could not get authenticator: ", err)
+	}
+	forged, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	cases := []struct {
+		name   string
+		header string
+		user   string
+		groups []string
+		err    string
+	}{
+		{"key file", "Bearer " + signTestToken(t, jwt.SigningMethodRS256, "", keys.rsa, testClaims(nil)),
+			"alice", []string{"group2", "team-a"}, ""},
+		{"jwks RSA", "bearer " + signTestToken(t, jwt.SigningMethodRS256, "rsa", keys.rsa, testClaims(nil)),
+			"alice", []string{"group2", "team-a"}, ""},
+		{"jwks EC", "Bearer " + signTestToken(t, jwt.SigningMethodES256, "ec", keys.ec, testClaims(func(c jwt.MapClaims) {
+			c["aud"] = "deflek"
+			c["realm_access"] = map[string]interface{}{"roles": "group2 analysts"}
+		})), "alice", []string{"group2", "analysts"}, ""},
+		{"no groups", "Bearer " + signTestToken(t, jwt.SigningMethodES256, "ec", keys.ec, testClaims(func(c jwt.MapClaims) {
+			delete(c, "realm_access")
+		})), "alice", []string{"group1"}, ""},
+		{"clock skew", "Bearer " + signTestToken(t, jwt.SigningMethodRS256, "rsa", keys.rsa, testClaims(func(c jwt.MapClaims) {
+			c["exp"] = time.Now().Add(-10 * time.Second).Unix()
+			c["nbf"] = time.Now().Add(10 * time.Second).Unix()
+		})), "alice", []string{"group2", "team-a"}, ""},
+
+		{"missing", "", "", nil, "missing authentication credentials"},
+		{"basic", "Basic YWxpY2U6c2VjcmV0", "", nil, "unsupported authentication scheme [Basic]"},
+		{"malformed", "Bearer abc", "", nil, "invalid number of segments"},
+		{"forged", "Bearer " + signTestToken(t, jwt.SigningMethodRS256, "rsa", forged, testClaims(nil)),
+			"", nil, "verification error"},
+		{"unknown kid", "Bearer " + signTestToken(t, jwt.SigningMethodES256, "other", keys.ec, testClaims(nil)),
+			"", nil, "no ES256 key with key ID other"},
+		{"algorithm not allowed", "Bearer " + signTestToken(t, jwt.SigningMethodHS256, "", []byte(testHMACSecret), testClaims(nil)),
+			"", nil, "signing method HS256 is invalid"},
+		{"unsigned", "Bearer " + signTestToken(t, jwt.SigningMethodNone, "", jwt.UnsafeAllowNoneSignatureType, testClaims(nil)),
+			"", nil, "signing method none is invalid"},
+		{"expired", "Bearer " + signTestToken(t, jwt.SigningMethodRS256, "", keys.rsa, testClaims(func(c jwt.MapClaims) {
+			c["exp"] = time.Now().Add(-time.Minute).Unix()
+		})), "", nil, "token is expired"},
+		{"no expiry", "Bearer " + signTestToken(t, jwt.SigningMethodRS256, "", keys.rsa, testClaims(func(c jwt.MapClaims) {
+			delete(c, "exp")
+		})), "", nil, "token has no exp claim"},
+		{"not yet valid", "Bearer " + signTestToken(t, jwt.SigningMethodRS256, "", keys.rsa, testClaims(func(c jwt.MapClaims) {
+			c["nbf"] = time.Now().Add(time.Minute).Unix()
+		})), "", nil, "token is not valid yet"},
+		{"issuer", "Bearer " + signTestToken(t, jwt.SigningMethodRS256, "", keys.rsa, testClaims(func(c jwt.MapClaims) {
+			c["iss"] = "https://evil.example.com"
+		})), "", nil, "token is not issued by https://sso.example.com"},
+		{"audience", "Bearer " + signTestToken(t, jwt.SigningMethodRS256, "", keys.rsa, testClaims(func(c jwt.MapClaims) {
+			c["aud"] = "kibana"
+		})), "", nil, "token is not for audience deflek"},
+		{"no user", "Bearer " + signTestToken(t, jwt.SigningMethodRS256, "", keys.rsa, testClaims(func(c jwt.MapClaims) {
+			c["sub"] = ""
+		})), "", nil, "token has no sub claim"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "http://localhost:9200/_search", nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		id, err := a.authenticate(req)
+
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: got error %v, expected %s", c.name, err, c.err)
+			}
+			if e, ok := err.(*authError); !ok || !strings.HasPrefix(e.challenge, "Bearer") {
+				t.Errorf("%s: got no bearer challenge with %v", c.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if id.user != c.user {
+			t.Errorf("%s: got user %s, expected %s", c.name, id.user, c.user)
+		}
+		if diff := cmp.Diff(c.groups, id.groups); diff != "" {
+			t.Errorf("%s: unexpected groups: (-want +got)\n%s", c.name, diff)
+		}
+		if req.Header.Get("Authorization") != "" {
+			t.Errorf("%s: token left on the request", c.name)
+		}
+	}
+}
+
+func TestJWTHMAC(t *testing.T) {
+	keys := getTestJWTKeys(t)
+	c := getTestConfig(withJWT(t, keys))
+	c.Authentication.JWT.Algorithms = []string{"HS256", "RS256"}
+	a, err := newJWTAuthenticator(c)
+	if err != nil {
+		t.Fatal("could not get authenticator: ", err)
+	}
+
+	// the public key in the key file isn't a secret, so it can't be used
+	// to sign tokens
+	token := signTestToken(t, jwt.SigningMethodHS256, "", keys.keyPEM, testClaims(nil))
+	req, _ := http.NewRequest("GET", "http://localhost:9200/_search", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if _, err := a.authenticate(req); err == nil || !strings.Contains(err.Error(), "no HS256 key") {
+		t.Errorf("token signed with the public key got %v", err)
+	}
+
+	c.Authentication.JWT.KeyFile = writeTestFile(t, "secret", []byte(testHMACSecret+"\n"))
+	a, err = newJWTAuthenticator(c)
+	if err != nil {
+		t.Fatal("could not get authenticator: ", err)
+	}
+	token = signTestToken(t, jwt.SigningMethodHS256, "", []byte(testHMACSecret), testClaims(nil))
+	req.Header.Set("Authorization", "Bearer "+token)
+	if id, err := a.authenticate(req); err != nil || id.user != "alice" {
+		t.Errorf("token signed with the secret got %v", err)
+	}
+}
+
+func TestNewJWTAuthenticator(t *testing.T) {
+	keys := getTestJWTKeys(t)
+	cases := []struct {
+		name   string
+		change func(c *Config)
+		err    string
+	}{
+		{"algorithm", func(c *Config) { c.Authentication.JWT.Algorithms = []string{"none"} },
+			"unsupported algorithm none"},
+		{"no keys", func(c *Config) { c.Authentication.JWT.KeyFile, c.Authentication.JWT.JWKSFile = "", "" },
+			"key_file or jwks_file is required"},
+		{"short secret", func(c *Config) { c.Authentication.JWT.KeyFile = writeTestFile(t, "secret", []byte("hunter2")) },
+			"too short"},
+		{"empty jwks", func(c *Config) { c.Authentication.JWT.JWKSFile = writeTestFile(t, "jwks.json", []byte(`{"keys":[]}`)) },
+			"no supported signing keys"},
+		{"bad EC point", func(c *Config) {
+			c.Authentication.JWT.JWKSFile = writeTestFile(t, "jwks.json",
+				[]byte(`{"keys":[{"kty":"EC","kid":"ec","crv":"P-256","x":"AQ","y":"AQ"}]}`))
+		}, "key ec: EC point is not on P-256"},
+	}
+	for _, c := range cases {
+		conf := getTestConfig(withJWT(t, keys))
+		c.change(conf)
+		_, err := newJWTAuthenticator(conf)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got error %v, expected %s", c.name, err, c.err)
+		}
+	}
+}
+
+func TestJWTRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"authorization":"%s"}`, r.Header.Get("Authorization"))
+	}))
+	defer upstream.Close()
+
+	keys := getTestJWTKeys(t)
+	c := getTestConfig(withJWT(t, keys))
+	c.Target = upstream.URL
+	p := NewProx(c)
+	traces, mu := captureTraces(p)
+
+	// the user header is no longer trusted
+	req := httptest.NewRequest("GET", "/test_deflek/_search", nil)
+	req.Header.Set("X-Remote-User", "mallory")
+	req.Header.Set("X-Remote-Groups", "CN=group2")
+	w := httptest.NewRecorder()
+	p.handleRequest(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, expected 401", w.Code)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); got != bearerChallenge {
+		t.Errorf("got challenge %s, expected %s", got, bearerChallenge)
+	}
+	expected := `{"error":{"root_cause":[{"type":"security_exception","reason":"missing authentication credentials for REST request [/test_deflek/_search]"}],"type":"security_exception","reason":"missing authentication credentials for REST request [/test_deflek/_search]"},"status":401}`
+	if diff := cmp.Diff(expected, w.Body.String()); diff != "" {
+		t.Errorf("unexpected body: (-want +got)\n%s", diff)
+	}
+
+	// the user and groups come from the token
+	token := signTestToken(t, jwt.SigningMethodES256, "ec", keys.ec, testClaims(func(c jwt.MapClaims) {
+		c["sub"] = "bob"
+	}))
+	req = httptest.NewRequest("GET", "/test_deflek/_search", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Remote-User", "mallory")
+	w = httptest.NewRecorder()
+	p.handleRequest(w, req)
+
+	if w.Code != http.StatusOK || w.Body.String() != `{"authorization":""}` {
+		t.Errorf("got status %d and body %s", w.Code, w.Body.String())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if trace, ok := traces["bob"]; !ok || fmt.Sprint(trace["groups"]) != "[group2 team-a]" {
+		t.Errorf("no trace for bob with the groups of the token: %v", traces)
+	}
+}
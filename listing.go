@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// indexKeyedListings answer with an object keyed by index name
+var indexKeyedListings = map[string]bool{
+	"indices:admin/get":                 true,
+	"indices:admin/aliases/get":         true,
+	"indices:admin/mappings/get":        true,
+	"indices:admin/mappings/fields/get": true,
+	"indices:monitor/settings/get":      true,
+	"indices:monitor/recovery":          true,
+}
+
+// nestedListings answer with the indices keyed under `indices`
+var nestedListings = map[string]bool{
+	"indices:monitor/stats":        true,
+	"indices:monitor/segments":     true,
+	"indices:monitor/upgrade":      true,
+	"indices:monitor/shard_stores": true,
+}
+
+// catListings are the _cat APIs with a column of index names
+var catListings = map[string]bool{
+	"cluster:monitor/cat/indices":  true,
+	"cluster:monitor/cat/aliases":  true,
+	"cluster:monitor/cat/shards":   true,
+	"cluster:monitor/cat/segments": true,
+	"cluster:monitor/cat/recovery": true,
+}
+
+// catIndexColumns are the names the index column goes by
+var catIndexColumns = []string{"index", "i", "idx"}
+
+func isListing(action string) bool {
+	return indexKeyedListings[action] || nestedListings[action] || catListings[action] ||
+		action == "indices:data/read/field_caps" || action == "indices:admin/resolve/index"
+}
+
+// indexVisible reports whether the index may show up in listings
+func indexVisible(ctx *requestContext, index string) bool {
+	return indexActionPermitted(ctx, index, ctx.action()) ||
+		indexActionPermitted(ctx, index, "indices:data/read/search") ||
+		indexActionPermitted(ctx, index, "indices:admin/get")
+}
+
+// listingPermitted makes sure the response of an API listing indices
+// can be filtered, and filters it to the indices the user may see
+func listingPermitted(ctx *requestContext) (bool, error) {
+	action := ctx.action()
+	if !isListing(action) {
+		return true, nil
+	}
+
+	query := ctx.r.URL.Query()
+	format := query.Get("format")
+	if format != "" && format != "json" && !(format == "txt" && catListings[action]) {
+		ctx.trace.Reason = "format " + format + " can't be filtered for " + action
+		return false, nil
+	}
+	// the response format follows the Accept header too
+	ctx.r.Header.Del("Accept")
+
+	// text _cat output is filtered by the offset of the index column in
+	// the header, so it's always asked for
+	stripHeader := false
+	if catListings[action] && format != "json" {
+		if _, ok := query["v"]; !ok {
+			query.Set("v", "true")
+			ctx.r.URL.RawQuery = query.Encode()
+			stripHeader = true
+		}
+	}
+
+	ctx.responseMutators = append(ctx.responseMutators, func(res *http.Response, body []byte) ([]byte, error) {
+		if res.StatusCode != http.StatusOK {
+			return body, nil
+		}
+		switch {
+		case catListings[action] && format != "json":
+			return filterCatText(ctx, body, stripHeader), nil
+		case catListings[action]:
+			return filterCatJSON(ctx, body)
+		case indexKeyedListings[action]:
+			return filterIndexKeys(ctx, body)
+		case nestedListings[action]:
+			return filterNestedIndices(ctx, body)
+		case action == "indices:data/read/field_caps":
+			return filterFieldCaps(ctx, body)
+		default:
+			return filterResolvedIndices(ctx, body)
+		}
+	})
+
+	return true, nil
+}
+
+// filterIndexKeys drops the indices that can't be seen from a response
+// like {"index":{"mappings":{...}}}
+func filterIndexKeys(ctx *requestContext, body []byte) ([]byte, error) {
+	var listing map[string]json.RawMessage
+	err := json.Unmarshal(body, &listing)
+	if err != nil {
+		return body, err
+	}
+	for index := range listing {
+		if !indexVisible(ctx, index) {
+			delete(listing, index)
+		}
+	}
+	return marshalJSON(listing)
+}
+
+// filterNestedIndices drops the indices that can't be seen from a
+// response like {"_all":{...},"indices":{"index":{...}}}
+func filterNestedIndices(ctx *requestContext, body []byte) ([]byte, error) {
+	var listing map[string]json.RawMessage
+	err := json.Unmarshal(body, &listing)
+	if err != nil {
+		return body, err
+	}
+	raw, ok := listing["indices"]
+	if !ok {
+		return body, nil
+	}
+	filtered, err := filterIndexKeys(ctx, raw)
+	if err != nil {
+		return body, err
+	}
+	listing["indices"] = filtered
+	return marshalJSON(listing)
+}
+
+// filterIndexList keeps the indices that can be seen
+func filterIndexList(ctx *requestContext, v interface{}) []interface{} {
+	list, _ := v.([]interface{})
+	kept := []interface{}{}
+	for _, index := range list {
+		if name, ok := index.(string); ok && indexVisible(ctx, name) {
+			kept = append(kept, index)
+		}
+	}
+	return kept
+}
+
+// filterFieldCaps drops the indices that can't be seen from the index
+// lists of a field capabilities response
+func filterFieldCaps(ctx *requestContext, body []byte) ([]byte, error) {
+	var caps map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	err := decoder.Decode(&caps)
+	if err != nil {
+		return body, err
+	}
+	if _, ok := caps["indices"]; ok {
+		caps["indices"] = filterIndexList(ctx, caps["indices"])
+	}
+	fields, _ := caps["fields"].(map[string]interface{})
+	for _, types := range fields {
+		types, _ := types.(map[string]interface{})
+		for _, capability := range types {
+			capability, _ := capability.(map[string]interface{})
+			for _, key := range []string{"indices", "non_searchable_indices", "non_aggregatable_indices"} {
+				if _, ok := capability[key]; ok {
+					capability[key] = filterIndexList(ctx, capability[key])
+				}
+			}
+		}
+	}
+	return marshalJSON(caps)
+}
+
+// filterResolvedIndices drops what can't be seen from the indices,
+// aliases and data streams of a resolve index response
+func filterResolvedIndices(ctx *requestContext, body []byte) ([]byte, error) {
+	var resolved map[string][]map[string]interface{}
+	err := json.Unmarshal(body, &resolved)
+	if err != nil {
+		return body, err
+	}
+	for key, entries := range resolved {
+		kept := []map[string]interface{}{}
+		for _, entry := range entries {
+			if name, ok := entry["name"].(string); ok && indexVisible(ctx, name) {
+				if _, ok := entry["indices"]; ok {
+					entry["indices"] = filterIndexList(ctx, entry["indices"])
+				}
+				kept = append(kept, entry)
+			}
+		}
+		resolved[key] = kept
+	}
+	return marshalJSON(resolved)
+}
+
+// filterCatJSON drops the rows of indices that can't be seen. rows without
+// an index column can't be told apart, so they are dropped too
+func filterCatJSON(ctx *requestContext, body []byte) ([]byte, error) {
+	var rows []map[string]json.RawMessage
+	err := json.Unmarshal(body, &rows)
+	if err != nil {
+		return body, err
+	}
+	kept := []map[string]json.RawMessage{}
+	for _, row := range rows {
+		for _, column := range catIndexColumns {
+			var index string
+			if json.Unmarshal(row[column], &index) == nil && index != "" {
+				if indexVisible(ctx, index) {
+					kept = append(kept, row)
+				}
+				break
+			}
+		}
+	}
+	return marshalJSON(kept)
+}
+
+// filterCatText drops the rows of indices that can't be seen from the
+// text table of a _cat API. the index column is left aligned, so its
+// values start where its header does
+func filterCatText(ctx *requestContext, body []byte, stripHeader bool) []byte {
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	if len(lines) == 0 || lines[0] == "" {
+		return body
+	}
+	header := lines[0]
+
+	offset := -1
+	position := 0
+	for _, name := range strings.Fields(header) {
+		position += strings.Index(header[position:], name)
+		if stringInSlice(name, catIndexColumns) {
+			offset = position
+			break
+		}
+		position += len(name)
+	}
+
+	var kept []string
+	if !stripHeader {
+		kept = append(kept, header)
+	}
+	for _, line := range lines[1:] {
+		if offset < 0 || offset >= len(line) {
+			continue
+		}
+		fields := strings.Fields(line[offset:])
+		if len(fields) > 0 && indexVisible(ctx, fields[0]) {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(kept, "\n") + "\n")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestListingFiltered(t *testing.T) {
+	cases := []struct {
+		path     string
+		uri      string
+		response string
+		expected string
+	}{
+		{
+			"/_cat/indices", "/_cat/indices?v=true",
+			"health status index        uuid pri rep\n" +
+				"green  open   test_deflek  abc    1   0\n" +
+				"green  open   secret_stuff def    1   0\n" +
+				"       close  globby-1     ghi    1   0\n" +
+				"green  open   .kibana      jkl    1   0\n",
+			"green  open   test_deflek  abc    1   0\n" +
+				"       close  globby-1     ghi    1   0\n" +
+				"green  open   .kibana      jkl    1   0\n",
+		},
+		{
+			"/_cat/aliases?v&h=alias,index", "/_cat/aliases?v&h=alias,index",
+			"alias  index\n" +
+				"logs   secret_stuff\n" +
+				"globby globby-1\n",
+			"alias  index\n" +
+				"globby globby-1\n",
+		},
+		// without the index column, rows can't be told apart
+		{
+			"/_cat/indices?v&h=health", "/_cat/indices?v&h=health",
+			"health\ngreen\ngreen\n",
+			"health\n",
+		},
+		{
+			"/_cat/indices?format=json", "/_cat/indices?format=json",
+			`[{"health":"green","index":"secret_stuff"},{"health":"green","index":"test_deflek2"},{"health":"green"}]`,
+			`[{"health":"green","index":"test_deflek2"}]`,
+		},
+		{
+			"/_cat/shards?format=json&h=i,s", "/_cat/shards?format=json&h=i,s",
+			`[{"i":"secret_stuff","s":"0"},{"i":"globby-2","s":"0"}]`,
+			`[{"i":"globby-2","s":"0"}]`,
+		},
+		{
+			"/_mapping", "/_mapping",
+			`{"secret_stuff":{"mappings":{"properties":{"ssn":{"type":"keyword"}}}},"test_deflek":{"mappings":{}}}`,
+			`{"test_deflek":{"mappings":{}}}`,
+		},
+		{
+			"/_alias", "/_alias",
+			`{"secret_stuff":{"aliases":{"logs":{}}},".kibana":{"aliases":{}}}`,
+			`{".kibana":{"aliases":{}}}`,
+		},
+		{
+			"/_stats", "/_stats",
+			`{"_shards":{"total":2},"indices":{"secret_stuff":{"uuid":"a"},"globby-1":{"uuid":"b"}}}`,
+			`{"_shards":{"total":2},"indices":{"globby-1":{"uuid":"b"}}}`,
+		},
+		{
+			"/_field_caps?fields=*", "/_field_caps?fields=*",
+			`{"indices":["secret_stuff","test_deflek"],"fields":{"ssn":{"keyword":{"type":"keyword","searchable":true,` +
+				`"indices":["secret_stuff"],"non_aggregatable_indices":["secret_stuff","test_deflek"]}}}}`,
+			`{"fields":{"ssn":{"keyword":{"indices":[],"non_aggregatable_indices":["test_deflek"],"searchable":true,"type":"keyword"}}},` +
+				`"indices":["test_deflek"]}`,
+		},
+		{
+			"/_resolve/index/*", "/_resolve/index/*",
+			`{"indices":[{"name":"secret_stuff"},{"name":"globby-1","aliases":["globby"]}],"aliases":[{"name":"globby","indices":["globby-1","secret_stuff"]}],"data_streams":[]}`,
+			`{"aliases":[],"data_streams":[],"indices":[{"aliases":["globby"],"name":"globby-1"}]}`,
+		},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, "", "GET")
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		ok, err := listingPermitted(ctx)
+		if !ok || err != nil {
+			t.Errorf("%s: not permitted or err: %v (%s)", c.path, err, ctx.trace.Reason)
+			continue
+		}
+		if got := ctx.r.URL.RequestURI(); got != c.uri {
+			t.Errorf("%s: got %s, expected %s", c.path, got, c.uri)
+		}
+		if len(ctx.responseMutators) != 1 {
+			t.Errorf("%s: expected a response mutator", c.path)
+			continue
+		}
+
+		filtered, err := ctx.responseMutators[0](&http.Response{StatusCode: http.StatusOK}, []byte(c.response))
+		if err != nil {
+			t.Errorf("%s: %v", c.path, err)
+		}
+		if diff := cmp.Diff(c.expected, string(filtered)); diff != "" {
+			t.Errorf("%s: unexpected response: (-want +got)\n%s", c.path, diff)
+		}
+	}
+}
+
+func TestListingUnfilterableFormat(t *testing.T) {
+	for _, path := range []string{"/_mapping?format=yaml", "/_cat/indices?format=smile", "/_stats?format=txt"} {
+		ctx, err := getTestContext(path, "", "GET")
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		ok, err := listingPermitted(ctx)
+		if ok || err != nil {
+			t.Errorf("%s: permitted or err: %v", path, err)
+		}
+	}
+}
@@ -3,6 +3,10 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"os"
+	"time"
+
+	log "github.com/inconshreveable/log15"
 )
 
 // Config for reverse proxy settings and RBAC users and groups
@@ -16,8 +20,97 @@ type Config struct {
 	GroupHeaderName string `yaml:"group_header_name"`
 	GroupHeaderType string `yaml:"group_header_type"`
 	UserHeaderName  string `yaml:"user_header_name"`
-	RBAC            struct {
+	// CIDRs of the proxies allowed to set the user and group headers. the
+	// headers of other peers are stripped, leaving them anonymous. every
+	// peer is trusted when empty
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// the authenticators of the listener, tried in order: headers, jwt,
+	// basic and client_cert. defaults to jwt when enabled, else headers
+	Authenticators []string
+	// a second listener, serving TLS to clients with certificates signed by
+	// the client CAs, who are authenticated by their certificate
+	TLSListener struct {
+		Enabled         bool
+		ListenInterface string `yaml:"listen_interface"`
+		ListenPort      int    `yaml:"listen_port"`
+		CertFile        string `yaml:"cert_file"`
+		KeyFile         string `yaml:"key_file"`
+		ClientCAFile    string `yaml:"client_ca_file"`
+		// defaults to client_cert
+		Authenticators []string
+	} `yaml:"tls_listener"`
+	// how requests are authenticated. without an authenticator enabled,
+	// the user and group headers are trusted
+	Authentication struct {
+		// bearer tokens, checked against a key file or a JWKS file
+		JWT struct {
+			Enabled bool
+			// defaults to RS256 and ES256
+			Algorithms []string
+			KeyFile    string `yaml:"key_file"`
+			JWKSFile   string `yaml:"jwks_file"`
+			Issuer     string
+			Audience   string
+			// defaults to sub and groups. claims nested in objects are
+			// named with dots, like realm_access.roles
+			UserClaim   string `yaml:"user_claim"`
+			GroupsClaim string `yaml:"groups_claim"`
+			// seconds of clock skew allowed on exp and nbf
+			ClockSkew int `yaml:"clock_skew"`
+		}
+		// signatures the SSO proxy puts on the user and group headers, so
+		// they can't be forged by whoever else reaches deflek
+		HeaderSignature struct {
+			Enabled    bool
+			SecretFile string `yaml:"secret_file"`
+			// default to X-Remote-Signature and X-Remote-Timestamp
+			SignatureHeader string `yaml:"signature_header"`
+			TimestampHeader string `yaml:"timestamp_header"`
+			// seconds a signature is good for, defaults to 60
+			MaxAge int `yaml:"max_age"`
+		} `yaml:"header_signature"`
+		// how client certificates of the TLS listener map to users and
+		// groups
+		ClientCert struct {
+			// cn (default), or the first dns, email or uri SAN
+			UserField string `yaml:"user_field"`
+			// groups of users. users without an entry get the OUs of their
+			// certificate subject
+			Groups map[string][]string
+		} `yaml:"client_cert"`
+		// users of HTTP Basic auth, for scripts and people without the SSO
+		Basic struct {
+			// htpasswd file of user:hash:groups lines, with bcrypt hashes
+			// and comma separated groups
+			UsersFile string `yaml:"users_file"`
+		}
+	}
+	// seconds between refreshes of the indices and aliases used to
+	// resolve wildcards, defaults to 30
+	IndexRefreshInterval int `yaml:"index_refresh_interval"`
+	// forward the permitted parts of multi-item requests and answer the
+	// rest with per-item errors, instead of denying the whole request
+	PartialRequests struct {
+		Bulk    bool
+		Msearch bool
+		Mget    bool
+	} `yaml:"partial_requests"`
+	// give every tenant a kibana index of its own, by rewriting the kibana
+	// indices to ones named after the tenant. the tenant is picked from the
+	// groups of the user with the tenant header
+	KibanaTenancy struct {
+		Enabled      bool
+		TenantHeader string `yaml:"tenant_header"`
+		// defaults to .kibana and .kibana_task_manager
+		Indices []string
+	} `yaml:"kibana_tenancy"`
+	RBAC struct {
 		Groups map[string]Permissions
+		// permissions of single users, merged with the ones of their groups
+		Users map[string]Permissions
+		// roles are given to users and groups by the role mappings
+		Roles        map[string]Role
+		RoleMappings []RoleMapping `yaml:"role_mappings"`
 	}
 }
 
@@ -27,6 +120,31 @@ func main() {
 
 	proxy := NewProx(&C)
 
+	interval := 30 * time.Second
+	if C.IndexRefreshInterval > 0 {
+		interval = time.Duration(C.IndexRefreshInterval) * time.Second
+	}
+	go proxy.cluster.run(interval, proxy.log)
+
+	if C.TLSListener.Enabled {
+		tlsConfig, err := C.listenerTLSConfig()
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		server := &http.Server{
+			Addr:      fmt.Sprintf("%s:%d", C.TLSListener.ListenInterface, C.TLSListener.ListenPort),
+			Handler:   http.HandlerFunc(proxy.handleTLSRequest),
+			TLSConfig: tlsConfig,
+		}
+		go func() {
+			// the certificates are in the TLS config already
+			err := server.ListenAndServeTLS("", "")
+			log.Error(err.Error())
+			os.Exit(1)
+		}()
+	}
+
 	http.HandleFunc("/", proxy.handleRequest)
 	http.ListenAndServe(fmt.Sprintf("%s:%d", C.ListenInterface, C.ListenPort), nil)
 }
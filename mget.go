@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// mgetDoc is one document requested by a multi get
+type mgetDoc struct {
+	Index string      `json:"_index,omitempty"`
+	Type  string      `json:"_type,omitempty"`
+	ID    interface{} `json:"_id,omitempty"`
+}
+
+// parseMget lists the documents of a multi get, from either the `docs`
+// or the `ids` shorthand. documents without an `_index` use the default
+// index from the URL
+func parseMget(body []byte, defaultIndex string) ([]mgetDoc, []json.RawMessage, error) {
+	var mB struct {
+		Docs []json.RawMessage `json:"docs"`
+		IDs  []interface{}     `json:"ids"`
+	}
+	err := json.Unmarshal(body, &mB)
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed mget body: %v", err)
+	}
+
+	var docs []mgetDoc
+	for _, raw := range mB.Docs {
+		var doc mgetDoc
+		err := json.Unmarshal(raw, &doc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("malformed mget doc: %v", err)
+		}
+		if doc.Index == "" {
+			doc.Index = defaultIndex
+		}
+		docs = append(docs, doc)
+	}
+	for _, id := range mB.IDs {
+		docs = append(docs, mgetDoc{Index: defaultIndex, ID: id})
+	}
+
+	return docs, mB.Docs, nil
+}
+
+// mgetPermitted authorizes every document of a multi get on its own. in
+// partial mode the denied documents are removed from the request and
+// answered with errors in the response
+func mgetPermitted(ctx *requestContext) (bool, error) {
+	docs, raw, err := parseMget(ctx.body, ctx.es.params["index"])
+	if err != nil {
+		return false, err
+	}
+
+	var indices, deniedIndices []string
+	var permitted []json.RawMessage
+	denied := make([]bool, len(docs))
+	for i, doc := range docs {
+		indices = append(indices, doc.Index)
+		// documents of filtered indices can only be found by searching
+		if indexActionPermitted(ctx, doc.Index, ctx.action()) && !documentFiltered(ctx, doc.Index, ctx.action()) {
+			if i < len(raw) {
+				permitted = append(permitted, raw[i])
+			}
+			continue
+		}
+		denied[i] = true
+		deniedIndices = append(deniedIndices, doc.Index)
+	}
+	ctx.indices = indices
+	ctx.trace.Access = indices
+
+	if len(deniedIndices) == 0 {
+		return true, nil
+	}
+	if !ctx.C.PartialRequests.Mget {
+		ctx.trace.Reason = "indices " + strings.Join(deniedIndices, ",") + " are not whitelisted for " + ctx.action()
+		return false, nil
+	}
+
+	ctx.trace.Message = fmt.Sprintf("%d of %d docs denied on %s",
+		len(deniedIndices), len(docs), strings.Join(deniedIndices, ","))
+
+	deniedDoc := func(i int) interface{} {
+		return struct {
+			mgetDoc
+			Error esError `json:"error"`
+		}{docs[i], securityException("action [" + ctx.action() + "] is unauthorized for index [" + docs[i].Index + "]")}
+	}
+
+	// the `ids` shorthand only has a single index, so nothing is left
+	if len(deniedIndices) == len(docs) {
+		ctx.localResponse, err = spliceResponseItems([]byte(`{"docs":[]}`), "docs", denied, deniedDoc)
+		return true, err
+	}
+
+	body, err := json.Marshal(struct {
+		Docs []json.RawMessage `json:"docs"`
+	}{permitted})
+	if err != nil {
+		return false, err
+	}
+	setRequestBody(ctx, body)
+
+	ctx.responseMutators = append(ctx.responseMutators, func(res *http.Response, body []byte) ([]byte, error) {
+		if res.StatusCode != http.StatusOK {
+			return body, nil
+		}
+		return spliceResponseItems(body, "docs", denied, deniedDoc)
+	})
+
+	return true, nil
+}
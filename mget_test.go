@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseMget(t *testing.T) {
+	body := `{"docs":[{"_index":"test","_id":"1"},{"_id":2},{"_index":"test2","_type":"doc","_id":"3"}]}`
+	docs, _, err := parseMget([]byte(body), "default")
+	if err != nil {
+		t.Fatal("could not parse mget: ", err)
+	}
+	expected := []mgetDoc{
+		{Index: "test", ID: "1"},
+		{Index: "default", ID: float64(2)},
+		{Index: "test2", Type: "doc", ID: "3"},
+	}
+	if diff := cmp.Diff(expected, docs); diff != "" {
+		t.Errorf("unexpected difference: (-want +got)\n%s", diff)
+	}
+
+	docs, _, err = parseMget([]byte(`{"ids":["1","2"]}`), "default")
+	if err != nil {
+		t.Fatal("could not parse mget: ", err)
+	}
+	expected = []mgetDoc{
+		{Index: "default", ID: "1"},
+		{Index: "default", ID: "2"},
+	}
+	if diff := cmp.Diff(expected, docs); diff != "" {
+		t.Errorf("unexpected difference: (-want +got)\n%s", diff)
+	}
+}
+
+const testMgetBody = `{"docs":[
+	{"_index":"test_deflek","_id":"1"},
+	{"_index":"secret_stuff","_id":"2"},
+	{"_id":"3"},
+	{"_index":".kibana","_id":"4"}
+]}`
+
+func TestMgetDenied(t *testing.T) {
+	ctx, err := getTestContext("/test_deflek/_mget", testMgetBody, "POST")
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+
+	var p Prox
+	ok, err := p.checkRBAC(ctx)
+	if ok || err != nil {
+		t.Error("mget with forbidden index permitted or err: ", err)
+	}
+}
+
+func TestMgetPartial(t *testing.T) {
+	ctx, err := getTestContext("/test_deflek/_mget", testMgetBody, "POST")
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ctx.C.PartialRequests.Mget = true
+
+	var p Prox
+	ok, err := p.checkRBAC(ctx)
+	if !ok || err != nil {
+		t.Fatalf("partial mget not permitted or err: %v (%s)", err, ctx.trace.Reason)
+	}
+
+	expectedBody := `{"docs":[{"_index":"test_deflek","_id":"1"},{"_id":"3"},{"_index":".kibana","_id":"4"}]}`
+	forwarded, _ := getBody(ctx.r)
+	if diff := cmp.Diff(expectedBody, string(forwarded)); diff != "" {
+		t.Errorf("unexpected forwarded body: (-want +got)\n%s", diff)
+	}
+
+	upstream := `{"docs":[` +
+		`{"_index":"test_deflek","_id":"1","found":true},` +
+		`{"_index":"test_deflek","_id":"3","found":false},` +
+		`{"_index":".kibana","_id":"4","found":true}]}`
+	merged, err := ctx.responseMutators[0](&http.Response{StatusCode: http.StatusOK}, []byte(upstream))
+	if err != nil {
+		t.Fatal("could not merge response: ", err)
+	}
+
+	var got struct {
+		Docs []struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+			Found *bool
+			Error *esError
+		}
+	}
+	err = json.Unmarshal(merged, &got)
+	if err != nil {
+		t.Fatal("could not decode merged response: ", err)
+	}
+
+	expected := []struct {
+		index string
+		id    string
+		err   bool
+	}{
+		{"test_deflek", "1", false},
+		{"secret_stuff", "2", true},
+		{"test_deflek", "3", false},
+		{".kibana", "4", false},
+	}
+	if len(got.Docs) != len(expected) {
+		t.Fatalf("got %d docs, expected %d: %s", len(got.Docs), len(expected), merged)
+	}
+	for i, e := range expected {
+		doc := got.Docs[i]
+		if doc.Index != e.index || doc.ID != e.id {
+			t.Errorf("doc %d: got %s/%s, expected %s/%s", i, doc.Index, doc.ID, e.index, e.id)
+		}
+		if e.err && (doc.Error == nil || doc.Error.Type != "security_exception") {
+			t.Errorf("doc %d: expected security_exception, got %+v", i, doc)
+		}
+		if !e.err && (doc.Error != nil || doc.Found == nil) {
+			t.Errorf("doc %d: expected upstream doc, got %+v", i, doc)
+		}
+	}
+}
+
+func TestMgetPartialIDs(t *testing.T) {
+	ctx, err := getTestContext("/secret_stuff/_mget", `{"ids":["1","2"]}`, "POST")
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ctx.C.PartialRequests.Mget = true
+
+	var p Prox
+	ok, err := p.checkRBAC(ctx)
+	if !ok || err != nil {
+		t.Fatalf("partial mget not permitted or err: %v (%s)", err, ctx.trace.Reason)
+	}
+
+	var got struct {
+		Docs []struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+			Error *esError
+		}
+	}
+	err = json.Unmarshal(ctx.localResponse, &got)
+	if err != nil {
+		t.Fatal("could not decode local response: ", err)
+	}
+	if len(got.Docs) != 2 {
+		t.Fatalf("got %d docs, expected 2", len(got.Docs))
+	}
+	for i, doc := range got.Docs {
+		if doc.Index != "secret_stuff" || doc.Error == nil {
+			t.Errorf("doc %d: expected error for secret_stuff, got %+v", i, doc)
+		}
+	}
+}
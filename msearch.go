@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// msearchItem is one header and body pair of a multi search request
+type msearchItem struct {
+	header  []byte
+	body    []byte
+	indices []string
+}
+
+// parseMsearch splits a multi search body into its searches. searches
+// without indices in the header use the default indices from the URL
+func parseMsearch(body []byte, defaultIndices []string) ([]msearchItem, error) {
+	var items []msearchItem
+
+	lines := bytes.Split(body, []byte("\n"))
+	// elasticsearch tolerates a leading newline, and the body ends with one
+	for len(lines) > 0 && len(bytes.TrimSpace(lines[0])) == 0 {
+		lines = lines[1:]
+	}
+	if len(lines) > 0 && len(bytes.TrimSpace(lines[len(lines)-1])) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	for i := 0; i < len(lines); i += 2 {
+		if i+1 >= len(lines) {
+			return nil, fmt.Errorf("msearch header on line %d is missing its body", i+1)
+		}
+		item := msearchItem{header: lines[i], body: lines[i+1]}
+
+		if len(bytes.TrimSpace(item.header)) > 0 {
+			indices, err := msearchHeaderIndices(item.header)
+			if err != nil {
+				return nil, fmt.Errorf("malformed msearch header on line %d: %v", i+1, err)
+			}
+			item.indices = indices
+		}
+
+		if len(item.indices) == 0 {
+			item.indices = defaultIndices
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// msearchHeaderKeys are the keys of a multi search header naming indices.
+// elasticsearch takes indices as a synonym of index
+var msearchHeaderKeys = []string{"index", "indices"}
+
+// msearchHeaderIndices returns the indices of a multi search header, named
+// by a string of comma separated indices or an array of them, in any of
+// the keys naming indices
+func msearchHeaderIndices(header []byte) ([]string, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(header, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	var indices []string
+	for _, key := range msearchHeaderKeys {
+		raw, ok := fields[key]
+		if !ok {
+			continue
+		}
+		var index string
+		var array []string
+		if json.Unmarshal(raw, &index) == nil {
+			array = []string{index}
+		} else if err := json.Unmarshal(raw, &array); err != nil {
+			return nil, fmt.Errorf("%s is not a string or an array of strings", key)
+		}
+		for _, index := range array {
+			if index != "" {
+				indices = append(indices, strings.Split(index, ",")...)
+			}
+		}
+	}
+	return indices, nil
+}
+
+// wildcards in searches get resolved to the concrete indices they are
+// permitted on. searches over every index get the permitted indices too.
+// req'd by Kibana
+func (item *msearchItem) mutateWildcardIndex(ctx *requestContext, action string) error {
+	expressions := item.indices
+	if len(expressions) == 0 {
+		expressions = []string{"_all"}
+	}
+	if !hasWildcard(expressions) {
+		return nil
+	}
+	resolved := resolveIndices(ctx, expressions, action)
+	// nothing permitted matches, so leave it to be denied
+	if len(resolved) == 0 {
+		item.indices = expressions
+		return nil
+	}
+
+	// every key naming indices gets them, so none is left with the
+	// wildcard for elasticsearch to pick
+	var fields map[string]json.RawMessage
+	json.Unmarshal(item.header, &fields)
+	header := item.header
+	for _, key := range msearchHeaderKeys {
+		if _, ok := fields[key]; !ok && key != "index" {
+			continue
+		}
+		mutated, err := setJSONField(header, key, strings.Join(resolved, ","))
+		if err != nil {
+			return err
+		}
+		header = mutated
+	}
+	item.header = header
+	item.indices = resolved
+
+	return nil
+}
+
+// filterDocuments limits the search to the fields and documents that can
+// be seen on its indices. searches that can't be limited are refused
+// with a reason
+func (item *msearchItem) filterDocuments(ctx *requestContext, action string) (string, error) {
+	var indices []string
+	for i, index := range item.indices {
+		if !isExclusion(item.indices, i) {
+			indices = append(indices, index)
+		}
+	}
+
+	// fields first, the document filter refers to fields of its own
+	if policies := fieldPolicies(ctx, indices, action); len(policies) > 0 {
+		if unfieldedRead(action) {
+			return action + " can't be used on indices with field level security " + strings.Join(indices, ","), nil
+		}
+		body, reason, err := restrictSearchBody(item.body, policies, commonPolicy(ctx, indices, action), true)
+		if err != nil || reason != "" {
+			return reason, err
+		}
+		item.body = body
+	}
+
+	filter := documentFilterQuery(ctx, indices, action)
+	if filter == nil {
+		return "", nil
+	}
+	if unfilteredRead(action) {
+		return action + " can't be used on filtered indices " + strings.Join(indices, ","), nil
+	}
+
+	body, reason, err := filterSearchBody(item.body, nil, filter)
+	if err != nil || reason != "" {
+		return reason, err
+	}
+	item.body = body
+	return "", nil
+}
+
+// msearchPermitted authorizes every search of a multi search request on
+// its own. in partial mode the denied searches are removed from the
+// request and answered with errors in the responses
+func msearchPermitted(ctx *requestContext, action string) (bool, error) {
+	items, err := parseMsearch(ctx.body, ctx.es.indices)
+	if err != nil {
+		return false, err
+	}
+
+	var indices, deniedIndices []string
+	var permitted bytes.Buffer
+	denied := make([]bool, len(items))
+	reasons := make([]string, len(items))
+	for i := range items {
+		item := &items[i]
+		err := item.mutateWildcardIndex(ctx, action)
+		if err != nil {
+			return false, err
+		}
+
+		indices = append(indices, item.indices...)
+		for j, index := range item.indices {
+			if isExclusion(item.indices, j) {
+				continue
+			}
+			if !indexActionPermitted(ctx, index, action) {
+				denied[i] = true
+				deniedIndices = append(deniedIndices, index)
+				reasons[i] = "action [" + action + "] is unauthorized for index [" + index + "]"
+				break
+			}
+		}
+
+		if !denied[i] {
+			reason, err := item.filterDocuments(ctx, action)
+			if err != nil {
+				return false, err
+			}
+			if reason != "" {
+				denied[i] = true
+				deniedIndices = append(deniedIndices, strings.Join(item.indices, ","))
+				reasons[i] = reason
+			}
+		}
+
+		if !denied[i] {
+			permitted.Write(item.header)
+			permitted.WriteByte('\n')
+			permitted.Write(item.body)
+			permitted.WriteByte('\n')
+		}
+	}
+	ctx.indices = indices
+	ctx.trace.Access = indices
+
+	if len(deniedIndices) == 0 {
+		setRequestBody(ctx, permitted.Bytes())
+		return true, nil
+	}
+	if !ctx.C.PartialRequests.Msearch {
+		ctx.trace.Reason = "indices " + strings.Join(deniedIndices, ",") + " are not whitelisted for " + action
+		return false, nil
+	}
+
+	ctx.trace.Message = fmt.Sprintf("%d of %d searches denied on %s",
+		len(deniedIndices), len(items), strings.Join(deniedIndices, ","))
+
+	deniedResponse := func(i int) interface{} {
+		return struct {
+			Error  esError `json:"error"`
+			Status int     `json:"status"`
+		}{securityException(reasons[i]), http.StatusForbidden}
+	}
+
+	if len(deniedIndices) == len(items) {
+		ctx.localResponse, err = spliceResponseItems([]byte(`{"took":0,"responses":[]}`), "responses", denied, deniedResponse)
+		return true, err
+	}
+
+	setRequestBody(ctx, permitted.Bytes())
+	ctx.responseMutators = append(ctx.responseMutators, func(res *http.Response, body []byte) ([]byte, error) {
+		if res.StatusCode != http.StatusOK {
+			return body, nil
+		}
+		return spliceResponseItems(body, "responses", denied, deniedResponse)
+	})
+
+	return true, nil
+}
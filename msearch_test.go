@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseMsearch(t *testing.T) {
+	// based on the docs example. modified to include several indices
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/search-multi-search.html
+	body := `
+{"index" : "test"}
+{"query" : {"match_all" : {}}, "from" : 0, "size" : 10}
+{"index" : ["test2","test3"], "search_type" : "dfs_query_then_fetch"}
+{"query" : {"match_all" : {}}}
+{}
+{"query" : {"match_all" : {}}}
+
+{"query" : {"match_all" : {}}}
+{"index" : "test4,test5"}
+{"query" : {"match_all" : {}}}
+{"indices" : "test6"}
+{"query" : {"match_all" : {}}}
+{"index" : "test7", "indices" : ["test8"]}
+{"query" : {"match_all" : {}}}
+`
+
+	items, err := parseMsearch([]byte(body), []string{"default"})
+	if err != nil {
+		t.Fatal("could not parse msearch: ", err)
+	}
+
+	var indices [][]string
+	for _, item := range items {
+		indices = append(indices, item.indices)
+	}
+	expected := [][]string{
+		{"test"},
+		{"test2", "test3"},
+		{"default"},
+		{"default"},
+		{"test4", "test5"},
+		{"test6"},
+		{"test7", "test8"},
+	}
+	if diff := cmp.Diff(expected, indices); diff != "" {
+		t.Errorf("unexpected difference: (-want +got)\n%s", diff)
+	}
+}
+
+func TestParseMsearchMalformed(t *testing.T) {
+	bodies := []string{
+		`{"index" : "test"}` + "\n",
+		`{"index" : 1}` + "\n{}\n",
+		`{"indices" : {"index" : "test"}}` + "\n{}\n",
+	}
+	for _, body := range bodies {
+		if _, err := parseMsearch([]byte(body), nil); err == nil {
+			t.Errorf("expected error for %s", body)
+		}
+	}
+}
+
+const testMsearchBody = `{"index" : "test_deflek"}
+{"query" : {"match_all" : {}}}
+{"index" : "secret_stuff"}
+{"query" : {"match_all" : {}}}
+{"index" : ["test_deflek", ".kibana"]}
+{"query" : {"match_all" : {}}}
+{"index" : "secret_stuff,test_deflek"}
+{"query" : {"match_all" : {}}}
+`
+
+func TestMsearchDenied(t *testing.T) {
+	ctx, err := getTestContext("/_msearch", testMsearchBody, "POST")
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+
+	var p Prox
+	ok, err := p.checkRBAC(ctx)
+	if ok || err != nil {
+		t.Error("msearch with forbidden index permitted or err: ", err)
+	}
+}
+
+func TestMsearchIndicesHeader(t *testing.T) {
+	cases := []struct {
+		path string
+		body string
+	}{
+		// indices is a synonym of index, overriding the indices of the URL
+		{"/test_deflek/_msearch", `{"indices":"secret_stuff"}` + "\n{}\n"},
+		{"/_msearch", `{"index":"test_deflek","indices":"secret_stuff"}` + "\n{}\n"},
+		{"/_msearch", `{"indices":["test_deflek","secret_stuff"]}` + "\n{}\n"},
+	}
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, c.body, "POST")
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		var p Prox
+		ok, err := p.checkRBAC(ctx)
+		if ok || err != nil {
+			t.Errorf("%s %s: msearch with forbidden indices permitted or err: %v", c.path, c.body, err)
+		}
+	}
+
+	body := `{"index":"*","indices":"*"}` + "\n{}\n"
+	ctx, err := getTestContext("/_msearch", body, "POST")
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	var p Prox
+	ok, err := p.checkRBAC(ctx)
+	if !ok || err != nil {
+		t.Fatalf("msearch not permitted or err: %v (%s)", err, ctx.trace.Reason)
+	}
+	expected := `{"index":"test_deflek","indices":"test_deflek"}` + "\n{}\n"
+	forwarded, _ := getBody(ctx.r)
+	if diff := cmp.Diff(expected, string(forwarded)); diff != "" {
+		t.Errorf("unexpected forwarded body: (-want +got)\n%s", diff)
+	}
+}
+
+func TestMsearchWildcard(t *testing.T) {
+	body := `{"index":"*","ignore":[404]}
+{"size":0}
+
+{"size":0}
+`
+	ctx, err := getTestContext("/_msearch", body, "POST")
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+
+	var p Prox
+	ok, err := p.checkRBAC(ctx)
+	if !ok || err != nil {
+		t.Fatalf("msearch not permitted or err: %v (%s)", err, ctx.trace.Reason)
+	}
+
+	// only test_deflek can be searched with POST
+	expected := `{"index":"test_deflek","ignore":[404]}
+{"size":0}
+{"index":"test_deflek"}
+{"size":0}
+`
+	forwarded, _ := getBody(ctx.r)
+	if diff := cmp.Diff(expected, string(forwarded)); diff != "" {
+		t.Errorf("unexpected forwarded body: (-want +got)\n%s", diff)
+	}
+}
+
+func TestMsearchPartial(t *testing.T) {
+	ctx, err := getTestContext("/_msearch", testMsearchBody, "POST")
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ctx.C.PartialRequests.Msearch = true
+
+	var p Prox
+	ok, err := p.checkRBAC(ctx)
+	if !ok || err != nil {
+		t.Fatalf("partial msearch not permitted or err: %v (%s)", err, ctx.trace.Reason)
+	}
+
+	expectedBody := `{"index" : "test_deflek"}
+{"query" : {"match_all" : {}}}
+{"index" : ["test_deflek", ".kibana"]}
+{"query" : {"match_all" : {}}}
+`
+	forwarded, _ := getBody(ctx.r)
+	if diff := cmp.Diff(expectedBody, string(forwarded)); diff != "" {
+		t.Errorf("unexpected forwarded body: (-want +got)\n%s", diff)
+	}
+
+	upstream := `{"took":5,"responses":[{"hits":{"total":1},"status":200},{"hits":{"total":2},"status":200}]}`
+	merged, err := ctx.responseMutators[0](&http.Response{StatusCode: http.StatusOK}, []byte(upstream))
+	if err != nil {
+		t.Fatal("could not merge response: ", err)
+	}
+
+	var got struct {
+		Took      int
+		Responses []struct {
+			Hits   *struct{ Total int }
+			Error  *esError
+			Status int
+		}
+	}
+	err = json.Unmarshal(merged, &got)
+	if err != nil {
+		t.Fatal("could not decode merged response: ", err)
+	}
+
+	if got.Took != 5 || len(got.Responses) != 4 {
+		t.Fatalf("got took %d and %d responses, expected 5 and 4: %s", got.Took, len(got.Responses), merged)
+	}
+	for i, total := range []int{1, 0, 2, 0} {
+		res := got.Responses[i]
+		if total > 0 {
+			if res.Hits == nil || res.Hits.Total != total || res.Status != 200 {
+				t.Errorf("response %d: expected %d hits, got %+v", i, total, res)
+			}
+			continue
+		}
+		if res.Status != 403 || res.Error == nil || res.Error.Type != "security_exception" ||
+			len(res.Error.RootCause) != 1 {
+			t.Errorf("response %d: expected security_exception, got %+v", i, res)
+		}
+	}
+}
+
+func TestMsearchPartialAllDenied(t *testing.T) {
+	body := `{"index" : "secret_stuff"}
+{"query" : {"match_all" : {}}}
+`
+	ctx, err := getTestContext("/_msearch", body, "POST")
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ctx.C.PartialRequests.Msearch = true
+
+	var p Prox
+	ok, err := p.checkRBAC(ctx)
+	if !ok || err != nil {
+		t.Fatalf("partial msearch not permitted or err: %v (%s)", err, ctx.trace.Reason)
+	}
+
+	expected := `{"responses":[{"error":{"root_cause":[{"type":"security_exception","reason":"action [indices:data/read/search] is unauthorized for index [secret_stuff]"}],"type":"security_exception","reason":"action [indices:data/read/search] is unauthorized for index [secret_stuff]"},"status":403}],"took":0}`
+	if diff := cmp.Diff(expected, string(ctx.localResponse)); diff != "" {
+		t.Errorf("unexpected local response: (-want +got)\n%s", diff)
+	}
+}
@@ -2,52 +2,201 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/url"
-	"regexp"
 	"strings"
 )
 
-// mutate things that aren't allowed in the path to things that are.
-// kibana requires use of this function
+// mutate index expressions in the path to the concrete indices the
+// request is permitted on. kibana requires use of this function
 //
-// `_all` gets replaced with whitelisted indices
+// `_all`, `*` and other wildcards get resolved to permitted indices
 //
-// `_search` API gets prefixed with whitelisted indices
+// exclusions like `-logs-secret` get applied to the wildcards before them
 //
-// `*` index pattern gets replaced with whitelisted indices
-//
-func mutatePath(ctx *requestContext) {
-	var indices []string
-	for _, whitelistedIndex := range ctx.whitelistedIndices {
-		if !strings.HasPrefix(whitelistedIndex.Name, ".") {
-			indices = append(indices, whitelistedIndex.Name)
-		}
-	}
-	indicesAsURI := strings.Join(indices, ",")
-	path := ctx.r.URL.Path
-	path = strings.TrimPrefix(path, "/_all")
-	path = strings.TrimPrefix(path, "/*")
-	urlStr := "/" + indicesAsURI + path
-	reqURL, _ := url.Parse(urlStr)
-	ctx.r.URL = reqURL
+// APIs without indices, like `_search`, get scoped to permitted indices
+func mutatePath(ctx *requestContext) error {
+	rt := ctx.es.route
+	params := map[string]string{}
+	for name, value := range ctx.es.params {
+		params[name] = value
+	}
+
+	mutated := false
+	if variant := rt.indexedVariant(ctx.r.Method); variant != nil {
+		rt = variant
+		params["index"] = "_all"
+		mutated = true
+	}
+
+	for _, seg := range rt.segments {
+		name := strings.Trim(seg, "{}")
+		if !isParam(seg) || !indexParams[name] {
+			continue
+		}
+		expressions := strings.Split(params[name], ",")
+		if !hasWildcard(expressions) {
+			continue
+		}
+		// when nothing permitted matches, the expression is left to be denied
+		if resolved := resolveIndices(ctx, expressions, ctx.action()); len(resolved) > 0 {
+			params[name] = strings.Join(resolved, ",")
+			mutated = true
+		}
+	}
+	if !mutated {
+		return nil
+	}
+
+	return setPath(ctx, rt, params)
 }
 
-// mutate wildcard index patterns that are specified in the body to be whitelisted indices
-// kibana requires use of this function
-//
-func mutateWildcardIndexInBody(ctx *requestContext) error {
-	// this is gross
-	body, err := getBody(ctx.r)
+// evaluate date math index names in the path, like <logs-{now/d}>, so
+// elasticsearch gets the same indices that were authorized
+func mutateDateMathPath(ctx *requestContext) error {
+	params := map[string]string{}
+	mutated := false
+	for name, value := range ctx.es.params {
+		params[name] = value
+		if !indexParams[name] {
+			continue
+		}
+		if !strings.Contains(value, "<") {
+			continue
+		}
+		resolved, err := resolveDateMathIndices(strings.Split(value, ","))
+		if err != nil {
+			return err
+		}
+		params[name] = strings.Join(resolved, ",")
+		mutated = true
+	}
+	if !mutated {
+		return nil
+	}
+
+	return setPath(ctx, ctx.es.route, params)
+}
+
+// evaluate date math index names in the body the same way, so the fields
+// naming indices name the ones that get authorized
+func mutateDateMathBody(ctx *requestContext) error {
+	if len(bytes.TrimSpace(ctx.body)) == 0 {
+		return nil
+	}
+
+	var resolveErr error
+	body, mutated, err := rewriteBodyIndices(ctx.action(), ctx.body, func(index string) []string {
+		name := strings.TrimSpace(index)
+		if !isDateMath(name) {
+			return []string{index}
+		}
+		resolved, err := resolveDateMath(name, dateMathNow())
+		if err != nil {
+			resolveErr = err
+			return []string{index}
+		}
+		return []string{resolved}
+	})
 	if err != nil {
 		return err
 	}
-	re := regexp.MustCompile(`\"\*\"`)
-	cleanIndex := `"` + ctx.whitelistedIndicesNames + `"`
-	cleanBody := re.ReplaceAllString(string(body), cleanIndex)
-	ctx.r.Body = ioutil.NopCloser(bytes.NewReader([]byte(cleanBody)))
-	ctx.r.ContentLength = int64(len([]byte(cleanBody)))
-	ctx.trace.Body = cleanBody
+	if resolveErr != nil {
+		return resolveErr
+	}
+	if mutated {
+		setRequestBody(ctx, body)
+	}
+	return nil
+}
 
+// setPath points the request at the route filled in with the params,
+// keeping the query string
+func setPath(ctx *requestContext, rt *route, params map[string]string) error {
+	reqURL, err := url.Parse(rt.buildPath(params))
+	if err != nil {
+		return err
+	}
+	ctx.r.URL.Path = reqURL.Path
+	ctx.r.URL.RawPath = reqURL.RawPath
+	ctx.es = parseRoute(ctx.r)
+	if ctx.es == nil {
+		return fmt.Errorf("no elasticsearch route for %s %s", ctx.r.Method, ctx.r.URL.Path)
+	}
 	return nil
 }
+
+// mutate wildcard index patterns that are specified in the body to the
+// concrete indices they are permitted on. kibana requires use of this
+// function. only the fields naming indices are rewritten, so a `"*"` in a
+// query stays as it is. reports whether any permitted index matched
+func mutateWildcardIndexInBody(ctx *requestContext) (bool, error) {
+	resolved := resolveIndices(ctx, []string{"*"}, ctx.action())
+	if len(resolved) == 0 {
+		return false, nil
+	}
+
+	body, mutated, err := rewriteBodyIndices(ctx.action(), ctx.body, func(index string) []string {
+		if index == "*" {
+			return resolved
+		}
+		return []string{index}
+	})
+	if err != nil {
+		return false, err
+	}
+	if mutated {
+		setRequestBody(ctx, body)
+	}
+
+	return true, nil
+}
+
+// replace the body that is forwarded to elasticsearch
+func setRequestBody(ctx *requestContext, body []byte) {
+	ctx.body = body
+	ctx.r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	ctx.r.ContentLength = int64(len(body))
+	ctx.trace.Body = string(body)
+}
+
+// spliceResponseItems merges the items elasticsearch answered for the
+// permitted parts of a request with the items made for the denied parts,
+// keeping the order of the original request. key is the field of the
+// response holding the items
+func spliceResponseItems(body []byte, key string, denied []bool, deniedItem func(i int) interface{}) ([]byte, error) {
+	var res map[string]json.RawMessage
+	err := json.Unmarshal(body, &res)
+	if err != nil {
+		return body, err
+	}
+	var upstreamItems []json.RawMessage
+	if raw, ok := res[key]; ok {
+		err = json.Unmarshal(raw, &upstreamItems)
+		if err != nil {
+			return body, err
+		}
+	}
+
+	var merged []interface{}
+	for i := range denied {
+		if denied[i] {
+			merged = append(merged, deniedItem(i))
+			continue
+		}
+		if len(upstreamItems) == 0 {
+			return body, fmt.Errorf("response is missing %s", key)
+		}
+		merged = append(merged, upstreamItems[0])
+		upstreamItems = upstreamItems[1:]
+	}
+
+	res[key], err = json.Marshal(merged)
+	if err != nil {
+		return body, err
+	}
+
+	return json.Marshal(res)
+}
@@ -3,12 +3,16 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"time"
 
 	log "github.com/inconshreveable/log15"
@@ -28,30 +32,46 @@ func (C *Config) getConf(configPath string) *Config {
 		log.Error(err.Error())
 		os.Exit(1)
 	}
+	err = C.validateRoles()
+	if err != nil {
+		log.Error(err.Error())
+		os.Exit(1)
+	}
 
 	return C
 }
 
 // Prox defines our reverse proxy
 type Prox struct {
-	config *Config
-	target *url.URL
-	proxy  *httputil.ReverseProxy
-	log    log.Logger
+	config    *Config
+	target    *url.URL
+	proxy     *httputil.ReverseProxy
+	transport *traceTransport
+	cluster   *indexCache
+	contexts  *contextStore
+	auth      authenticator
+	tlsAuth   authenticator
+	log       log.Logger
 }
 
 // Trace - Request error handling wrapper on the handler
 type Trace struct {
-	Path    string
-	Method  string
-	Error   string
-	Message string
-	Code    int
-	Elapsed int
-	User    string
-	Groups  []string
-	Body    string
-	Access  []string
+	Path     string
+	Method   string
+	Error    string
+	Message  string
+	Action   string
+	Reason   string
+	Code     int
+	Elapsed  int
+	Upstream int
+	Bytes    int64
+	User     string
+	Groups   []string
+	Roles    []string
+	Tenant   string
+	Body     string
+	Access   []string
 }
 
 // NewProx returns new reverse proxy instance
@@ -64,62 +84,169 @@ func NewProx(C *Config) *Prox {
 			log.JsonFormat())))
 	}
 
-	return &Prox{
-		config: C,
-		target: url,
-		proxy:  httputil.NewSingleHostReverseProxy(url),
-		log:    logger,
+	p := &Prox{
+		config:    C,
+		target:    url,
+		proxy:     httputil.NewSingleHostReverseProxy(url),
+		transport: newTraceTransport(),
+		log:       logger,
+	}
+	// the proxy and its transport are shared by every request, so any
+	// per-request state must travel in the request context instead
+	p.proxy.Transport = p.transport
+	p.proxy.ModifyResponse = p.modifyResponse
+	p.proxy.ErrorHandler = p.upstreamError
+	p.cluster = newIndexCache(url, p.transport)
+	p.contexts = newContextStore()
+
+	auth, err := newAuthenticator(C, C.listenerAuthenticators())
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	p.auth = auth
+	if C.TLSListener.Enabled {
+		p.tlsAuth, err = newAuthenticator(C, C.tlsListenerAuthenticators())
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+
+	return p
+}
+
+type contextKey int
+
+const (
+	requestContextKey contextKey = iota
+	identityContextKey
+)
+
+// responseMutator rewrites the body of an elasticsearch response
+type responseMutator func(res *http.Response, body []byte) ([]byte, error)
+
+// withRequestContext attaches the request context to the request, so
+// the transport and response handling can find the state of the request
+func withRequestContext(r *http.Request, ctx *requestContext) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestContextKey, ctx))
+}
+
+// requestContextFromRequest returns the request context carried by the
+// request, if any
+func requestContextFromRequest(r *http.Request) *requestContext {
+	ctx, _ := r.Context().Value(requestContextKey).(*requestContext)
+	return ctx
+}
+
+// traceFromRequest returns the trace carried by the request, if any
+func traceFromRequest(r *http.Request) *Trace {
+	if ctx := requestContextFromRequest(r); ctx != nil {
+		return ctx.trace
 	}
+	return nil
 }
 
+// traceTransport is the upstream transport shared by all requests.
+// Connections to elasticsearch are pooled by the underlying transport,
+// and the response of each round trip is recorded on the Trace of the
+// request context carried by that request
 type traceTransport struct {
-	Response *http.Response
+	transport http.RoundTripper
+}
+
+func newTraceTransport() *traceTransport {
+	return &traceTransport{
+		transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			// every request goes to the same host, so the default of 2
+			// idle connections per host would churn connections under load
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}
 }
 
 func (p *Prox) handleRequest(w http.ResponseWriter, r *http.Request) {
+	p.serve(w, r, p.auth)
+}
+
+// handleTLSRequest serves the requests of the TLS listener, made by the
+// users of their client certificates unless other authenticators are set
+func (p *Prox) handleTLSRequest(w http.ResponseWriter, r *http.Request) {
+	p.serve(w, r, p.tlsAuth)
+}
+
+func (p *Prox) serve(w http.ResponseWriter, r *http.Request, auth authenticator) {
 	start := time.Now()
-	trace := Trace{}
+	trace := &Trace{Method: r.Method}
 
-	ctx, err := getRequestContext(r, p.config, &trace)
+	id, err := auth.authenticate(r)
 	if err != nil {
-		trace.Error = err.Error()
-		w.WriteHeader(http.StatusBadRequest)
+		trace.Reason = err.Error()
+		unauthorized(w, trace, err)
+		p.logTrace(r, trace, start)
+		return
 	}
+	r = withIdentity(r, id)
+	stripIdentityHeaders(r, p.config)
 
-	trans := traceTransport{}
-	p.proxy.Transport = &trans
+	ctx, err := getRequestContext(r, p.config, trace)
+	if err != nil {
+		trace.Error = err.Error()
+		trace.Code = http.StatusBadRequest
+		w.WriteHeader(trace.Code)
+		p.logTrace(r, trace, start)
+		return
+	}
+	ctx.cluster = p.cluster
+	ctx.contexts = p.contexts
 
 	ok, err := p.checkRBAC(ctx)
-	if !ok {
-		w.WriteHeader(http.StatusUnauthorized)
-	} else if err != nil {
+	if err != nil {
 		trace.Error = err.Error()
-		w.WriteHeader(http.StatusUnauthorized)
-	} else {
-		p.proxy.ServeHTTP(w, r)
 	}
-
-	trace.Elapsed = int(time.Since(start) / time.Millisecond)
-	if trans.Response != nil {
-		trace.Code = trans.Response.StatusCode
+	if !ok || err != nil {
+		trace.Code = http.StatusForbidden
+		w.WriteHeader(trace.Code)
+	} else if ctx.localResponse != nil {
+		respondLocally(w, ctx)
 	} else {
-		trace.Code = 403
+		p.proxy.ServeHTTP(w, withRequestContext(ctx.r, ctx))
 	}
 
-	trace.Method = r.Method
+	p.logTrace(ctx.r, trace, start)
+}
+
+func (p *Prox) logTrace(r *http.Request, trace *Trace, start time.Time) {
+	trace.Elapsed = int(time.Since(start) / time.Millisecond)
+	trace.Path = r.URL.Path
 
 	fields := log.Ctx{
-		"code":    trace.Code,
-		"method":  r.Method,
-		"path":    r.URL.Path,
-		"elasped": trace.Elapsed,
-		"user":    trace.User,
-		"groups":  trace.Groups,
-		"body":    trace.Body,
-		"access":  trace.Access,
+		"code":     trace.Code,
+		"method":   trace.Method,
+		"path":     trace.Path,
+		"action":   trace.Action,
+		"reason":   trace.Reason,
+		"elasped":  trace.Elapsed,
+		"upstream": trace.Upstream,
+		"bytes":    trace.Bytes,
+		"user":     trace.User,
+		"groups":   trace.Groups,
+		"roles":    trace.Roles,
+		"tenant":   trace.Tenant,
+		"body":     trace.Body,
+		"access":   trace.Access,
 	}
 
-	if err != nil {
+	if trace.Error != "" {
 		p.log.Error(trace.Error, fields)
 	} else if trace.Code != 200 {
 		p.log.Warn(trace.Message, fields)
@@ -128,8 +255,62 @@ func (p *Prox) handleRequest(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// respondLocally answers requests that don't need elasticsearch at all,
+// like a bulk request where every item was denied
+func respondLocally(w http.ResponseWriter, ctx *requestContext) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	n, _ := w.Write(ctx.localResponse)
+	ctx.trace.Code = http.StatusOK
+	ctx.trace.Bytes = int64(n)
+}
+
+// modifyResponse applies the response mutators of the request, and
+// counts the bytes sent back to the client
+func (p *Prox) modifyResponse(res *http.Response) error {
+	ctx := requestContextFromRequest(res.Request)
+	if ctx == nil {
+		return nil
+	}
+
+	if len(ctx.responseMutators) > 0 {
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, mutate := range ctx.responseMutators {
+			body, err = mutate(res, body)
+			if err != nil {
+				return err
+			}
+		}
+		res.Body = ioutil.NopCloser(bytes.NewReader(body))
+		res.ContentLength = int64(len(body))
+		res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	res.Body = &countingBody{ReadCloser: res.Body, n: &ctx.trace.Bytes}
+	return nil
+}
+
+// upstreamError is called by the reverse proxy when elasticsearch
+// could not be reached or the response could not be copied
+func (p *Prox) upstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	if trace := traceFromRequest(r); trace != nil {
+		trace.Code = http.StatusBadGateway
+		trace.Error = err.Error()
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
 func (t *traceTransport) RoundTrip(request *http.Request) (*http.Response, error) {
-	res, err := http.DefaultTransport.RoundTrip(request)
+	start := time.Now()
+	res, err := t.transport.RoundTrip(request)
+	trace := traceFromRequest(request)
+	if trace != nil {
+		trace.Upstream = int(time.Since(start) / time.Millisecond)
+	}
 	if err != nil {
 		return res, err
 	}
@@ -137,20 +318,47 @@ func (t *traceTransport) RoundTrip(request *http.Request) (*http.Response, error
 	if res.Header.Get("Content-Encoding") == "gzip" {
 		body, err := gzip.NewReader(res.Body)
 		if err != nil {
-			return res, err
+			res.Body.Close()
+			return nil, err
 		}
-		res.Body = body
+		res.Body = &gzipBody{Reader: body, body: res.Body}
 		res.Header.Del("Content-Encoding")
 		res.Header.Del("Content-Length")
 		res.ContentLength = -1
 		res.Uncompressed = true
 	}
 
-	t.Response = res
+	if trace != nil {
+		trace.Code = res.StatusCode
+	}
 
 	return res, nil
 }
 
+// gzipBody decompresses the upstream body and closes it when done, so
+// the connection can be returned to the pool
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// countingBody counts the response bytes read by the reverse proxy
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	*b.n += int64(n)
+	return n, err
+}
+
 func getBody(r *http.Request) ([]byte, error) {
 	var body []byte
 	buf, err := ioutil.ReadAll(r.Body)
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	log "github.com/inconshreveable/log15"
+)
+
+// statuses returned by the fake upstream, picked per user so that
+// concurrent requests get different responses
+var upstreamStatuses = []int{200, 201, 202, 404, 409, 429, 500}
+
+func upstreamStatus(user string) int {
+	n, _ := strconv.Atoi(strings.TrimPrefix(user, "user"))
+	return upstreamStatuses[n%len(upstreamStatuses)]
+}
+
+func getTestProx(target string) *Prox {
+	var c Config
+	c.getConf("config.example.yaml")
+	c.Target = target
+
+	return NewProx(&c)
+}
+
+// collect the log records emitted for each trace
+func captureTraces(p *Prox) (map[string]log.Ctx, *sync.Mutex) {
+	var mu sync.Mutex
+	traces := map[string]log.Ctx{}
+	p.log.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		fields := log.Ctx{}
+		for i := 0; i+1 < len(r.Ctx); i += 2 {
+			fields[fmt.Sprint(r.Ctx[i])] = r.Ctx[i+1]
+		}
+		mu.Lock()
+		traces[fmt.Sprint(fields["user"])] = fields
+		mu.Unlock()
+		return nil
+	}))
+	return traces, &mu
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the identity headers are stripped, so the user is told by the
+		// opaque ID deflek tags requests with
+		user := strings.TrimPrefix(r.Header.Get("X-Opaque-Id"), "deflek:user+")
+		w.WriteHeader(upstreamStatus(user))
+		fmt.Fprintf(w, `{"user":"%s"}`, user)
+	}))
+	defer upstream.Close()
+
+	p := getTestProx(upstream.URL)
+	traces, mu := captureTraces(p)
+
+	const requests = 500
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+
+			req := httptest.NewRequest("GET", "/test_deflek/_search", nil)
+			req.Header.Add("X-Remote-User", user)
+			req.Header.Add("X-Remote-Groups", "OU=thing,CN=group2,DC=something")
+			w := httptest.NewRecorder()
+
+			p.handleRequest(w, req)
+
+			if w.Code != upstreamStatus(user) {
+				t.Errorf("%s: got status %d, expected %d", user, w.Code, upstreamStatus(user))
+			}
+			expectedBody := fmt.Sprintf(`{"user":"%s"}`, user)
+			if w.Body.String() != expectedBody {
+				t.Errorf("%s: got body %s, expected %s", user, w.Body.String(), expectedBody)
+			}
+		}(fmt.Sprintf("user%d", i))
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(traces) != requests {
+		t.Fatalf("got %d traces, expected %d", len(traces), requests)
+	}
+	for user, fields := range traces {
+		if fields["code"] != upstreamStatus(user) {
+			t.Errorf("%s: traced code %v, expected %d", user, fields["code"], upstreamStatus(user))
+		}
+		expectedBytes := int64(len(fmt.Sprintf(`{"user":"%s"}`, user)))
+		if fields["bytes"] != expectedBytes {
+			t.Errorf("%s: traced %v bytes, expected %d", user, fields["bytes"], expectedBytes)
+		}
+	}
+}
+
+func TestForbiddenRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("forbidden request reached upstream: ", r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	p := getTestProx(upstream.URL)
+	traces, _ := captureTraces(p)
+
+	req := httptest.NewRequest("GET", "/secret_stuff/_search", nil)
+	req.Header.Add("X-Remote-User", "dustind")
+	req.Header.Add("X-Remote-Groups", "OU=thing,CN=group2,DC=something")
+	w := httptest.NewRecorder()
+
+	p.handleRequest(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d, expected %d", w.Code, http.StatusForbidden)
+	}
+	if traces["dustind"]["code"] != http.StatusForbidden {
+		t.Errorf("traced code %v, expected %d", traces["dustind"]["code"], http.StatusForbidden)
+	}
+}
+
+func TestUpstreamUnavailable(t *testing.T) {
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	p := getTestProx(upstream.URL)
+	traces, _ := captureTraces(p)
+
+	req := httptest.NewRequest("GET", "/test_deflek/_search", nil)
+	req.Header.Add("X-Remote-User", "dustind")
+	req.Header.Add("X-Remote-Groups", "OU=thing,CN=group2,DC=something")
+	w := httptest.NewRecorder()
+
+	p.handleRequest(w, req)
+
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got status %d, expected %d", w.Code, http.StatusBadGateway)
+	}
+	if traces["dustind"]["code"] != http.StatusBadGateway {
+		t.Errorf("traced code %v, expected %d", traces["dustind"]["code"], http.StatusBadGateway)
+	}
+}
@@ -11,19 +11,32 @@ import (
 type Permissions struct {
 	WhitelistedIndices []Index `yaml:"whitelisted_indices"`
 	WhitelistedAPIs    []API   `yaml:"whitelisted_apis"`
-	CanManage          bool    `yaml:"can_manage"`
+	// denied indices and APIs override what any group whitelists. without
+	// REST verbs or actions, a rule denies everything
+	DeniedIndices []Index `yaml:"denied_indices"`
+	DeniedAPIs    []API   `yaml:"denied_apis"`
+	CanManage     bool    `yaml:"can_manage"`
 }
 
-// Index struct defines index and REST verbs allowed
+// Index struct defines index and REST verbs or actions allowed. With
+// Alias set, Name is an alias instead, and grants the indices behind it.
+// DocumentFilter is a query limiting the documents that can be seen, and
+// AllowedFields and DeniedFields are patterns limiting their fields
 type Index struct {
-	Name      string
-	RESTverbs []string `yaml:"rest_verbs"`
+	Name           string
+	Alias          bool        `yaml:"alias"`
+	RESTverbs      []string    `yaml:"rest_verbs"`
+	Actions        []string    `yaml:"actions"`
+	DocumentFilter interface{} `yaml:"document_filter"`
+	AllowedFields  []string    `yaml:"allowed_fields"`
+	DeniedFields   []string    `yaml:"denied_fields"`
 }
 
-// API struct defines index and REST verbs allowed
+// API struct defines index and REST verbs or actions allowed
 type API struct {
 	Name      string
 	RESTverbs []string `yaml:"rest_verbs"`
+	Actions   []string `yaml:"actions"`
 }
 
 type requestContext struct {
@@ -34,8 +47,21 @@ type requestContext struct {
 	whitelistedIndices      []Index
 	whitelistedIndicesNames string
 	whitelistedAPIs         []API
+	deniedIndices           []Index
+	deniedAPIs              []API
 	indices                 []string
 	firstPathComponent      string
+	es                      *esRequest
+	// the indices and aliases of the cluster, to resolve wildcards with
+	cluster *indexCache
+	// rewrite the elasticsearch response before it is sent to the client
+	responseMutators []responseMutator
+	// answer the request without forwarding it to elasticsearch
+	localResponse []byte
+	// the tenant whose kibana indices the request uses
+	tenant string
+	// the owners of scrolls, points in time and async searches
+	contexts *contextStore
 }
 
 func getRequestContext(r *http.Request, C *Config, trace *Trace) (*requestContext, error) {
@@ -56,6 +82,8 @@ func getRequestContext(r *http.Request, C *Config, trace *Trace) (*requestContex
 		return nil, err
 	}
 
+	deniedIndices, deniedAPIs := getDenied(r, C)
+
 	var indicesStrSlice []string
 	for _, whitelistedIndex := range whitelistedIndices {
 		indicesStrSlice = append(indicesStrSlice, whitelistedIndex.Name)
@@ -68,13 +96,24 @@ func getRequestContext(r *http.Request, C *Config, trace *Trace) (*requestContex
 		body:                    body,
 		whitelistedIndices:      whitelistedIndices,
 		whitelistedAPIs:         whitelistedAPIs,
+		deniedIndices:           deniedIndices,
+		deniedAPIs:              deniedAPIs,
 		whitelistedIndicesNames: strings.Join(indicesStrSlice, ","),
 		firstPathComponent:      getFirstPathComponent(r),
+		es:                      parseRoute(r),
 	}
 
 	return &ctx, nil
 }
 
+// action returns the elasticsearch action of the request, if it was routed
+func (ctx *requestContext) action() string {
+	if ctx.es == nil {
+		return ""
+	}
+	return ctx.es.action
+}
+
 func (p *Prox) checkRBAC(ctx *requestContext) (bool, error) {
 
 	user, err := getUser(ctx.r, ctx.C)
@@ -85,6 +124,25 @@ func (p *Prox) checkRBAC(ctx *requestContext) (bool, error) {
 
 	groups := getGroups(ctx.r, ctx.C)
 	ctx.trace.Groups = groups
+	ctx.trace.Roles = getRoles(ctx.r, ctx.C)
+
+	// requests that elasticsearch wouldn't route are not understood,
+	// so they can't be authorized either
+	if ctx.es == nil {
+		ctx.trace.Reason = "no elasticsearch route for " + ctx.r.Method + " " + ctx.r.URL.Path
+		return false, nil
+	}
+	ctx.trace.Action = ctx.es.action
+
+	if ctx.C.KibanaTenancy.Enabled {
+		tenant, ok := getTenant(ctx.r, ctx.C)
+		if !ok {
+			ctx.trace.Reason = "tenant " + ctx.r.Header.Get(ctx.C.KibanaTenancy.TenantHeader) + " is not one of the groups of the user"
+			return false, nil
+		}
+		ctx.tenant = tenant
+		ctx.trace.Tenant = tenant
+	}
 
 	ok, err := apiPermitted(ctx)
 	if err != nil || !ok {
@@ -96,35 +154,137 @@ func (p *Prox) checkRBAC(ctx *requestContext) (bool, error) {
 		return false, err
 	}
 
+	ok, err = managePermitted(ctx)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	ok, err = contextsPermitted(ctx)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	ok, err = tasksPermitted(ctx)
+	if err != nil || !ok {
+		return false, err
+	}
+	// tasks are told apart by who started them
+	tagOpaqueID(ctx)
+
+	// the client gets the kibana index names it asked for
+	if ctx.tenant != "" {
+		ctx.responseMutators = append(ctx.responseMutators, ctx.untenantResponse)
+	}
+
 	return true, nil
 }
 
+// managePermitted requires `can_manage` for management actions, unless
+// every index of the request is granted an action covering it. REST verbs
+// don't count, since PUT and DELETE are needed for documents too
+func managePermitted(ctx *requestContext) (bool, error) {
+	action := ctx.action()
+	if !isManagementAction(action) {
+		return true, nil
+	}
+
+	ok, err := canManage(ctx.r, ctx.C)
+	if err != nil || ok {
+		return ok, err
+	}
+
+	// the indices of the path and the body, like the ones of _aliases
+	indices := ctx.indices
+	if len(indices) == 0 {
+		indices = ctx.es.indices
+	}
+	indices, err = resolveDateMathIndices(indices)
+	if err != nil {
+		return false, err
+	}
+	if len(indices) == 0 {
+		ctx.trace.Reason = action + " is a management action and requires can_manage"
+		return false, nil
+	}
+	for _, index := range indices {
+		if !ctx.manageGranted(index, action) {
+			ctx.trace.Reason = action + " is a management action and requires can_manage, or manage on index " + index
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// manageGranted reports whether an index grant gives the management
+// action on the index through its actions
+func (ctx *requestContext) manageGranted(index string, action string) bool {
+	index = ctx.logicalIndex(index)
+	for _, whitelistedIndex := range ctx.whitelistedIndices {
+		if glob.Glob(whitelistedIndex.Name, index) && actionPermitted(action, whitelistedIndex.Actions) {
+			return true
+		}
+	}
+	return false
+}
+
 func canManage(r *http.Request, C *Config) (bool, error) {
-	groups := getGroups(r, C)
+	// Can the user or any of the groups manage?
+	for _, permissions := range getPermissions(r, C) {
+		if permissions.CanManage == true {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
 
-	// Can any of the groups manage?
-	for _, group := range groups {
+// getPermissions returns the permissions of the groups of the request,
+// along with the ones given to the user and to their roles
+func getPermissions(r *http.Request, C *Config) []Permissions {
+	var permissions []Permissions
+	for _, group := range getGroups(r, C) {
 		if configGroup, ok := C.RBAC.Groups[group]; ok {
-			if configGroup.CanManage == true {
-				return true, nil
-			}
+			permissions = append(permissions, configGroup)
 		}
 	}
 
-	return false, nil
+	user, _ := getUser(r, C)
+	if configUser, ok := C.RBAC.Users[user]; ok && user != "" {
+		permissions = append(permissions, configUser)
+	}
+
+	for _, role := range getRoles(r, C) {
+		permissions = append(permissions, C.RBAC.Roles[role].Permissions)
+	}
+
+	return permissions
 }
 
 func getUser(r *http.Request, C *Config) (string, error) {
+	return requestIdentity(r, C).user, nil
+}
+
+func getGroups(r *http.Request, C *Config) []string {
+	return requestIdentity(r, C).groups
+}
+
+// headerIdentity is who the user and group headers say made the request
+func headerIdentity(r *http.Request, C *Config) *identity {
+	return &identity{user: headerUser(r, C), groups: headerGroups(r, C), dns: headerGroupDNs(r, C)}
+}
+
+func headerUser(r *http.Request, C *Config) string {
 	// Username is trusted input provided by a SSO proxy layer
 	var username string
 	if _, ok := r.Header[C.UserHeaderName]; ok {
 		username = r.Header[C.UserHeaderName][0]
 	}
 
-	return username, nil
+	return username
 }
 
-func getGroups(r *http.Request, C *Config) []string {
+func headerGroups(r *http.Request, C *Config) []string {
 	// Group is trusted input provided by a SSO proxy layer
 	var groups = []string{C.AnonymousGroup}
 	if _, ok := r.Header[C.GroupHeaderName]; ok {
@@ -163,13 +323,10 @@ func getSpaceDelimitedGroups(rawGroups string) []string {
 
 func getWhitelistedIndices(r *http.Request, C *Config) ([]Index, error) {
 	var indices []Index
-	groups := getGroups(r, C)
 
-	for _, group := range groups {
-		if configGroup, ok := C.RBAC.Groups[group]; ok {
-			for _, configIndex := range configGroup.WhitelistedIndices {
-				indices = append(indices, configIndex)
-			}
+	for _, permissions := range getPermissions(r, C) {
+		for _, configIndex := range permissions.WhitelistedIndices {
+			indices = append(indices, configIndex)
 		}
 	}
 
@@ -178,37 +335,56 @@ func getWhitelistedIndices(r *http.Request, C *Config) ([]Index, error) {
 
 func getWhitelistedAPIs(r *http.Request, C *Config) ([]API, error) {
 	var apis []API
-	groups := getGroups(r, C)
 
-	for _, group := range groups {
-		if configGroup, ok := C.RBAC.Groups[group]; ok {
-			for _, configAPI := range configGroup.WhitelistedAPIs {
-				apis = append(apis, configAPI)
-			}
+	for _, permissions := range getPermissions(r, C) {
+		for _, configAPI := range permissions.WhitelistedAPIs {
+			apis = append(apis, configAPI)
 		}
 	}
 
 	return apis, nil
 }
 
+// getDenied collects the deny rules of the user and all the groups of the
+// request
+func getDenied(r *http.Request, C *Config) ([]Index, []API) {
+	var indices []Index
+	var apis []API
+	for _, permissions := range getPermissions(r, C) {
+		indices = append(indices, permissions.DeniedIndices...)
+		apis = append(apis, permissions.DeniedAPIs...)
+	}
+	return indices, apis
+}
+
 func getFirstPathComponent(r *http.Request) string {
 	return strings.Split(r.URL.Path, "/")[1]
 }
 
 func apiPermitted(ctx *requestContext) (bool, error) {
-	api := extractAPI(ctx.r)
+	var api string
+	if ctx.es != nil {
+		api = ctx.es.api
+	}
 
 	if len(api) > 0 {
+		for _, deniedAPI := range ctx.deniedAPIs {
+			if glob.Glob(deniedAPI.Name, api) && deniedAPI.denies(ctx.r.Method, ctx.action()) {
+				ctx.trace.Reason = "API " + api + " is denied by denied_apis rule " + deniedAPI.Name
+				return false, nil
+			}
+		}
 		for _, whitelistedAPI := range ctx.whitelistedAPIs {
 			// match API patterns in the RBAC config against patterns
 			// that were extracted (both support globs)
 			if glob.Glob(whitelistedAPI.Name, api) {
-				// also enforce REST verbs that are permitted on the API
-				if stringInSlice(ctx.r.Method, whitelistedAPI.RESTverbs) {
+				// also enforce REST verbs or actions that are permitted on the API
+				if whitelistedAPI.permits(ctx.r.Method, ctx.action()) {
 					return true, nil
 				}
 			}
 		}
+		ctx.trace.Reason = "API " + api + " is not whitelisted for " + ctx.r.Method + " " + ctx.action()
 		return false, nil
 	}
 	return true, nil
@@ -216,10 +392,62 @@ func apiPermitted(ctx *requestContext) (bool, error) {
 
 func indexPermitted(ctx *requestContext) (bool, error) {
 
-	if ctx.firstPathComponent == "_all" ||
-		ctx.firstPathComponent == "_search" ||
-		ctx.firstPathComponent == "*" {
-		mutatePath(ctx)
+	err := mutateDateMathPath(ctx)
+	if err != nil {
+		return false, err
+	}
+	err = mutateDateMathBody(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// kibana indices are the tenant's from here on
+	if ctx.tenant != "" {
+		err = mutateTenantPath(ctx)
+		if err != nil {
+			return false, err
+		}
+		err = mutateTenantBody(ctx)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// documents in the response lose the fields that can't be seen
+	if fieldReadActions[ctx.action()] && ctx.hasFieldRules() {
+		ctx.responseMutators = append(ctx.responseMutators, ctx.stripFields)
+	}
+
+	// listings of indices only show the indices that can be seen
+	ok, err := listingPermitted(ctx)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	// multi item requests are authorized item by item
+	switch ctx.action() {
+	case "indices:data/write/bulk":
+		return bulkPermitted(ctx)
+	case "indices:data/read/msearch":
+		return msearchPermitted(ctx, "indices:data/read/search")
+	case "indices:data/read/msearch/template":
+		return msearchPermitted(ctx, "indices:data/read/search/template")
+	case "indices:data/read/mget":
+		return mgetPermitted(ctx)
+	}
+
+	// searches on a point in time are on the indices it was opened on
+	if ctx.action() == "indices:data/read/search" {
+		if pit := parseContextRequest(ctx.body).Pit; pit != nil {
+			return pitSearchPermitted(ctx, pit.ID)
+		}
+	}
+
+	if ctx.es.route.indexedVariant(ctx.r.Method) != nil || hasWildcard(ctx.es.indices) {
+		err = mutatePath(ctx)
+		if err != nil {
+			return false, err
+		}
 	}
 
 	indices, err := extractIndices(ctx)
@@ -227,44 +455,154 @@ func indexPermitted(ctx *requestContext) (bool, error) {
 		return false, err
 	}
 
-	var allowedIndices []string
-
-	// support searching wild card indices
-	// req'd by Kibana Visual Builder
-	// this implementation is gross
+	// if this request operates on any indices, apply RBAC logic
 	for i, index := range indices {
+		// support searching wild card indices
+		// req'd by Kibana Visual Builder
 		if index == "*" {
-			err := mutateWildcardIndexInBody(ctx)
+			ok, err := mutateWildcardIndexInBody(ctx)
 			if err != nil {
 				return false, err
 			}
-			indices[i] = ctx.whitelistedIndicesNames
-			allowedIndices = append(allowedIndices, ctx.whitelistedIndicesNames)
+			if !ok {
+				ctx.trace.Reason = "no whitelisted indices match * for " + ctx.r.Method + " " + ctx.action()
+				return false, nil
+			}
+			continue
+		}
+
+		// exclusions only narrow down the wildcards before them
+		if isExclusion(indices, i) {
+			continue
+		}
+
+		if !indexActionPermitted(ctx, index, ctx.action()) {
+			ctx.trace.Reason = indexDenialReason(ctx, index, ctx.action())
+			return false, nil
 		}
 	}
 
-	// if this request operates on any indices, apply RBAC logic
-	if len(indices) > 0 {
-		for _, whitelistedIndex := range ctx.whitelistedIndices {
-			for _, index := range indices {
-				// match index patterns in the RBAC config against patterns
-				// that were extracted (both support globs)
-				if glob.Glob(whitelistedIndex.Name, index) {
-					// also enforce REST verbs that are permitted on the index
-					if stringInSlice(ctx.r.Method, whitelistedIndex.RESTverbs) {
-						allowedIndices = append(allowedIndices, index)
-					}
-				}
+	var pathIndices []string
+	for i, index := range ctx.es.indices {
+		if !isExclusion(ctx.es.indices, i) {
+			pathIndices = append(pathIndices, index)
+		}
+	}
+	// fields first, the document filter refers to fields of its own
+	ok, err = fieldLevelSecurity(ctx, pathIndices)
+	if err != nil || !ok {
+		return false, err
+	}
+	return documentLevelSecurity(ctx, pathIndices)
+}
+
+// indexActionPermitted reports whether the whitelisted indices allow the
+// action on the index. aliases are authorized on the indices behind them,
+// unless they are filtered or granted by name
+func indexActionPermitted(ctx *requestContext, index string, action string) bool {
+	// authorize on the index the date math evaluates to
+	if isDateMath(index) {
+		resolved, err := resolveDateMath(index, dateMathNow())
+		if err != nil {
+			return false
+		}
+		index = resolved
+	}
+
+	if _, denied := ctx.deniedIndex(index, action); denied {
+		return false
+	}
+	if ctx.foreignKibanaIndex(index) {
+		return false
+	}
+
+	// without a view of the cluster, aliases can't be told apart from indices
+	if !ctx.cluster.loaded() {
+		return ctx.granted(index, action, false) || ctx.granted(index, action, true)
+	}
+	// with one, wildcards are resolved to the permitted indices they match
+	// before they get here. a wildcard left matched none of them, and
+	// elasticsearch would expand it to indices that are denied
+	if hasWildcard([]string{index}) {
+		return false
+	}
+
+	if alias, ok := ctx.cluster.alias(index); ok {
+		// deny rules on the indices behind an alias override granting it
+		for _, backing := range alias.Indices {
+			if _, denied := ctx.deniedIndex(backing, action); denied {
+				return false
 			}
 		}
-	} else {
-		return true, nil
+		if ctx.granted(index, action, true) {
+			return true
+		}
+		// filtered aliases only show part of their indices, so they are
+		// a resource of their own that has to be granted by name
+		if alias.Filtered {
+			return false
+		}
+		return allPermitted(ctx, alias.Indices, action)
 	}
 
-	if len(allowedIndices) >= len(indices) {
-		return true, nil
+	if ctx.granted(index, action, false) {
+		return true
 	}
-	return false, nil
+	// granting an alias grants the indices behind it, unless it's filtered
+	for _, name := range ctx.cluster.aliasesOf(index) {
+		alias, _ := ctx.cluster.alias(name)
+		if !alias.Filtered && ctx.granted(name, action, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// deniedIndex returns the deny rule matching the action on the index
+func (ctx *requestContext) deniedIndex(index string, action string) (Index, bool) {
+	index = ctx.logicalIndex(index)
+	for _, deniedIndex := range ctx.deniedIndices {
+		if glob.Glob(deniedIndex.Name, index) && deniedIndex.denies(ctx.r.Method, action) {
+			return deniedIndex, true
+		}
+	}
+	return Index{}, false
+}
+
+// indexDenialReason explains why the action isn't permitted on the index,
+// naming the deny rule if one is the cause
+func indexDenialReason(ctx *requestContext, index string, action string) string {
+	names := []string{index}
+	if alias, ok := ctx.cluster.aliasIfLoaded(index); ok {
+		names = append(names, alias.Indices...)
+	}
+	for _, name := range names {
+		if rule, denied := ctx.deniedIndex(name, action); denied {
+			return "index " + name + " is denied by denied_indices rule " + rule.Name
+		}
+	}
+	return "index " + index + " is not whitelisted for " + ctx.r.Method + " " + action
+}
+
+// granted reports whether any whitelisted index, or alias, matching the
+// name allows the action
+func (ctx *requestContext) granted(name string, action string, alias bool) bool {
+	// the kibana indices of the tenant are granted as the kibana indices
+	name = ctx.logicalIndex(name)
+	for _, whitelistedIndex := range ctx.whitelistedIndices {
+		if whitelistedIndex.Alias != alias {
+			continue
+		}
+		// match index patterns in the RBAC config against patterns
+		// that were extracted (both support globs)
+		if glob.Glob(whitelistedIndex.Name, name) {
+			// also enforce REST verbs or actions that are permitted on the index
+			if whitelistedIndex.permits(ctx.r.Method, action) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func stringInSlice(a string, list []string) bool {
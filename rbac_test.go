@@ -8,21 +8,65 @@ import (
 	"github.com/google/go-cmp/cmp"
 )
 
-func getTestContext(path string, body string, method string) (*requestContext, error) {
-	req, _ := http.NewRequest(method, "http://localhost:9200"+path, bytes.NewBufferString(body))
-	req.Header.Add("X-Remote-User", "dustind")
-	req.Header.Add("X-Remote-Groups", "OU=thing,CN=group2,DC=something")
+// testFixture is the request and config a test context is made from
+type testFixture struct {
+	r     *http.Request
+	C     *Config
+	store *contextStore
+}
+
+// testOption changes the fixture before the context is made
+type testOption func(f *testFixture)
+
+// withUser makes the request by the user
+func withUser(user string) testOption {
+	return func(f *testFixture) {
+		f.r.Header.Set("X-Remote-User", user)
+	}
+}
 
+// withGroups makes the request by the groups
+func withGroups(groups string) testOption {
+	return func(f *testFixture) {
+		f.r.Header.Set("X-Remote-Groups", groups)
+	}
+}
+
+func newTestFixture(path string, body string, method string, options []testOption) *testFixture {
+	req, _ := http.NewRequest(method, "http://localhost:9200"+path, bytes.NewBufferString(body))
 	var c Config
 	c.getConf("config.example.yaml")
 
+	f := &testFixture{r: req, C: &c}
+	withUser("dustind")(f)
+	withGroups("OU=thing,CN=group2,DC=something")(f)
+	for _, option := range options {
+		option(f)
+	}
+	return f
+}
+
+// getTestContext returns the context of a request made by dustind of
+// group2 with the example config, unless the options say otherwise
+func getTestContext(path string, body string, method string, options ...testOption) (*requestContext, error) {
+	f := newTestFixture(path, body, method, options)
+
 	var trace Trace
 
-	ctx, err := getRequestContext(req, &c, &trace)
+	ctx, err := getRequestContext(f.r, f.C, &trace)
+	if ctx != nil {
+		ctx.contexts = f.store
+	}
 
 	return ctx, err
 }
 
+// getTestConfig returns the example config changed by the options, for
+// the tests of authenticators and of the proxy
+func getTestConfig(options ...testOption) *Config {
+	return newTestFixture("/", "", "GET", options).C
+}
+
 func TestIndexPermitted(t *testing.T) {
 	body := `{"index":"*","ignore":[404],"timeout":"90s","requestTimeout":90000,"ignoreUnavailable":true}
 {"size":0,"query":{"bool":{"must":[{"range":{"@timestamp":{"gte":1519223869113,"lte":1519225669114,"format":"epoch_millis"}}},{"bool":{"must":[{"match_all":{}}],"must_not":[]}}]}},"aggs":{"61ca57f1-469d-11e7-af02-69e470af7417":{"filter":{"match_all":{}},"aggs":{"timeseries":{"date_histogram":{"field":"@timestamp","interval":"30s","min_doc_count":0,"time_zone":"America/Chicago","extended_bounds":{"min":1519223869113,"max":1519225669114}},"aggs":{"61ca57f2-469d-11e7-af02-69e470af7417":{"bucket_script":{"buckets_path":{"count":"_count"},"script":{"inline":"count * 1","lang":"expression"},"gap_policy":"skip"}}}}}}}}
@@ -180,6 +224,136 @@ func TestCanManage(t *testing.T) {
 	}
 }
 
+func TestManagePermitted(t *testing.T) {
+	cases := []struct {
+		groups    string
+		method    string
+		path      string
+		permitted bool
+	}{
+		// can_manage
+		{"CN=group2", "PUT", "/_cluster/settings", true},
+		{"CN=group2", "PUT", "/_template/kibana_index_template", true},
+		{"CN=group2", "DELETE", "/test_deflek", true},
+		{"CN=group1", "PUT", "/_template/kibana_index_template", false},
+		{"CN=group1", "PUT", "/_snapshot/repo/snap", false},
+		{"CN=group1", "DELETE", "/secret_stuff", false},
+		{"CN=group1", "PUT", "/_ingest/pipeline/p", false},
+		{"CN=group1", "GET", "/_template/kibana_index_template", true},
+		{"CN=group2", "POST", "/test_deflek/_close", true},
+		{"CN=group1", "POST", "/test_deflek/_close", false},
+		{"CN=group1", "POST", "/test_deflek/_open", false},
+		{"CN=group1", "PUT", "/_data_stream/logs-app", false},
+		{"CN=group1", "DELETE", "/_data_stream/logs-app", false},
+		{"CN=group1", "PUT", "/test_deflek/_mapping", false},
+		{"CN=group1", "PUT", "/test_deflek/_alias/current", false},
+		{"CN=group1", "POST", "/test_deflek/_shrink/test_deflek_small", false},
+		{"CN=group1", "POST", "/test_deflek/_rollover", false},
+		{"CN=group1", "POST", "/_cluster/reroute", false},
+		{"CN=group1", "PUT", "/_scripts/score", false},
+		{"CN=group2", "POST", "/_sql", true},
+		{"CN=group1", "POST", "/_sql/translate", false},
+		{"CN=group1", "POST", "/_sql/close", false},
+
+		// manage scope per index pattern
+		{"CN=shippers", "PUT", "/logs-2024", true},
+		{"CN=shippers", "PUT", "/%3Clogs-%7Bnow%2Fd%7D%3E", true},
+		{"CN=shippers", "PUT", "/audit-2024", false},
+		{"CN=shippers", "DELETE", "/logs-2024", false},
+		{"CN=shippers", "POST", "/_reindex", false},
+		{"CN=shippers", "POST", "/logs-2024/_doc", true},
+		{"CN=shippers", "PUT", "/_data_stream/logs-app", true},
+		{"CN=shippers", "DELETE", "/_data_stream/logs-app", false},
+		{"CN=shippers", "POST", "/logs-2024/_close", false},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, "", c.method, withGroups(c.groups))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		ok, err := managePermitted(ctx)
+		if err != nil {
+			t.Errorf("%s %s %s: %v", c.groups, c.method, c.path, err)
+		}
+		if ok != c.permitted {
+			t.Errorf("%s %s %s: got permitted %v, expected %v", c.groups, c.method, c.path, ok, c.permitted)
+		}
+		if !ok && ctx.trace.Reason == "" {
+			t.Errorf("%s %s %s: denied without a reason", c.groups, c.method, c.path)
+		}
+	}
+}
+
+func TestSQLDenied(t *testing.T) {
+	var p Prox
+	for _, groups := range []string{"CN=team-a", "CN=support"} {
+		ctx, err := getTestContext("/_sql", `{"query":"SELECT * FROM secret_stuff"}`, "POST", withGroups(groups))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+		ok, err := p.checkRBAC(ctx)
+		if err != nil {
+			t.Errorf("%s: %v", groups, err)
+		}
+		if ok {
+			t.Errorf("%s: _sql permitted without can_manage", groups)
+		}
+	}
+}
+
+func TestBodyIndicesPermitted(t *testing.T) {
+	cases := []struct {
+		groups    string
+		path      string
+		body      string
+		permitted bool
+	}{
+		{"CN=group2", "/_aliases", `{"actions":[{"add":{"index":"test_deflek","alias":"test_deflek"}}]}`, true},
+		{"CN=group2", "/_aliases", `{"actions":[{"add":{"index":"secret_stuff","alias":"test_deflek"}}]}`, false},
+		{"CN=group2", "/_aliases", `{"actions":[{"add":{"index":"test_deflek","alias":"secret_stuff"}}]}`, false},
+		{"CN=group2", "/_aliases", `{"actions":[{"remove":{"indices":["test_deflek","secret_stuff"],"alias":"test_deflek"}}]}`, false},
+		{"CN=group2", "/_aliases", `{"actions":[{"remove_index":{"index":"secret_stuff"}}]}`, false},
+		{"CN=group2", "/_reindex", `{"source":{"index":"test_deflek"},"dest":{"index":"test_deflek"}}`, true},
+		{"CN=group2", "/_reindex", `{"source":{"index":"secret_stuff"},"dest":{"index":"test_deflek"}}`, false},
+		{"CN=group2", "/_reindex", `{"source":{"index":["test_deflek","secret_stuff"]},"dest":{"index":"test_deflek"}}`, false},
+		{"CN=group2", "/_reindex", `{"source":{"index":"test_deflek"},"dest":{"index":"secret_stuff"}}`, false},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, c.body, "POST", withGroups(c.groups))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		ok, err := indexPermitted(ctx)
+		if err != nil {
+			t.Errorf("%s %s: %v", c.path, c.body, err)
+		}
+		if ok != c.permitted {
+			t.Errorf("%s %s: got permitted %v, expected %v (%s)", c.path, c.body, ok, c.permitted, ctx.trace.Reason)
+		}
+	}
+}
+
+// elasticsearch reads bodies with comments, which would hide their indices
+func TestBodyIndicesInvalid(t *testing.T) {
+	for path, body := range map[string]string{
+		"/_reindex": `{"source":{/* c */"index":"secret_stuff"},"dest":{"index":"test_deflek"}}`,
+		"/_aliases": `{"actions":[{"remove_index":{/* c */"index":"secret_stuff"}}]}`,
+	} {
+		ctx, err := getTestContext(path, body, "POST", withGroups("CN=group2"))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		if ok, _ := indexPermitted(ctx); ok {
+			t.Errorf("%s %s: permitted", path, body)
+		}
+	}
+}
+
 func indexInSlice(a Index, indices []Index) bool {
 	for _, b := range indices {
 		if b.Name == a.Name {
@@ -188,3 +362,107 @@ func indexInSlice(a Index, indices []Index) bool {
 	}
 	return false
 }
+
+func TestDeniedIndices(t *testing.T) {
+	cache := getTestIndexCache(t)
+
+	cases := []struct {
+		method    string
+		path      string
+		permitted bool
+		reason    string
+	}{
+		{"GET", "/globby-1/_search", true, ""},
+		{"GET", "/globby-2/_search", false, "index globby-2 is denied by denied_indices rule globby-2"},
+		{"GET", "/globby-1,globby-2/_search", false, "index globby-2 is denied by denied_indices rule globby-2"},
+		// aliases over a denied index are denied too
+		{"GET", "/latest/_search", false, "index globby-2 is denied by denied_indices rule globby-2"},
+		{"GET", "/globby/_search", false, "index globby-2 is denied by denied_indices rule globby-2"},
+		// rules with actions only deny those
+		{"GET", "/test_deflek/_search", true, ""},
+		{"POST", "/test_deflek/_doc", false, "index test_deflek is denied by denied_indices rule test_deflek"},
+		// wildcards leave denied indices out
+		{"GET", "/globby-*/_search", true, ""},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, "", c.method, withGroups("CN=group2,CN=contractors"))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+		ctx.cluster = cache
+
+		ok, err := indexPermitted(ctx)
+		if err != nil {
+			t.Errorf("%s %s: %v", c.method, c.path, err)
+		}
+		if ok != c.permitted {
+			t.Errorf("%s %s: got permitted %v, expected %v (%s)", c.method, c.path, ok, c.permitted, ctx.trace.Reason)
+		}
+		if !ok && ctx.trace.Reason != c.reason {
+			t.Errorf("%s %s: got reason %q, expected %q", c.method, c.path, ctx.trace.Reason, c.reason)
+		}
+		if c.path == "/globby-*/_search" && ctx.r.URL.Path != "/globby-1/_search" {
+			t.Errorf("%s %s: got path %s, expected /globby-1/_search", c.method, c.path, ctx.r.URL.Path)
+		}
+	}
+}
+
+func TestDeniedAPIs(t *testing.T) {
+	ctx, err := getTestContext("/_mget", "", "POST", withGroups("CN=group2"))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ok, err := apiPermitted(ctx)
+	if err != nil || !ok {
+		t.Errorf("_mget denied without a deny rule: %v (%s)", err, ctx.trace.Reason)
+	}
+
+	ctx, err = getTestContext("/_mget", "", "POST", withGroups("CN=group2,CN=contractors"))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ok, err = apiPermitted(ctx)
+	if err != nil || ok {
+		t.Errorf("_mget permitted with a deny rule: %v", err)
+	}
+	expected := "API _mget is denied by denied_apis rule _mget"
+	if ctx.trace.Reason != expected {
+		t.Errorf("got reason %q, expected %q", ctx.trace.Reason, expected)
+	}
+}
+
+func TestUserPermissions(t *testing.T) {
+	cases := []struct {
+		user      string
+		groups    string
+		method    string
+		path      string
+		permitted bool
+	}{
+		{"metrics-shipper", "CN=nobody", "POST", "/metrics-2024/_doc", true},
+		{"metrics-shipper", "CN=nobody", "POST", "/logs-2024/_doc", false},
+		{"dustind", "CN=nobody", "POST", "/metrics-2024/_doc", false},
+		// merged with the permissions of the groups
+		{"metrics-shipper", "CN=group2", "GET", "/test_deflek/_search", true},
+		{"metrics-shipper", "CN=group2", "PUT", "/metrics-2024", true},
+		{"oncall", "CN=group1", "PUT", "/_cluster/settings", true},
+		{"dustind", "CN=group1", "PUT", "/_cluster/settings", false},
+	}
+
+	var p Prox
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, "", c.method, withUser(c.user), withGroups(c.groups))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		ok, err := p.checkRBAC(ctx)
+		if err != nil {
+			t.Errorf("%s %s %s: %v", c.user, c.method, c.path, err)
+		}
+		if ok != c.permitted {
+			t.Errorf("%s %s %s: got permitted %v, expected %v (%s)", c.user, c.method, c.path, ok, c.permitted, ctx.trace.Reason)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	glob "github.com/ryanuber/go-glob"
+)
+
+// Role is a named set of permissions, which can include the permissions of
+// other roles
+type Role struct {
+	Permissions `yaml:",inline"`
+	Inherits    []string `yaml:"inherits"`
+}
+
+// RoleMapping gives a role to the users, groups and group DNs matching
+// its patterns. patterns are exact names, globs, or regular expressions
+// wrapped in slashes like `/^ops-.*$/`
+type RoleMapping struct {
+	Role   string
+	Users  []string
+	Groups []string
+	DNs    []string `yaml:"dns"`
+}
+
+// compiled regular expressions of the role mapping patterns
+var rolePatterns sync.Map
+
+func isRegexPattern(pattern string) bool {
+	return len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+}
+
+// patternMatches matches a value against a role mapping pattern
+func patternMatches(pattern string, value string) bool {
+	if !isRegexPattern(pattern) {
+		return glob.Glob(pattern, value)
+	}
+
+	re, ok := rolePatterns.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return false
+		}
+		re, _ = rolePatterns.LoadOrStore(pattern, compiled)
+	}
+	return re.(*regexp.Regexp).MatchString(value)
+}
+
+func anyPatternMatches(patterns []string, values []string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if patternMatches(pattern, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateRoles checks that the mapped and inherited roles exist and that
+// the mapping patterns compile
+func (C *Config) validateRoles() error {
+	for name, role := range C.RBAC.Roles {
+		for _, inherited := range role.Inherits {
+			if _, ok := C.RBAC.Roles[inherited]; !ok {
+				return fmt.Errorf("role %s inherits unknown role %s", name, inherited)
+			}
+		}
+	}
+
+	for _, mapping := range C.RBAC.RoleMappings {
+		if _, ok := C.RBAC.Roles[mapping.Role]; !ok {
+			return fmt.Errorf("role mapping for unknown role %s", mapping.Role)
+		}
+		patterns := append(append(append([]string{}, mapping.Users...), mapping.Groups...), mapping.DNs...)
+		for _, pattern := range patterns {
+			if !isRegexPattern(pattern) {
+				continue
+			}
+			_, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return fmt.Errorf("role mapping for %s: %v", mapping.Role, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// getGroupDNs returns the distinguished names of the groups of the request
+func getGroupDNs(r *http.Request, C *Config) []string {
+	return requestIdentity(r, C).dns
+}
+
+// headerGroupDNs returns the distinguished names of the groups, when the
+// group header has them
+func headerGroupDNs(r *http.Request, C *Config) []string {
+	var dns []string
+	if C.GroupHeaderType != "AD" {
+		return dns
+	}
+	if _, ok := r.Header[C.GroupHeaderName]; ok {
+		for _, dn := range strings.Split(r.Header[C.GroupHeaderName][0], ";") {
+			if dn = strings.TrimSpace(dn); dn != "" {
+				dns = append(dns, dn)
+			}
+		}
+	}
+	return dns
+}
+
+// getRoles returns the roles mapped to the user and groups of the request,
+// followed by the roles they inherit
+func getRoles(r *http.Request, C *Config) []string {
+	user, _ := getUser(r, C)
+	groups := getGroups(r, C)
+	dns := getGroupDNs(r, C)
+
+	var roles []string
+	seen := map[string]bool{}
+	var add func(role string)
+	add = func(role string) {
+		if seen[role] {
+			return
+		}
+		seen[role] = true
+		roles = append(roles, role)
+		for _, inherited := range C.RBAC.Roles[role].Inherits {
+			add(inherited)
+		}
+	}
+
+	for _, mapping := range C.RBAC.RoleMappings {
+		if _, ok := C.RBAC.Roles[mapping.Role]; !ok {
+			continue
+		}
+		if (user != "" && anyPatternMatches(mapping.Users, []string{user})) ||
+			anyPatternMatches(mapping.Groups, groups) ||
+			anyPatternMatches(mapping.DNs, dns) {
+			add(mapping.Role)
+		}
+	}
+
+	return roles
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGetRoles(t *testing.T) {
+	cases := []struct {
+		user     string
+		groups   string
+		expected []string
+	}{
+		{"dustind", "CN=group2", nil},
+		{"dustind", "CN=kibana-users", []string{"kibana-reader"}},
+		{"dustind", "CN=sre-team", []string{"dashboards-editor", "kibana-reader"}},
+		{"dustind", "CN=sre-team-leads", nil},
+		{"dustind", "CN=writers,OU=Editors,DC=example,DC=com", []string{"dashboards-editor", "kibana-reader"}},
+		{"oncall", "CN=group2", []string{"dashboards-editor", "kibana-reader"}},
+		{"dustind", "CN=kibana-users;CN=ops-team", []string{"kibana-reader", "dashboards-editor"}},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext("/_search", "", "GET", withUser(c.user), withGroups(c.groups))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		got := getRoles(ctx.r, ctx.C)
+		if diff := cmp.Diff(c.expected, got); diff != "" {
+			t.Errorf("%s %s: unexpected roles: (-want +got)\n%s", c.user, c.groups, diff)
+		}
+	}
+}
+
+func TestRolePermissions(t *testing.T) {
+	cases := []struct {
+		groups    string
+		method    string
+		path      string
+		permitted bool
+	}{
+		{"CN=kibana-users", "GET", "/.kibana/_search", true},
+		{"CN=kibana-users", "POST", "/dashboards-1/_doc", false},
+		// inherited roles
+		{"CN=ops-team", "GET", "/.kibana/_search", true},
+		{"CN=ops-team", "POST", "/dashboards-1/_search", true},
+		{"CN=nobody", "GET", "/.kibana/_search", false},
+	}
+
+	var p Prox
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, "", c.method, withGroups(c.groups))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+
+		ok, err := p.checkRBAC(ctx)
+		if err != nil {
+			t.Errorf("%s %s %s: %v", c.groups, c.method, c.path, err)
+		}
+		if ok != c.permitted {
+			t.Errorf("%s %s %s: got permitted %v, expected %v (%s)", c.groups, c.method, c.path, ok, c.permitted, ctx.trace.Reason)
+		}
+		if len(ctx.trace.Roles) == 0 && c.groups != "CN=nobody" {
+			t.Errorf("%s %s %s: no roles in the trace", c.groups, c.method, c.path)
+		}
+	}
+}
+
+func TestValidateRoles(t *testing.T) {
+	var c Config
+	c.getConf("config.example.yaml")
+	if err := c.validateRoles(); err != nil {
+		t.Error("example config has invalid roles: ", err)
+	}
+
+	c.RBAC.Roles["broken"] = Role{Inherits: []string{"missing"}}
+	if err := c.validateRoles(); err == nil {
+		t.Error("inheriting an unknown role passed validation")
+	}
+	delete(c.RBAC.Roles, "broken")
+
+	c.RBAC.RoleMappings = append(c.RBAC.RoleMappings, RoleMapping{Role: "kibana-reader", Groups: []string{"/(/"}})
+	if err := c.validateRoles(); err == nil {
+		t.Error("invalid regular expression passed validation")
+	}
+}
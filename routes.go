@@ -0,0 +1,709 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// routeSpec declares the paths of one elasticsearch REST endpoint, modeled
+// on the REST API spec shipped with elasticsearch 6.x and 7.x. Actions are
+// named after the transport actions elasticsearch executes for them.
+type routeSpec struct {
+	methods string
+	action  string
+	paths   []string
+}
+
+// path parameters that hold index names (or index patterns, or aliases).
+// everything else in a path is a literal or an opaque parameter
+var indexParams = map[string]bool{
+	"index":     true,
+	"target":    true,
+	"new_index": true,
+	"alias":     true,
+}
+
+var routeSpecs = []routeSpec{
+	// root
+	{"GET HEAD", "cluster:monitor/main", []string{"/"}},
+
+	// document APIs
+	{"PUT POST", "indices:data/write/index", []string{
+		"/{index}/_doc/{id}", "/{index}/_doc", "/{index}/_create/{id}",
+		"/{index}/{type}/{id}", "/{index}/{type}", "/{index}/{type}/{id}/_create"}},
+	{"GET HEAD", "indices:data/read/get", []string{
+		"/{index}/_doc/{id}", "/{index}/{type}/{id}",
+		"/{index}/_source/{id}", "/{index}/{type}/{id}/_source"}},
+	{"DELETE", "indices:data/write/delete", []string{
+		"/{index}/_doc/{id}", "/{index}/{type}/{id}"}},
+	{"POST", "indices:data/write/update", []string{
+		"/{index}/_update/{id}", "/{index}/{type}/{id}/_update"}},
+	{"PUT POST", "indices:data/write/bulk", []string{
+		"/_bulk", "/{index}/_bulk", "/{index}/{type}/_bulk"}},
+	{"GET POST", "indices:data/read/mget", []string{
+		"/_mget", "/{index}/_mget", "/{index}/{type}/_mget"}},
+	{"POST", "indices:data/write/delete/byquery", []string{
+		"/{index}/_delete_by_query", "/{index}/{type}/_delete_by_query"}},
+	{"POST", "indices:data/write/update/byquery", []string{
+		"/{index}/_update_by_query", "/{index}/{type}/_update_by_query"}},
+	{"POST", "indices:data/write/reindex", []string{"/_reindex"}},
+	{"POST", "cluster:admin/reindex/rethrottle", []string{
+		"/_reindex/{task_id}/_rethrottle",
+		"/_delete_by_query/{task_id}/_rethrottle",
+		"/_update_by_query/{task_id}/_rethrottle"}},
+	{"GET POST", "indices:data/read/tv", []string{
+		"/{index}/_termvectors/{id}", "/{index}/_termvectors",
+		"/{index}/{type}/{id}/_termvectors", "/{index}/{type}/_termvectors"}},
+	{"GET POST", "indices:data/read/mtv", []string{
+		"/_mtermvectors", "/{index}/_mtermvectors", "/{index}/{type}/_mtermvectors"}},
+
+	// search APIs
+	{"GET POST", "indices:data/read/search", []string{
+		"/_search", "/{index}/_search", "/{index}/{type}/_search",
+		"/_count", "/{index}/_count", "/{index}/{type}/_count"}},
+	{"GET POST", "indices:data/read/msearch", []string{
+		"/_msearch", "/{index}/_msearch", "/{index}/{type}/_msearch"}},
+	{"GET POST", "indices:data/read/search/template", []string{
+		"/_search/template", "/{index}/_search/template", "/{index}/{type}/_search/template"}},
+	{"GET POST", "indices:data/read/msearch/template", []string{
+		"/_msearch/template", "/{index}/_msearch/template", "/{index}/{type}/_msearch/template"}},
+	{"GET POST", "cluster:admin/render/template/search", []string{
+		"/_render/template", "/_render/template/{id}"}},
+	{"GET POST", "indices:data/read/scroll", []string{
+		"/_search/scroll", "/_search/scroll/{scroll_id}"}},
+	{"DELETE", "indices:data/read/scroll/clear", []string{
+		"/_search/scroll", "/_search/scroll/{scroll_id}"}},
+	{"GET POST", "indices:data/read/explain", []string{
+		"/{index}/_explain/{id}", "/{index}/{type}/{id}/_explain"}},
+	{"GET POST", "indices:data/read/field_caps", []string{
+		"/_field_caps", "/{index}/_field_caps"}},
+	{"GET POST", "indices:data/read/field_stats", []string{
+		"/_field_stats", "/{index}/_field_stats"}},
+	{"GET POST", "indices:admin/validate/query", []string{
+		"/_validate/query", "/{index}/_validate/query", "/{index}/{type}/_validate/query"}},
+	{"GET POST", "indices:admin/shards/search_shards", []string{
+		"/_search_shards", "/{index}/_search_shards"}},
+	{"GET POST", "indices:data/read/rank_eval", []string{
+		"/_rank_eval", "/{index}/_rank_eval"}},
+	{"POST", "indices:data/read/open_point_in_time", []string{"/{index}/_pit"}},
+	{"DELETE", "indices:data/read/close_point_in_time", []string{"/_pit"}},
+	{"POST", "indices:data/read/async_search/submit", []string{
+		"/_async_search", "/{index}/_async_search"}},
+	{"GET", "indices:data/read/async_search/get", []string{"/_async_search/{id}"}},
+	{"DELETE", "indices:data/read/async_search/delete", []string{"/_async_search/{id}"}},
+	{"GET", "cluster:monitor/async_search/status", []string{"/_async_search/status/{id}"}},
+
+	// scripts
+	{"PUT POST", "cluster:admin/script/put", []string{
+		"/_scripts/{id}", "/_scripts/{id}/{context}"}},
+	{"GET", "cluster:admin/script/get", []string{"/_scripts/{id}"}},
+	{"DELETE", "cluster:admin/script/delete", []string{"/_scripts/{id}"}},
+	{"GET POST", "cluster:admin/scripts/painless/execute", []string{"/_scripts/painless/_execute"}},
+	{"GET", "cluster:admin/script_context/get", []string{"/_script_context"}},
+	{"GET", "cluster:admin/script_language/get", []string{"/_script_language"}},
+
+	// index management
+	{"PUT", "indices:admin/create", []string{"/{index}"}},
+	{"DELETE", "indices:admin/delete", []string{"/{index}"}},
+	{"GET", "indices:admin/get", []string{"/{index}"}},
+	{"HEAD", "indices:admin/exists", []string{"/{index}"}},
+	{"HEAD", "indices:admin/types/exists", []string{"/{index}/_mapping/{type}"}},
+	{"POST", "indices:admin/open", []string{"/{index}/_open"}},
+	{"POST", "indices:admin/close", []string{"/{index}/_close"}},
+	{"POST", "indices:admin/freeze", []string{"/{index}/_freeze", "/{index}/_unfreeze"}},
+	{"PUT POST", "indices:admin/resize", []string{
+		"/{index}/_shrink/{target}", "/{index}/_split/{target}", "/{index}/_clone/{target}"}},
+	{"POST", "indices:admin/rollover", []string{
+		"/{alias}/_rollover", "/{alias}/_rollover/{new_index}"}},
+	{"GET POST", "indices:admin/refresh", []string{"/_refresh", "/{index}/_refresh"}},
+	{"GET POST", "indices:admin/flush", []string{"/_flush", "/{index}/_flush"}},
+	{"GET POST", "indices:admin/synced_flush", []string{"/_flush/synced", "/{index}/_flush/synced"}},
+	{"POST", "indices:admin/forcemerge", []string{"/_forcemerge", "/{index}/_forcemerge"}},
+	{"POST", "indices:admin/cache/clear", []string{"/_cache/clear", "/{index}/_cache/clear"}},
+	{"POST", "indices:admin/upgrade", []string{"/_upgrade", "/{index}/_upgrade"}},
+	{"GET", "indices:monitor/upgrade", []string{"/_upgrade", "/{index}/_upgrade"}},
+	{"GET POST", "indices:admin/analyze", []string{"/_analyze", "/{index}/_analyze"}},
+	{"GET", "indices:admin/resolve/index", []string{"/_resolve/index/{index}"}},
+	{"PUT", "indices:admin/data_stream/create", []string{"/_data_stream/{index}"}},
+	{"DELETE", "indices:admin/data_stream/delete", []string{"/_data_stream/{index}"}},
+	{"GET", "indices:admin/data_stream/get", []string{"/_data_stream", "/_data_stream/{index}"}},
+
+	// aliases
+	{"POST", "indices:admin/aliases", []string{"/_aliases"}},
+	{"PUT POST DELETE", "indices:admin/aliases", []string{
+		"/{index}/_alias/{name}", "/{index}/_aliases/{name}"}},
+	{"GET", "indices:admin/aliases/get", []string{
+		"/_aliases", "/{index}/_aliases", "/_alias", "/_alias/{name}",
+		"/{index}/_alias", "/{index}/_alias/{name}"}},
+	{"HEAD", "indices:admin/aliases/exists", []string{
+		"/_alias/{name}", "/{index}/_alias", "/{index}/_alias/{name}"}},
+
+	// mappings
+	{"GET", "indices:admin/mappings/get", []string{
+		"/_mapping", "/{index}/_mapping", "/_mapping/{type}", "/{index}/_mapping/{type}",
+		"/_mappings", "/{index}/_mappings", "/_mappings/{type}", "/{index}/_mappings/{type}"}},
+	{"PUT POST", "indices:admin/mapping/put", []string{
+		"/{index}/_mapping", "/{index}/_mapping/{type}", "/{index}/{type}/_mapping",
+		"/_mapping/{type}", "/{index}/_mappings", "/{index}/_mappings/{type}",
+		"/{index}/{type}/_mappings", "/_mappings/{type}"}},
+	{"GET", "indices:admin/mappings/fields/get", []string{
+		"/_mapping/field/{fields}", "/{index}/_mapping/field/{fields}",
+		"/_mapping/{type}/field/{fields}", "/{index}/_mapping/{type}/field/{fields}"}},
+
+	// settings
+	{"GET", "indices:monitor/settings/get", []string{
+		"/_settings", "/{index}/_settings", "/_settings/{name}", "/{index}/_settings/{name}"}},
+	{"PUT", "indices:admin/settings/update", []string{"/_settings", "/{index}/_settings"}},
+
+	// templates
+	{"GET HEAD", "indices:admin/template/get", []string{"/_template", "/_template/{name}"}},
+	{"PUT POST", "indices:admin/template/put", []string{"/_template/{name}"}},
+	{"DELETE", "indices:admin/template/delete", []string{"/_template/{name}"}},
+	{"GET HEAD", "indices:admin/index_template/get", []string{"/_index_template", "/_index_template/{name}"}},
+	{"PUT POST", "indices:admin/index_template/put", []string{"/_index_template/{name}"}},
+	{"DELETE", "indices:admin/index_template/delete", []string{"/_index_template/{name}"}},
+	{"POST", "indices:admin/index_template/simulate", []string{
+		"/_index_template/_simulate", "/_index_template/_simulate/{name}",
+		"/_index_template/_simulate_index/{index}"}},
+	{"GET HEAD", "cluster:admin/component_template/get", []string{"/_component_template", "/_component_template/{name}"}},
+	{"PUT POST", "cluster:admin/component_template/put", []string{"/_component_template/{name}"}},
+	{"DELETE", "cluster:admin/component_template/delete", []string{"/_component_template/{name}"}},
+
+	// index monitoring
+	{"GET", "indices:monitor/stats", []string{
+		"/_stats", "/_stats/{metric}", "/{index}/_stats", "/{index}/_stats/{metric}"}},
+	{"GET", "indices:monitor/segments", []string{"/_segments", "/{index}/_segments"}},
+	{"GET", "indices:monitor/recovery", []string{"/_recovery", "/{index}/_recovery"}},
+	{"GET", "indices:monitor/shard_stores", []string{"/_shard_stores", "/{index}/_shard_stores"}},
+
+	// index lifecycle management
+	{"PUT", "cluster:admin/ilm/put", []string{"/_ilm/policy/{policy}"}},
+	{"GET", "cluster:admin/ilm/get", []string{"/_ilm/policy", "/_ilm/policy/{policy}"}},
+	{"DELETE", "cluster:admin/ilm/delete", []string{"/_ilm/policy/{policy}"}},
+	{"GET", "indices:admin/ilm/explain", []string{"/{index}/_ilm/explain"}},
+	{"POST", "indices:admin/ilm/remove_policy", []string{"/{index}/_ilm/remove"}},
+	{"POST", "indices:admin/ilm/retry", []string{"/{index}/_ilm/retry"}},
+	{"POST", "cluster:admin/ilm/_move/post", []string{"/_ilm/move/{index}"}},
+	{"GET", "cluster:admin/ilm/operation_mode/get", []string{"/_ilm/status"}},
+	{"POST", "cluster:admin/ilm/start", []string{"/_ilm/start"}},
+	{"POST", "cluster:admin/ilm/stop", []string{"/_ilm/stop"}},
+
+	// cluster
+	{"GET", "cluster:monitor/health", []string{"/_cluster/health", "/_cluster/health/{index}"}},
+	{"GET", "cluster:monitor/state", []string{
+		"/_cluster/state", "/_cluster/state/{metric}", "/_cluster/state/{metric}/{index}"}},
+	{"GET", "cluster:monitor/stats", []string{"/_cluster/stats", "/_cluster/stats/nodes/{node_id}"}},
+	{"GET", "cluster:monitor/settings", []string{"/_cluster/settings"}},
+	{"PUT", "cluster:admin/settings/update", []string{"/_cluster/settings"}},
+	{"POST", "cluster:admin/reroute", []string{"/_cluster/reroute"}},
+	{"GET POST", "cluster:monitor/allocation/explain", []string{"/_cluster/allocation/explain"}},
+	{"GET", "cluster:monitor/task", []string{"/_cluster/pending_tasks"}},
+	{"GET", "cluster:monitor/remote/info", []string{"/_remote/info"}},
+	{"POST", "cluster:admin/voting_config/add_exclusions", []string{
+		"/_cluster/voting_config_exclusions", "/_cluster/voting_config_exclusions/{node_name}"}},
+	{"DELETE", "cluster:admin/voting_config/clear_exclusions", []string{"/_cluster/voting_config_exclusions"}},
+
+	// nodes
+	{"GET", "cluster:monitor/nodes/info", []string{
+		"/_nodes", "/_nodes/{node_id}", "/_nodes/{node_id}/{metric}"}},
+	{"GET", "cluster:monitor/nodes/stats", []string{
+		"/_nodes/stats", "/_nodes/{node_id}/stats", "/_nodes/stats/{metric}",
+		"/_nodes/{node_id}/stats/{metric}", "/_nodes/stats/{metric}/{index_metric}",
+		"/_nodes/{node_id}/stats/{metric}/{index_metric}"}},
+	{"GET", "cluster:monitor/nodes/hot_threads", []string{
+		"/_nodes/hot_threads", "/_nodes/{node_id}/hot_threads"}},
+	{"GET", "cluster:monitor/nodes/usage", []string{
+		"/_nodes/usage", "/_nodes/{node_id}/usage", "/_nodes/usage/{metric}",
+		"/_nodes/{node_id}/usage/{metric}"}},
+	{"POST", "cluster:admin/nodes/reload_secure_settings", []string{
+		"/_nodes/reload_secure_settings", "/_nodes/{node_id}/reload_secure_settings"}},
+
+	// tasks
+	{"GET", "cluster:monitor/tasks/lists", []string{"/_tasks"}},
+	{"GET", "cluster:monitor/task/get", []string{"/_tasks/{task_id}"}},
+	{"POST", "cluster:admin/tasks/cancel", []string{"/_tasks/_cancel", "/_tasks/{task_id}/_cancel"}},
+
+	// snapshots
+	{"PUT POST", "cluster:admin/repository/put", []string{"/_snapshot/{repository}"}},
+	{"GET", "cluster:admin/repository/get", []string{"/_snapshot", "/_snapshot/{repository}"}},
+	{"DELETE", "cluster:admin/repository/delete", []string{"/_snapshot/{repository}"}},
+	{"POST", "cluster:admin/repository/verify", []string{"/_snapshot/{repository}/_verify"}},
+	{"POST", "cluster:admin/repository/_cleanup", []string{"/_snapshot/{repository}/_cleanup"}},
+	{"PUT POST", "cluster:admin/snapshot/create", []string{"/_snapshot/{repository}/{snapshot}"}},
+	{"GET", "cluster:admin/snapshot/get", []string{"/_snapshot/{repository}/{snapshot}"}},
+	{"DELETE", "cluster:admin/snapshot/delete", []string{"/_snapshot/{repository}/{snapshot}"}},
+	{"POST", "cluster:admin/snapshot/restore", []string{"/_snapshot/{repository}/{snapshot}/_restore"}},
+	{"PUT", "cluster:admin/snapshot/clone", []string{"/_snapshot/{repository}/{snapshot}/_clone/{target_snapshot}"}},
+	{"GET", "cluster:admin/snapshot/status", []string{
+		"/_snapshot/_status", "/_snapshot/{repository}/_status",
+		"/_snapshot/{repository}/{snapshot}/_status"}},
+
+	// ingest
+	{"PUT", "cluster:admin/ingest/pipeline/put", []string{"/_ingest/pipeline/{id}"}},
+	{"GET", "cluster:admin/ingest/pipeline/get", []string{"/_ingest/pipeline", "/_ingest/pipeline/{id}"}},
+	{"DELETE", "cluster:admin/ingest/pipeline/delete", []string{"/_ingest/pipeline/{id}"}},
+	{"GET POST", "cluster:admin/ingest/pipeline/simulate", []string{
+		"/_ingest/pipeline/_simulate", "/_ingest/pipeline/{id}/_simulate"}},
+	{"GET", "cluster:admin/ingest/processor/grok/get", []string{"/_ingest/processor/grok"}},
+
+	// x-pack security
+	{"GET", "cluster:admin/xpack/security/user/authenticate", []string{"/_security/_authenticate"}},
+	{"PUT POST", "cluster:admin/xpack/security/user/put", []string{"/_security/user/{username}"}},
+	{"GET", "cluster:admin/xpack/security/user/get", []string{"/_security/user", "/_security/user/{username}"}},
+	{"DELETE", "cluster:admin/xpack/security/user/delete", []string{"/_security/user/{username}"}},
+	{"PUT POST", "cluster:admin/xpack/security/user/change_password", []string{
+		"/_security/user/_password", "/_security/user/{username}/_password"}},
+	{"PUT POST", "cluster:admin/xpack/security/user/set_enabled", []string{
+		"/_security/user/{username}/_enable", "/_security/user/{username}/_disable"}},
+	{"GET POST", "cluster:admin/xpack/security/user/has_privileges", []string{
+		"/_security/user/_has_privileges", "/_security/user/{user}/_has_privileges"}},
+	{"GET", "cluster:admin/xpack/security/user/list_privileges", []string{"/_security/user/_privileges"}},
+	{"PUT POST", "cluster:admin/xpack/security/role/put", []string{"/_security/role/{name}"}},
+	{"GET", "cluster:admin/xpack/security/role/get", []string{"/_security/role", "/_security/role/{name}"}},
+	{"DELETE", "cluster:admin/xpack/security/role/delete", []string{"/_security/role/{name}"}},
+	{"POST", "cluster:admin/xpack/security/roles/cache/clear", []string{"/_security/role/{name}/_clear_cache"}},
+	{"PUT POST", "cluster:admin/xpack/security/role_mapping/put", []string{"/_security/role_mapping/{name}"}},
+	{"GET", "cluster:admin/xpack/security/role_mapping/get", []string{
+		"/_security/role_mapping", "/_security/role_mapping/{name}"}},
+	{"DELETE", "cluster:admin/xpack/security/role_mapping/delete", []string{"/_security/role_mapping/{name}"}},
+	{"PUT POST", "cluster:admin/xpack/security/privilege/put", []string{"/_security/privilege"}},
+	{"GET", "cluster:admin/xpack/security/privilege/get", []string{
+		"/_security/privilege", "/_security/privilege/{application}", "/_security/privilege/{application}/{name}"}},
+	{"DELETE", "cluster:admin/xpack/security/privilege/delete", []string{"/_security/privilege/{application}/{name}"}},
+	{"GET", "cluster:admin/xpack/security/privilege/builtin/get", []string{"/_security/privilege/_builtin"}},
+	{"POST", "cluster:admin/xpack/security/privilege/cache/clear", []string{
+		"/_security/privilege/{application}/_clear_cache"}},
+	{"POST", "cluster:admin/xpack/security/realm/cache/clear", []string{"/_security/realm/{realms}/_clear_cache"}},
+	{"PUT POST", "cluster:admin/xpack/security/api_key/create", []string{"/_security/api_key"}},
+	{"GET", "cluster:admin/xpack/security/api_key/get", []string{"/_security/api_key"}},
+	{"DELETE", "cluster:admin/xpack/security/api_key/invalidate", []string{"/_security/api_key"}},
+	{"POST", "cluster:admin/xpack/security/api_key/grant", []string{"/_security/api_key/grant"}},
+	{"POST", "cluster:admin/xpack/security/api_key/cache/clear", []string{"/_security/api_key/{ids}/_clear_cache"}},
+	{"POST", "cluster:admin/xpack/security/token/create", []string{"/_security/oauth2/token"}},
+	{"DELETE", "cluster:admin/xpack/security/token/invalidate", []string{"/_security/oauth2/token"}},
+	{"POST", "cluster:admin/xpack/security/saml/prepare", []string{"/_security/saml/prepare"}},
+	{"POST", "cluster:admin/xpack/security/saml/authenticate", []string{"/_security/saml/authenticate"}},
+	{"POST", "cluster:admin/xpack/security/saml/logout", []string{"/_security/saml/logout"}},
+	{"POST", "cluster:admin/xpack/security/saml/invalidate", []string{"/_security/saml/invalidate"}},
+	{"POST", "cluster:admin/xpack/security/saml/complete_logout", []string{"/_security/saml/complete_logout"}},
+	{"GET", "cluster:monitor/xpack/security/saml/metadata", []string{"/_security/saml/metadata/{realm_name}"}},
+	{"POST", "cluster:admin/xpack/security/oidc/prepare", []string{"/_security/oidc/prepare"}},
+	{"POST", "cluster:admin/xpack/security/oidc/authenticate", []string{"/_security/oidc/authenticate"}},
+	{"POST", "cluster:admin/xpack/security/oidc/logout", []string{"/_security/oidc/logout"}},
+	{"POST", "cluster:admin/xpack/security/delegate_pki", []string{"/_security/delegate_pki"}},
+	{"GET", "cluster:monitor/xpack/ssl/certificates/get", []string{"/_ssl/certificates"}},
+	{"GET", "cluster:admin/xpack/security/service_account/get", []string{
+		"/_security/service", "/_security/service/{namespace}", "/_security/service/{namespace}/{service}"}},
+	{"PUT POST", "cluster:admin/xpack/security/service_account/token/create", []string{
+		"/_security/service/{namespace}/{service}/credential/token",
+		"/_security/service/{namespace}/{service}/credential/token/{name}"}},
+	{"DELETE", "cluster:admin/xpack/security/service_account/token/delete", []string{
+		"/_security/service/{namespace}/{service}/credential/token/{name}"}},
+	{"GET", "cluster:admin/xpack/security/service_account/credential/get", []string{
+		"/_security/service/{namespace}/{service}/_credentials"}},
+
+	// x-pack info and license
+	{"GET", "cluster:monitor/xpack/info", []string{"/_xpack"}},
+	{"GET", "cluster:monitor/xpack/usage", []string{"/_xpack/usage"}},
+	{"GET", "cluster:monitor/xpack/license/get", []string{"/_license"}},
+	{"PUT POST", "cluster:admin/xpack/license/put", []string{"/_license"}},
+	{"DELETE", "cluster:admin/xpack/license/delete", []string{"/_license"}},
+	{"GET", "cluster:admin/xpack/license/trial_status", []string{"/_license/trial_status"}},
+	{"POST", "cluster:admin/xpack/license/start_trial", []string{"/_license/start_trial"}},
+	{"GET", "cluster:admin/xpack/license/basic_status", []string{"/_license/basic_status"}},
+	{"POST", "cluster:admin/xpack/license/start_basic", []string{"/_license/start_basic"}},
+	{"GET", "cluster:admin/xpack/deprecation/info", []string{
+		"/_migration/deprecations", "/{index}/_migration/deprecations"}},
+	{"PUT POST", "cluster:admin/xpack/monitoring/bulk", []string{"/_monitoring/bulk"}},
+
+	// sql, eql and graph. the indices of sql queries are named in the query
+	{"GET POST", "indices:data/read/sql", []string{"/_sql"}},
+	{"GET POST", "indices:data/read/sql/translate", []string{"/_sql/translate"}},
+	{"POST", "indices:data/read/sql/close_cursor", []string{"/_sql/close"}},
+	{"GET POST", "indices:data/read/eql", []string{"/{index}/_eql/search"}},
+	{"GET", "indices:data/read/eql/async/get", []string{"/_eql/search/{id}"}},
+	{"DELETE", "cluster:admin/eql/async/delete", []string{"/_eql/search/{id}"}},
+	{"GET POST", "indices:data/read/xpack/graph/explore", []string{"/{index}/_graph/explore"}},
+
+	// machine learning
+	{"GET", "cluster:monitor/xpack/ml/info/get", []string{"/_ml/info"}},
+	{"POST", "cluster:admin/xpack/ml/upgrade_mode", []string{"/_ml/set_upgrade_mode"}},
+	{"PUT", "cluster:admin/xpack/ml/job/put", []string{"/_ml/anomaly_detectors/{job_id}"}},
+	{"GET", "cluster:monitor/xpack/ml/job/get", []string{
+		"/_ml/anomaly_detectors", "/_ml/anomaly_detectors/{job_id}"}},
+	{"GET", "cluster:monitor/xpack/ml/job/stats/get", []string{
+		"/_ml/anomaly_detectors/_stats", "/_ml/anomaly_detectors/{job_id}/_stats"}},
+	{"DELETE", "cluster:admin/xpack/ml/job/delete", []string{"/_ml/anomaly_detectors/{job_id}"}},
+	{"POST", "cluster:admin/xpack/ml/job/open", []string{"/_ml/anomaly_detectors/{job_id}/_open"}},
+	{"POST", "cluster:admin/xpack/ml/job/close", []string{"/_ml/anomaly_detectors/{job_id}/_close"}},
+	{"POST", "cluster:admin/xpack/ml/job/flush", []string{"/_ml/anomaly_detectors/{job_id}/_flush"}},
+	{"POST", "cluster:admin/xpack/ml/job/update", []string{"/_ml/anomaly_detectors/{job_id}/_update"}},
+	{"POST", "cluster:admin/xpack/ml/job/data/post", []string{"/_ml/anomaly_detectors/{job_id}/_data"}},
+	{"POST", "cluster:admin/xpack/ml/job/forecast", []string{"/_ml/anomaly_detectors/{job_id}/_forecast"}},
+	{"POST", "cluster:admin/xpack/ml/job/validate", []string{
+		"/_ml/anomaly_detectors/_validate", "/_ml/anomaly_detectors/_validate/detector"}},
+	{"GET POST", "cluster:monitor/xpack/ml/job/results/buckets/get", []string{
+		"/_ml/anomaly_detectors/{job_id}/results/buckets",
+		"/_ml/anomaly_detectors/{job_id}/results/buckets/{timestamp}"}},
+	{"GET POST", "cluster:monitor/xpack/ml/job/results/records/get", []string{
+		"/_ml/anomaly_detectors/{job_id}/results/records"}},
+	{"GET POST", "cluster:monitor/xpack/ml/job/results/influencers/get", []string{
+		"/_ml/anomaly_detectors/{job_id}/results/influencers"}},
+	{"GET POST", "cluster:monitor/xpack/ml/job/results/categories/get", []string{
+		"/_ml/anomaly_detectors/{job_id}/results/categories",
+		"/_ml/anomaly_detectors/{job_id}/results/categories/{category_id}"}},
+	{"GET POST", "cluster:monitor/xpack/ml/job/results/overall_buckets/get", []string{
+		"/_ml/anomaly_detectors/{job_id}/results/overall_buckets"}},
+	{"GET POST", "cluster:monitor/xpack/ml/job/model_snapshots/get", []string{
+		"/_ml/anomaly_detectors/{job_id}/model_snapshots",
+		"/_ml/anomaly_detectors/{job_id}/model_snapshots/{snapshot_id}"}},
+	{"PUT", "cluster:admin/xpack/ml/datafeeds/put", []string{"/_ml/datafeeds/{datafeed_id}"}},
+	{"GET", "cluster:monitor/xpack/ml/datafeeds/get", []string{"/_ml/datafeeds", "/_ml/datafeeds/{datafeed_id}"}},
+	{"GET", "cluster:monitor/xpack/ml/datafeeds/stats/get", []string{
+		"/_ml/datafeeds/_stats", "/_ml/datafeeds/{datafeed_id}/_stats"}},
+	{"DELETE", "cluster:admin/xpack/ml/datafeeds/delete", []string{"/_ml/datafeeds/{datafeed_id}"}},
+	{"POST", "cluster:admin/xpack/ml/datafeed/start", []string{"/_ml/datafeeds/{datafeed_id}/_start"}},
+	{"POST", "cluster:admin/xpack/ml/datafeed/stop", []string{"/_ml/datafeeds/{datafeed_id}/_stop"}},
+	{"POST", "cluster:admin/xpack/ml/datafeeds/update", []string{"/_ml/datafeeds/{datafeed_id}/_update"}},
+	{"GET POST", "cluster:admin/xpack/ml/datafeeds/preview", []string{"/_ml/datafeeds/{datafeed_id}/_preview"}},
+	{"PUT", "cluster:admin/xpack/ml/data_frame/analytics/put", []string{"/_ml/data_frame/analytics/{id}"}},
+	{"GET", "cluster:monitor/xpack/ml/data_frame/analytics/get", []string{
+		"/_ml/data_frame/analytics", "/_ml/data_frame/analytics/{id}"}},
+	{"GET", "cluster:monitor/xpack/ml/data_frame/analytics/stats/get", []string{
+		"/_ml/data_frame/analytics/_stats", "/_ml/data_frame/analytics/{id}/_stats"}},
+	{"DELETE", "cluster:admin/xpack/ml/data_frame/analytics/delete", []string{"/_ml/data_frame/analytics/{id}"}},
+	{"POST", "cluster:admin/xpack/ml/data_frame/analytics/start", []string{"/_ml/data_frame/analytics/{id}/_start"}},
+	{"POST", "cluster:admin/xpack/ml/data_frame/analytics/stop", []string{"/_ml/data_frame/analytics/{id}/_stop"}},
+	{"POST", "cluster:monitor/xpack/ml/data_frame/evaluate", []string{"/_ml/data_frame/_evaluate"}},
+	{"GET POST", "cluster:admin/xpack/ml/data_frame/analytics/explain", []string{
+		"/_ml/data_frame/analytics/_explain", "/_ml/data_frame/analytics/{id}/_explain"}},
+	{"GET", "cluster:monitor/xpack/ml/inference/get", []string{
+		"/_ml/trained_models", "/_ml/trained_models/{model_id}"}},
+	{"GET", "cluster:monitor/xpack/ml/inference/stats/get", []string{
+		"/_ml/trained_models/_stats", "/_ml/trained_models/{model_id}/_stats"}},
+	{"PUT", "cluster:admin/xpack/ml/inference/put", []string{"/_ml/trained_models/{model_id}"}},
+	{"DELETE", "cluster:admin/xpack/ml/inference/delete", []string{"/_ml/trained_models/{model_id}"}},
+	{"GET", "cluster:admin/xpack/ml/calendars/get", []string{"/_ml/calendars", "/_ml/calendars/{calendar_id}"}},
+	{"PUT", "cluster:admin/xpack/ml/calendars/put", []string{"/_ml/calendars/{calendar_id}"}},
+	{"DELETE", "cluster:admin/xpack/ml/calendars/delete", []string{"/_ml/calendars/{calendar_id}"}},
+	{"GET", "cluster:admin/xpack/ml/filters/get", []string{"/_ml/filters", "/_ml/filters/{filter_id}"}},
+	{"PUT", "cluster:admin/xpack/ml/filters/put", []string{"/_ml/filters/{filter_id}"}},
+	{"DELETE", "cluster:admin/xpack/ml/filters/delete", []string{"/_ml/filters/{filter_id}"}},
+	{"POST", "cluster:monitor/xpack/ml/findfilestructure", []string{"/_ml/find_file_structure"}},
+	{"POST", "cluster:monitor/text_structure/findstructure", []string{"/_text_structure/find_structure"}},
+
+	// watcher
+	{"PUT POST", "cluster:admin/xpack/watcher/watch/put", []string{"/_watcher/watch/{id}"}},
+	{"GET", "cluster:monitor/xpack/watcher/watch/get", []string{"/_watcher/watch/{id}"}},
+	{"DELETE", "cluster:admin/xpack/watcher/watch/delete", []string{"/_watcher/watch/{id}"}},
+	{"PUT POST", "cluster:admin/xpack/watcher/watch/execute", []string{
+		"/_watcher/watch/_execute", "/_watcher/watch/{id}/_execute"}},
+	{"PUT POST", "cluster:admin/xpack/watcher/watch/ack", []string{
+		"/_watcher/watch/{watch_id}/_ack", "/_watcher/watch/{watch_id}/_ack/{action_id}"}},
+	{"PUT POST", "cluster:admin/xpack/watcher/watch/activate", []string{
+		"/_watcher/watch/{watch_id}/_activate", "/_watcher/watch/{watch_id}/_deactivate"}},
+	{"GET", "cluster:monitor/xpack/watcher/stats/dist", []string{"/_watcher/stats", "/_watcher/stats/{metric}"}},
+	{"POST", "cluster:admin/xpack/watcher/service", []string{"/_watcher/_start", "/_watcher/_stop"}},
+	{"GET POST", "cluster:monitor/xpack/watcher/watch/query", []string{"/_watcher/_query/watches"}},
+
+	// rollups
+	{"PUT", "cluster:admin/xpack/rollup/put", []string{"/_rollup/job/{id}"}},
+	{"GET", "cluster:monitor/xpack/rollup/get", []string{"/_rollup/job", "/_rollup/job/{id}"}},
+	{"DELETE", "cluster:admin/xpack/rollup/delete", []string{"/_rollup/job/{id}"}},
+	{"POST", "cluster:admin/xpack/rollup/start", []string{"/_rollup/job/{id}/_start"}},
+	{"POST", "cluster:admin/xpack/rollup/stop", []string{"/_rollup/job/{id}/_stop"}},
+	{"GET", "cluster:monitor/xpack/rollup/get/caps", []string{"/_rollup/data", "/_rollup/data/{index}"}},
+	{"GET", "indices:data/read/xpack/rollup/get/index/caps", []string{"/{index}/_rollup/data"}},
+	{"GET POST", "indices:data/read/xpack/rollup/search", []string{
+		"/{index}/_rollup_search", "/{index}/{type}/_rollup_search"}},
+
+	// cross cluster replication
+	{"PUT", "indices:admin/xpack/ccr/put_follow", []string{"/{index}/_ccr/follow"}},
+	{"POST", "indices:admin/xpack/ccr/pause_follow", []string{"/{index}/_ccr/pause_follow"}},
+	{"POST", "indices:admin/xpack/ccr/resume_follow", []string{"/{index}/_ccr/resume_follow"}},
+	{"POST", "indices:admin/xpack/ccr/unfollow", []string{"/{index}/_ccr/unfollow"}},
+	{"POST", "indices:admin/xpack/ccr/forget_follower", []string{"/{index}/_ccr/forget_follower"}},
+	{"GET", "indices:monitor/xpack/ccr/follow_stats", []string{"/{index}/_ccr/stats"}},
+	{"GET", "indices:monitor/xpack/ccr/follow_info", []string{"/{index}/_ccr/info"}},
+	{"GET", "cluster:monitor/xpack/ccr/stats", []string{"/_ccr/stats"}},
+	{"PUT", "cluster:admin/xpack/ccr/auto_follow_pattern/put", []string{"/_ccr/auto_follow/{name}"}},
+	{"GET", "cluster:admin/xpack/ccr/auto_follow_pattern/get", []string{"/_ccr/auto_follow", "/_ccr/auto_follow/{name}"}},
+	{"DELETE", "cluster:admin/xpack/ccr/auto_follow_pattern/delete", []string{"/_ccr/auto_follow/{name}"}},
+	{"POST", "cluster:admin/xpack/ccr/auto_follow_pattern/activate", []string{
+		"/_ccr/auto_follow/{name}/pause", "/_ccr/auto_follow/{name}/resume"}},
+
+	// transforms
+	{"PUT", "cluster:admin/transform/put", []string{"/_transform/{transform_id}"}},
+	{"GET", "cluster:monitor/transform/get", []string{"/_transform", "/_transform/{transform_id}"}},
+	{"GET", "cluster:monitor/transform/stats/get", []string{"/_transform/{transform_id}/_stats"}},
+	{"DELETE", "cluster:admin/transform/delete", []string{"/_transform/{transform_id}"}},
+	{"POST", "cluster:admin/transform/start", []string{"/_transform/{transform_id}/_start"}},
+	{"POST", "cluster:admin/transform/stop", []string{"/_transform/{transform_id}/_stop"}},
+	{"POST", "cluster:admin/transform/update", []string{"/_transform/{transform_id}/_update"}},
+	{"GET POST", "cluster:admin/transform/preview", []string{"/_transform/_preview"}},
+
+	// enrich and snapshot lifecycle management
+	{"PUT", "cluster:admin/xpack/enrich/put", []string{"/_enrich/policy/{name}"}},
+	{"GET", "cluster:admin/xpack/enrich/get", []string{"/_enrich/policy", "/_enrich/policy/{name}"}},
+	{"DELETE", "cluster:admin/xpack/enrich/delete", []string{"/_enrich/policy/{name}"}},
+	{"PUT POST", "cluster:admin/xpack/enrich/execute", []string{"/_enrich/policy/{name}/_execute"}},
+	{"GET", "cluster:monitor/xpack/enrich/stats", []string{"/_enrich/_stats"}},
+	{"PUT", "cluster:admin/slm/put", []string{"/_slm/policy/{policy_id}"}},
+	{"GET", "cluster:admin/slm/get", []string{"/_slm/policy", "/_slm/policy/{policy_id}"}},
+	{"DELETE", "cluster:admin/slm/delete", []string{"/_slm/policy/{policy_id}"}},
+	{"PUT POST", "cluster:admin/slm/execute", []string{"/_slm/policy/{policy_id}/_execute"}},
+	{"POST", "cluster:admin/slm/execute_retention", []string{"/_slm/_execute_retention"}},
+	{"GET", "cluster:admin/slm/stats", []string{"/_slm/stats"}},
+	{"GET", "cluster:admin/slm/status", []string{"/_slm/status"}},
+	{"POST", "cluster:admin/slm/start", []string{"/_slm/start"}},
+	{"POST", "cluster:admin/slm/stop", []string{"/_slm/stop"}},
+	{"POST", "cluster:admin/snapshot/mount", []string{"/_snapshot/{repository}/{snapshot}/_mount"}},
+
+	// cat
+	{"GET", "cluster:monitor/cat/help", []string{"/_cat"}},
+	{"GET", "cluster:monitor/cat/aliases", []string{"/_cat/aliases", "/_cat/aliases/{name}"}},
+	{"GET", "cluster:monitor/cat/allocation", []string{"/_cat/allocation", "/_cat/allocation/{node_id}"}},
+	{"GET", "cluster:monitor/cat/count", []string{"/_cat/count", "/_cat/count/{index}"}},
+	{"GET", "cluster:monitor/cat/fielddata", []string{"/_cat/fielddata", "/_cat/fielddata/{fields}"}},
+	{"GET", "cluster:monitor/cat/health", []string{"/_cat/health"}},
+	{"GET", "cluster:monitor/cat/indices", []string{"/_cat/indices", "/_cat/indices/{index}"}},
+	{"GET", "cluster:monitor/cat/master", []string{"/_cat/master"}},
+	{"GET", "cluster:monitor/cat/nodeattrs", []string{"/_cat/nodeattrs"}},
+	{"GET", "cluster:monitor/cat/nodes", []string{"/_cat/nodes"}},
+	{"GET", "cluster:monitor/cat/pending_tasks", []string{"/_cat/pending_tasks"}},
+	{"GET", "cluster:monitor/cat/plugins", []string{"/_cat/plugins"}},
+	{"GET", "cluster:monitor/cat/recovery", []string{"/_cat/recovery", "/_cat/recovery/{index}"}},
+	{"GET", "cluster:monitor/cat/repositories", []string{"/_cat/repositories"}},
+	{"GET", "cluster:monitor/cat/segments", []string{"/_cat/segments", "/_cat/segments/{index}"}},
+	{"GET", "cluster:monitor/cat/shards", []string{"/_cat/shards", "/_cat/shards/{index}"}},
+	{"GET", "cluster:monitor/cat/snapshots", []string{"/_cat/snapshots", "/_cat/snapshots/{repository}"}},
+	{"GET", "cluster:monitor/cat/tasks", []string{"/_cat/tasks"}},
+	{"GET", "cluster:monitor/cat/templates", []string{"/_cat/templates", "/_cat/templates/{name}"}},
+	{"GET", "cluster:monitor/cat/thread_pool", []string{
+		"/_cat/thread_pool", "/_cat/thread_pool/{thread_pool_patterns}"}},
+}
+
+// route is a single compiled method + path template
+type route struct {
+	methods  []string
+	action   string
+	path     string
+	segments []string
+	// the first literal `_` prefixed segment, used for `whitelisted_apis`
+	api string
+}
+
+var routes = compileRoutes(routeSpecs)
+
+func compileRoutes(specs []routeSpec) []*route {
+	var compiled []*route
+	for _, spec := range specs {
+		for _, p := range spec.paths {
+			rt := &route{
+				methods:  strings.Fields(spec.methods),
+				action:   spec.action,
+				path:     p,
+				segments: splitPath(p),
+			}
+			for _, seg := range rt.segments {
+				if !isParam(seg) && strings.HasPrefix(seg, "_") {
+					rt.api = seg
+					break
+				}
+			}
+			compiled = append(compiled, rt)
+		}
+	}
+	return compiled
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func isParam(seg string) bool {
+	return strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}")
+}
+
+// match returns the parameters of the path if it fits the route template
+func (rt *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rt.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, seg := range rt.segments {
+		if isParam(seg) {
+			name := strings.Trim(seg, "{}")
+			if !validParam(name, segments[i]) {
+				return nil, false
+			}
+			params[name] = segments[i]
+		} else if seg != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// index and type names can't start with `_` in elasticsearch, so those
+// segments are API names and must not be mistaken for parameters
+func validParam(name, value string) bool {
+	if value == "" {
+		return false
+	}
+	if indexParams[name] {
+		return value == "_all" || !strings.HasPrefix(value, "_")
+	}
+	if name == "type" {
+		return !strings.HasPrefix(value, "_")
+	}
+	return true
+}
+
+// moreSpecific reports whether rt should win over other when both match.
+// like elasticsearch's path trie, a literal segment beats a parameter at
+// the first position where the templates differ
+func (rt *route) moreSpecific(other *route) bool {
+	for i := range rt.segments {
+		a, b := isParam(rt.segments[i]), isParam(other.segments[i])
+		if a != b {
+			return !a
+		}
+	}
+	return false
+}
+
+// esRequest is what an HTTP request means to elasticsearch, as
+// resolved through the route table
+type esRequest struct {
+	route   *route
+	action  string
+	api     string
+	params  map[string]string
+	indices []string
+}
+
+// parseRoute resolves the request against the route table. Requests
+// that don't match any route are returned as nil
+func parseRoute(r *http.Request) *esRequest {
+	segments, err := pathSegments(r.URL)
+	if err != nil {
+		return nil
+	}
+
+	// an empty method means GET for net/http
+	method := r.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	var best *route
+	var bestParams map[string]string
+	for _, rt := range routes {
+		if !stringInSlice(method, rt.methods) {
+			continue
+		}
+		params, ok := rt.match(segments)
+		if !ok {
+			continue
+		}
+		if best == nil || rt.moreSpecific(best) {
+			best = rt
+			bestParams = params
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	es := esRequest{
+		route:  best,
+		action: best.action,
+		api:    best.api,
+		params: bestParams,
+	}
+	for _, seg := range best.segments {
+		name := strings.Trim(seg, "{}")
+		if isParam(seg) && indexParams[name] {
+			es.indices = append(es.indices, strings.Split(bestParams[name], ",")...)
+		}
+	}
+
+	return &es
+}
+
+// pathSegments splits the escaped path before decoding each segment, so
+// an encoded `/` (as found in date math index names) stays in its segment
+func pathSegments(u *url.URL) ([]string, error) {
+	segments := splitPath(u.EscapedPath())
+	for i, seg := range segments {
+		decoded, err := url.PathUnescape(seg)
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = decoded
+	}
+	return segments, nil
+}
+
+// scopedActions return documents or index metadata of every index when
+// they are sent without indices, so they get scoped to permitted indices.
+// other APIs without indices, like `_analyze` or `_refresh`, are left alone
+var scopedActions = map[string]bool{
+	"indices:data/read/search":              true,
+	"indices:data/read/search/template":     true,
+	"indices:data/read/field_caps":          true,
+	"indices:data/read/field_stats":         true,
+	"indices:data/read/rank_eval":           true,
+	"indices:data/read/async_search/submit": true,
+	"indices:admin/validate/query":          true,
+	"indices:admin/shards/search_shards":    true,
+	"indices:admin/aliases/get":             true,
+	"indices:admin/mappings/get":            true,
+	"indices:admin/mappings/fields/get":     true,
+	"indices:monitor/settings/get":          true,
+	"indices:monitor/stats":                 true,
+}
+
+// indexedVariant returns the route of the same API scoped to indices, like
+// `/{index}/_search` for `/_search`. requests without indices operate on
+// all of them, so this is where they go to be scoped to permitted indices
+func (rt *route) indexedVariant(method string) *route {
+	if !scopedActions[rt.action] {
+		return nil
+	}
+	for _, seg := range rt.segments {
+		if isParam(seg) && indexParams[strings.Trim(seg, "{}")] {
+			return nil
+		}
+	}
+	for _, other := range routes {
+		if other.path == "/{index}"+rt.path && other.action == rt.action &&
+			stringInSlice(method, other.methods) {
+			return other
+		}
+	}
+	return nil
+}
+
+// buildPath fills in the route template, escaping each parameter value
+func (rt *route) buildPath(params map[string]string) string {
+	var segments []string
+	for _, seg := range rt.segments {
+		if !isParam(seg) {
+			segments = append(segments, seg)
+			continue
+		}
+		var values []string
+		for _, value := range strings.Split(params[strings.Trim(seg, "{}")], ",") {
+			values = append(values, url.PathEscape(value))
+		}
+		segments = append(segments, strings.Join(values, ","))
+	}
+	return "/" + strings.Join(segments, "/")
+}
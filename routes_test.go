@@ -0,0 +1,352 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fill in a route template with sample values, using two indices for
+// every index parameter
+func samplePath(rt *route) (string, []string) {
+	var segments, indices []string
+	for _, seg := range rt.segments {
+		name := strings.Trim(seg, "{}")
+		switch {
+		case !isParam(seg):
+			segments = append(segments, seg)
+		case indexParams[name]:
+			segments = append(segments, name+"-a,"+name+"-b")
+			indices = append(indices, name+"-a", name+"-b")
+		default:
+			segments = append(segments, "sample-"+name)
+		}
+	}
+	return "/" + strings.Join(segments, "/"), indices
+}
+
+// restSpecPaths are endpoints of the elasticsearch 7.x REST spec, with the
+// parameter names of the spec, transcribed apart from the route table so
+// routes missing from it are caught
+var restSpecPaths = []string{
+	"GET /",
+	"PUT /{index}/_doc/{id}", "POST /{index}/_doc", "PUT /{index}/_create/{id}",
+	"GET /{index}/_doc/{id}", "HEAD /{index}/_doc/{id}", "GET /{index}/_source/{id}",
+	"DELETE /{index}/_doc/{id}", "POST /{index}/_update/{id}",
+	"POST /_bulk", "PUT /{index}/_bulk", "GET /_mget", "POST /{index}/_mget",
+	"POST /{index}/_delete_by_query", "POST /{index}/_update_by_query", "POST /_reindex",
+	"POST /_reindex/{task_id}/_rethrottle", "POST /_update_by_query/{task_id}/_rethrottle",
+	"GET /{index}/_termvectors/{id}", "POST /_mtermvectors",
+	"GET /_search", "POST /{index}/_search", "GET /_count", "POST /{index}/_count",
+	"POST /_msearch", "POST /{index}/_msearch", "GET /_search/template", "POST /{index}/_msearch/template",
+	"POST /_render/template/{id}", "POST /_search/scroll/{scroll_id}", "DELETE /_search/scroll",
+	"GET /{index}/_explain/{id}", "GET /_field_caps", "POST /{index}/_field_caps",
+	"GET /{index}/_validate/query", "GET /{index}/_search_shards", "POST /{index}/_rank_eval",
+	"POST /{index}/_pit", "DELETE /_pit", "POST /{index}/_async_search", "GET /_async_search/{id}",
+	"DELETE /_async_search/{id}", "GET /_async_search/status/{id}",
+	"PUT /_scripts/{id}", "GET /_scripts/{id}", "DELETE /_scripts/{id}", "POST /_scripts/painless/_execute",
+	"GET /_script_context", "GET /_script_language",
+	"PUT /{index}", "DELETE /{index}", "GET /{index}", "HEAD /{index}",
+	"POST /{index}/_open", "POST /{index}/_close", "POST /{index}/_freeze", "POST /{index}/_unfreeze",
+	"PUT /{index}/_shrink/{target}", "POST /{index}/_split/{target}", "PUT /{index}/_clone/{target}",
+	"POST /{alias}/_rollover", "POST /{alias}/_rollover/{new_index}",
+	"POST /_refresh", "POST /{index}/_flush", "POST /{index}/_forcemerge", "POST /{index}/_cache/clear",
+	"GET /_analyze", "POST /{index}/_analyze", "GET /_resolve/index/{name}",
+	"PUT /_data_stream/{name}", "DELETE /_data_stream/{name}", "GET /_data_stream",
+	"POST /_aliases", "PUT /{index}/_alias/{name}", "DELETE /{index}/_alias/{name}",
+	"GET /_alias", "GET /{index}/_alias/{name}", "HEAD /_alias/{name}",
+	"GET /_mapping", "GET /{index}/_mapping", "PUT /{index}/_mapping", "GET /{index}/_mapping/field/{fields}",
+	"GET /_settings", "GET /{index}/_settings/{name}", "PUT /{index}/_settings",
+	"GET /_template/{name}", "PUT /_template/{name}", "DELETE /_template/{name}",
+	"GET /_index_template/{name}", "PUT /_index_template/{name}", "POST /_index_template/_simulate_index/{name}",
+	"GET /_component_template/{name}", "PUT /_component_template/{name}",
+	"GET /_stats", "GET /{index}/_stats/{metric}", "GET /{index}/_segments", "GET /{index}/_recovery",
+	"GET /{index}/_shard_stores",
+	"PUT /_ilm/policy/{policy}", "GET /_ilm/policy", "DELETE /_ilm/policy/{policy}", "GET /{index}/_ilm/explain",
+	"POST /{index}/_ilm/remove", "POST /{index}/_ilm/retry", "POST /_ilm/move/{index}", "GET /_ilm/status",
+	"POST /_ilm/start", "POST /_ilm/stop",
+	"GET /_cluster/health/{index}", "GET /_cluster/state/{metric}/{index}", "GET /_cluster/stats",
+	"GET /_cluster/settings", "PUT /_cluster/settings", "POST /_cluster/reroute",
+	"GET /_cluster/allocation/explain", "GET /_cluster/pending_tasks", "GET /_remote/info",
+	"POST /_cluster/voting_config_exclusions", "DELETE /_cluster/voting_config_exclusions",
+	"GET /_nodes/{node_id}/{metric}", "GET /_nodes/{node_id}/stats/{metric}/{index_metric}",
+	"GET /_nodes/hot_threads", "GET /_nodes/{node_id}/usage", "POST /_nodes/reload_secure_settings",
+	"GET /_tasks", "GET /_tasks/{task_id}", "POST /_tasks/_cancel", "POST /_tasks/{task_id}/_cancel",
+	"PUT /_snapshot/{repository}", "GET /_snapshot", "DELETE /_snapshot/{repository}",
+	"POST /_snapshot/{repository}/_verify", "POST /_snapshot/{repository}/_cleanup",
+	"PUT /_snapshot/{repository}/{snapshot}", "GET /_snapshot/{repository}/{snapshot}",
+	"DELETE /_snapshot/{repository}/{snapshot}", "POST /_snapshot/{repository}/{snapshot}/_restore",
+	"PUT /_snapshot/{repository}/{snapshot}/_clone/{target_snapshot}", "GET /_snapshot/_status",
+	"PUT /_ingest/pipeline/{id}", "GET /_ingest/pipeline", "DELETE /_ingest/pipeline/{id}",
+	"POST /_ingest/pipeline/{id}/_simulate", "GET /_ingest/processor/grok",
+	"GET /_cat", "GET /_cat/aliases/{name}", "GET /_cat/allocation/{node_id}", "GET /_cat/count/{index}",
+	"GET /_cat/fielddata/{fields}", "GET /_cat/health", "GET /_cat/indices/{index}", "GET /_cat/master",
+	"GET /_cat/nodeattrs", "GET /_cat/nodes", "GET /_cat/pending_tasks", "GET /_cat/plugins",
+	"GET /_cat/recovery/{index}", "GET /_cat/repositories", "GET /_cat/segments/{index}",
+	"GET /_cat/shards/{index}", "GET /_cat/snapshots/{repository}", "GET /_cat/tasks",
+	"GET /_cat/templates/{name}", "GET /_cat/thread_pool/{thread_pool_patterns}",
+
+	// x-pack
+	"GET /_security/_authenticate", "PUT /_security/user/{username}", "GET /_security/user",
+	"DELETE /_security/user/{username}", "POST /_security/user/{username}/_password",
+	"PUT /_security/user/_password", "PUT /_security/user/{username}/_enable",
+	"PUT /_security/user/{username}/_disable", "GET /_security/user/_has_privileges",
+	"POST /_security/user/{user}/_has_privileges", "GET /_security/user/_privileges",
+	"PUT /_security/role/{name}", "GET /_security/role/{name}", "DELETE /_security/role/{name}",
+	"POST /_security/role/{name}/_clear_cache", "PUT /_security/role_mapping/{name}",
+	"GET /_security/role_mapping", "DELETE /_security/role_mapping/{name}",
+	"PUT /_security/privilege", "GET /_security/privilege/{application}/{name}",
+	"DELETE /_security/privilege/{application}/{name}", "GET /_security/privilege/_builtin",
+	"POST /_security/privilege/{application}/_clear_cache", "POST /_security/realm/{realms}/_clear_cache",
+	"PUT /_security/api_key", "GET /_security/api_key", "DELETE /_security/api_key",
+	"POST /_security/api_key/grant", "POST /_security/api_key/{ids}/_clear_cache",
+	"POST /_security/oauth2/token", "DELETE /_security/oauth2/token",
+	"POST /_security/saml/prepare", "POST /_security/saml/authenticate", "POST /_security/saml/logout",
+	"POST /_security/saml/invalidate", "POST /_security/saml/complete_logout",
+	"GET /_security/saml/metadata/{realm_name}", "POST /_security/oidc/prepare",
+	"POST /_security/oidc/authenticate", "POST /_security/oidc/logout", "POST /_security/delegate_pki",
+	"GET /_ssl/certificates", "GET /_security/service/{namespace}/{service}",
+	"POST /_security/service/{namespace}/{service}/credential/token/{name}",
+	"DELETE /_security/service/{namespace}/{service}/credential/token/{name}",
+	"GET /_security/service/{namespace}/{service}/_credentials",
+	"GET /_xpack", "GET /_xpack/usage", "GET /_license", "PUT /_license", "DELETE /_license",
+	"GET /_license/trial_status", "POST /_license/start_trial", "GET /_license/basic_status",
+	"POST /_license/start_basic", "GET /_migration/deprecations", "GET /{index}/_migration/deprecations",
+	"POST /_monitoring/bulk",
+	"POST /_sql", "POST /_sql/translate", "POST /_sql/close", "POST /{index}/_eql/search",
+	"GET /_eql/search/{id}", "DELETE /_eql/search/{id}", "POST /{index}/_graph/explore",
+	"GET /_ml/info", "POST /_ml/set_upgrade_mode", "PUT /_ml/anomaly_detectors/{job_id}",
+	"GET /_ml/anomaly_detectors", "GET /_ml/anomaly_detectors/{job_id}/_stats",
+	"GET /_ml/anomaly_detectors/_stats", "DELETE /_ml/anomaly_detectors/{job_id}",
+	"POST /_ml/anomaly_detectors/{job_id}/_open", "POST /_ml/anomaly_detectors/{job_id}/_close",
+	"POST /_ml/anomaly_detectors/{job_id}/_flush", "POST /_ml/anomaly_detectors/{job_id}/_update",
+	"POST /_ml/anomaly_detectors/{job_id}/_data", "POST /_ml/anomaly_detectors/{job_id}/_forecast",
+	"POST /_ml/anomaly_detectors/_validate", "POST /_ml/anomaly_detectors/_validate/detector",
+	"GET /_ml/anomaly_detectors/{job_id}/results/buckets/{timestamp}",
+	"POST /_ml/anomaly_detectors/{job_id}/results/records",
+	"GET /_ml/anomaly_detectors/{job_id}/results/influencers",
+	"GET /_ml/anomaly_detectors/{job_id}/results/categories/{category_id}",
+	"GET /_ml/anomaly_detectors/{job_id}/results/overall_buckets",
+	"GET /_ml/anomaly_detectors/{job_id}/model_snapshots/{snapshot_id}",
+	"PUT /_ml/datafeeds/{datafeed_id}", "GET /_ml/datafeeds", "GET /_ml/datafeeds/{datafeed_id}/_stats",
+	"DELETE /_ml/datafeeds/{datafeed_id}", "POST /_ml/datafeeds/{datafeed_id}/_start",
+	"POST /_ml/datafeeds/{datafeed_id}/_stop", "POST /_ml/datafeeds/{datafeed_id}/_update",
+	"GET /_ml/datafeeds/{datafeed_id}/_preview",
+	"PUT /_ml/data_frame/analytics/{id}", "GET /_ml/data_frame/analytics", "GET /_ml/data_frame/analytics/_stats",
+	"DELETE /_ml/data_frame/analytics/{id}", "POST /_ml/data_frame/analytics/{id}/_start",
+	"POST /_ml/data_frame/analytics/{id}/_stop", "POST /_ml/data_frame/_evaluate",
+	"POST /_ml/data_frame/analytics/_explain", "GET /_ml/trained_models/{model_id}",
+	"GET /_ml/trained_models/_stats", "PUT /_ml/trained_models/{model_id}",
+	"DELETE /_ml/trained_models/{model_id}", "GET /_ml/calendars", "PUT /_ml/calendars/{calendar_id}",
+	"GET /_ml/filters/{filter_id}", "PUT /_ml/filters/{filter_id}", "POST /_ml/find_file_structure",
+	"POST /_text_structure/find_structure",
+	"PUT /_watcher/watch/{id}", "GET /_watcher/watch/{id}", "DELETE /_watcher/watch/{id}",
+	"POST /_watcher/watch/_execute", "PUT /_watcher/watch/{id}/_execute",
+	"PUT /_watcher/watch/{watch_id}/_ack/{action_id}", "PUT /_watcher/watch/{watch_id}/_activate",
+	"PUT /_watcher/watch/{watch_id}/_deactivate", "GET /_watcher/stats/{metric}",
+	"POST /_watcher/_start", "POST /_watcher/_stop", "GET /_watcher/_query/watches",
+	"PUT /_rollup/job/{id}", "GET /_rollup/job", "DELETE /_rollup/job/{id}", "POST /_rollup/job/{id}/_start",
+	"POST /_rollup/job/{id}/_stop", "GET /_rollup/data/{id}", "GET /{index}/_rollup/data",
+	"POST /{index}/_rollup_search",
+	"PUT /{index}/_ccr/follow", "POST /{index}/_ccr/pause_follow", "POST /{index}/_ccr/resume_follow",
+	"POST /{index}/_ccr/unfollow", "POST /{index}/_ccr/forget_follower", "GET /{index}/_ccr/stats",
+	"GET /{index}/_ccr/info", "GET /_ccr/stats", "PUT /_ccr/auto_follow/{name}", "GET /_ccr/auto_follow",
+	"DELETE /_ccr/auto_follow/{name}", "POST /_ccr/auto_follow/{name}/pause",
+	"POST /_ccr/auto_follow/{name}/resume",
+	"PUT /_transform/{transform_id}", "GET /_transform", "GET /_transform/{transform_id}/_stats",
+	"DELETE /_transform/{transform_id}", "POST /_transform/{transform_id}/_start",
+	"POST /_transform/{transform_id}/_stop", "POST /_transform/{transform_id}/_update",
+	"POST /_transform/_preview",
+	"PUT /_enrich/policy/{name}", "GET /_enrich/policy", "DELETE /_enrich/policy/{name}",
+	"PUT /_enrich/policy/{name}/_execute", "GET /_enrich/_stats",
+	"PUT /_slm/policy/{policy_id}", "GET /_slm/policy", "DELETE /_slm/policy/{policy_id}",
+	"PUT /_slm/policy/{policy_id}/_execute", "POST /_slm/_execute_retention", "GET /_slm/stats",
+	"GET /_slm/status", "POST /_slm/start", "POST /_slm/stop",
+	"POST /_snapshot/{repository}/{snapshot}/_mount",
+}
+
+// every endpoint of the REST spec must have a route
+func TestRestSpecRoutes(t *testing.T) {
+	for _, endpoint := range restSpecPaths {
+		fields := strings.Fields(endpoint)
+		method, template := fields[0], fields[1]
+		var segments []string
+		for _, seg := range splitPath(template) {
+			if isParam(seg) {
+				seg = "sample-" + strings.Trim(seg, "{}")
+			}
+			segments = append(segments, seg)
+		}
+		path := "/" + strings.Join(segments, "/")
+
+		req, _ := http.NewRequest(method, "http://localhost:9200"+path, nil)
+		if parseRoute(req) == nil {
+			t.Errorf("%s: no route for %s %s", endpoint, method, path)
+		}
+	}
+}
+
+// every route in the table must be reachable, and not shadowed by
+// another route
+func TestRouteTable(t *testing.T) {
+	for _, rt := range routes {
+		path, indices := samplePath(rt)
+		for _, method := range rt.methods {
+			req, _ := http.NewRequest(method, "http://localhost:9200"+path, nil)
+			es := parseRoute(req)
+			if es == nil {
+				t.Errorf("%s %s: no route, expected %s", method, path, rt.path)
+				continue
+			}
+			if es.route != rt {
+				t.Errorf("%s %s: got route %s (%s), expected %s (%s)",
+					method, path, es.route.path, es.action, rt.path, rt.action)
+			}
+			if diff := cmp.Diff(indices, es.indices); diff != "" {
+				t.Errorf("%s %s: unexpected indices: (-want +got)\n%s", method, path, diff)
+			}
+		}
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	cases := []struct {
+		method  string
+		path    string
+		action  string
+		api     string
+		indices []string
+	}{
+		{"GET", "/", "cluster:monitor/main", "", nil},
+		{"HEAD", "/", "cluster:monitor/main", "", nil},
+		{"GET", "/_search", "indices:data/read/search", "_search", nil},
+		{"POST", "/test1,test2/_search?q=tag:wow", "indices:data/read/search", "_search", []string{"test1", "test2"}},
+		{"GET", "/_all/_search", "indices:data/read/search", "_search", []string{"_all"}},
+		{"GET", "/*/_search", "indices:data/read/search", "_search", []string{"*"}},
+		{"GET", "/logs-*/doc/_search", "indices:data/read/search", "_search", []string{"logs-*"}},
+		{"GET", "/idx/_count", "indices:data/read/search", "_count", []string{"idx"}},
+		{"POST", "/_msearch", "indices:data/read/msearch", "_msearch", nil},
+		{"POST", "/idx/_msearch", "indices:data/read/msearch", "_msearch", []string{"idx"}},
+		{"GET", "/_search/scroll", "indices:data/read/scroll", "_search", nil},
+		{"POST", "/_search/scroll/c2Nhbg==", "indices:data/read/scroll", "_search", nil},
+		{"DELETE", "/_search/scroll", "indices:data/read/scroll/clear", "_search", nil},
+		{"GET", "/_search/template", "indices:data/read/search/template", "_search", nil},
+
+		// the paths extractAPI and extractURIindices got wrong
+		{"GET", "/_cat/indices/secret*", "cluster:monitor/cat/indices", "_cat", []string{"secret*"}},
+		{"GET", "/_cat/indices", "cluster:monitor/cat/indices", "_cat", nil},
+		{"GET", "/_cat/aliases/secret", "cluster:monitor/cat/aliases", "_cat", nil},
+		{"GET", "/_cat/shards/secret", "cluster:monitor/cat/shards", "_cat", []string{"secret"}},
+		{"GET", "/_cluster/health/secret", "cluster:monitor/health", "_cluster", []string{"secret"}},
+		{"GET", "/_cluster/state/metadata/secret,other", "cluster:monitor/state", "_cluster", []string{"secret", "other"}},
+		{"GET", "/idx/_doc/_search", "indices:data/read/get", "_doc", []string{"idx"}},
+		{"PUT", "/idx/_doc/_search", "indices:data/write/index", "_doc", []string{"idx"}},
+		{"DELETE", "/idx/_doc/_bulk", "indices:data/write/delete", "_doc", []string{"idx"}},
+
+		// documents
+		{"GET", "/idx/doc/1", "indices:data/read/get", "", []string{"idx"}},
+		{"HEAD", "/idx/_doc/1", "indices:data/read/get", "_doc", []string{"idx"}},
+		{"GET", "/idx/_source/1", "indices:data/read/get", "_source", []string{"idx"}},
+		{"POST", "/idx/_doc", "indices:data/write/index", "_doc", []string{"idx"}},
+		{"POST", "/idx/doc", "indices:data/write/index", "", []string{"idx"}},
+		{"PUT", "/idx/_create/1", "indices:data/write/index", "_create", []string{"idx"}},
+		{"POST", "/idx/doc/1/_update", "indices:data/write/update", "_update", []string{"idx"}},
+		{"POST", "/idx/_update/1", "indices:data/write/update", "_update", []string{"idx"}},
+		{"POST", "/_bulk", "indices:data/write/bulk", "_bulk", nil},
+		{"POST", "/idx/_bulk", "indices:data/write/bulk", "_bulk", []string{"idx"}},
+		{"POST", "/_mget", "indices:data/read/mget", "_mget", nil},
+		{"POST", "/idx/_delete_by_query", "indices:data/write/delete/byquery", "_delete_by_query", []string{"idx"}},
+		{"POST", "/_reindex", "indices:data/write/reindex", "_reindex", nil},
+
+		// indices
+		{"PUT", "/idx", "indices:admin/create", "", []string{"idx"}},
+		{"DELETE", "/idx", "indices:admin/delete", "", []string{"idx"}},
+		{"GET", "/idx", "indices:admin/get", "", []string{"idx"}},
+		{"HEAD", "/idx", "indices:admin/exists", "", []string{"idx"}},
+		{"GET", "/idx/_mapping", "indices:admin/mappings/get", "_mapping", []string{"idx"}},
+		{"GET", "/_mapping/doc", "indices:admin/mappings/get", "_mapping", nil},
+		{"GET", "/idx/_mapping/field/message", "indices:admin/mappings/fields/get", "_mapping", []string{"idx"}},
+		{"PUT", "/idx/_mapping/doc", "indices:admin/mapping/put", "_mapping", []string{"idx"}},
+		{"GET", "/idx/_settings", "indices:monitor/settings/get", "_settings", []string{"idx"}},
+		{"PUT", "/_settings", "indices:admin/settings/update", "_settings", nil},
+		{"POST", "/idx/_shrink/small", "indices:admin/resize", "_shrink", []string{"idx", "small"}},
+		{"POST", "/logs/_rollover/logs-2", "indices:admin/rollover", "_rollover", []string{"logs", "logs-2"}},
+		{"GET", "/_alias/logs", "indices:admin/aliases/get", "_alias", nil},
+		{"PUT", "/idx/_alias/logs", "indices:admin/aliases", "_alias", []string{"idx"}},
+		{"GET", "/_template/kibana_index_template", "indices:admin/template/get", "_template", nil},
+		{"PUT", "/_template/kibana_index_template", "indices:admin/template/put", "_template", nil},
+		{"GET", "/_stats/docs", "indices:monitor/stats", "_stats", nil},
+		{"GET", "/idx/_stats/docs", "indices:monitor/stats", "_stats", []string{"idx"}},
+
+		// x-pack
+		{"GET", "/_security/_authenticate", "cluster:admin/xpack/security/user/authenticate", "_security", nil},
+		{"GET", "/_security/user/_privileges", "cluster:admin/xpack/security/user/list_privileges", "_security", nil},
+		{"GET", "/_security/user/admin", "cluster:admin/xpack/security/user/get", "_security", nil},
+		{"GET", "/_ml/anomaly_detectors/_stats", "cluster:monitor/xpack/ml/job/stats/get", "_ml", nil},
+		{"POST", "/_sql", "indices:data/read/sql", "_sql", nil},
+		{"POST", "/logs-*/_eql/search", "indices:data/read/eql", "_eql", []string{"logs-*"}},
+		{"POST", "/rollups/_rollup_search", "indices:data/read/xpack/rollup/search", "_rollup_search", []string{"rollups"}},
+		{"PUT", "/follower/_ccr/follow", "indices:admin/xpack/ccr/put_follow", "_ccr", []string{"follower"}},
+
+		// cluster
+		{"GET", "/_nodes/local", "cluster:monitor/nodes/info", "_nodes", nil},
+		{"GET", "/_nodes/stats", "cluster:monitor/nodes/stats", "_nodes", nil},
+		{"GET", "/_nodes/_local/stats/indices", "cluster:monitor/nodes/stats", "_nodes", nil},
+		{"GET", "/_nodes/stats/indices/search", "cluster:monitor/nodes/stats", "_nodes", nil},
+		{"PUT", "/_cluster/settings", "cluster:admin/settings/update", "_cluster", nil},
+		{"GET", "/_tasks", "cluster:monitor/tasks/lists", "_tasks", nil},
+		{"POST", "/_tasks/_cancel", "cluster:admin/tasks/cancel", "_tasks", nil},
+		{"POST", "/_tasks/node:1/_cancel", "cluster:admin/tasks/cancel", "_tasks", nil},
+		{"GET", "/_snapshot/_status", "cluster:admin/snapshot/status", "_snapshot", nil},
+		{"GET", "/_snapshot/repo/_status", "cluster:admin/snapshot/status", "_snapshot", nil},
+		{"GET", "/_snapshot/repo/snap", "cluster:admin/snapshot/get", "_snapshot", nil},
+		{"POST", "/_snapshot/repo/_verify", "cluster:admin/repository/verify", "_snapshot", nil},
+		{"GET", "/_ingest/pipeline/_simulate", "cluster:admin/ingest/pipeline/simulate", "_ingest", nil},
+		{"POST", "/_ilm/move/idx", "cluster:admin/ilm/_move/post", "_ilm", []string{"idx"}},
+		{"GET", "/idx/_ilm/explain", "indices:admin/ilm/explain", "_ilm", []string{"idx"}},
+
+		// encoded date math stays in one segment
+		{"GET", "/%3Clogs-%7Bnow%2Fd%7D%3E/_search", "indices:data/read/search", "_search", []string{"<logs-{now/d}>"}},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, "http://localhost:9200"+c.path, nil)
+		es := parseRoute(req)
+		if es == nil {
+			t.Errorf("%s %s: no route", c.method, c.path)
+			continue
+		}
+		if es.action != c.action {
+			t.Errorf("%s %s: got action %s, expected %s", c.method, c.path, es.action, c.action)
+		}
+		if es.api != c.api {
+			t.Errorf("%s %s: got API %s, expected %s", c.method, c.path, es.api, c.api)
+		}
+		if diff := cmp.Diff(c.indices, es.indices); diff != "" {
+			t.Errorf("%s %s: unexpected indices: (-want +got)\n%s", c.method, c.path, diff)
+		}
+	}
+}
+
+func TestParseRouteUnknown(t *testing.T) {
+	cases := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/some_index/local"},
+		{"DELETE", "/_search"},
+		{"POST", "/idx/_bogus"},
+		{"PATCH", "/_security/user/admin"},
+		{"GET", "/_security/bogus"},
+		{"PATCH", "/idx/_doc/1"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, "http://localhost:9200"+c.path, nil)
+		if es := parseRoute(req); es != nil {
+			t.Errorf("%s %s: expected no route, got %s (%s)", c.method, c.path, es.route.path, es.action)
+		}
+	}
+}
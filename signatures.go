@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readHeaderSecret reads the secret shared with the SSO proxy
+func readHeaderSecret(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("header_signature: secret_file is required")
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("header_signature: %v", err)
+	}
+	secret := bytes.TrimSpace(raw)
+	if len(secret) < minHMACSecret {
+		return nil, fmt.Errorf("header_signature: secret_file %s needs a secret of at least %d bytes", path, minHMACSecret)
+	}
+	return secret, nil
+}
+
+// signIdentity returns the hex HMAC-SHA256 the SSO proxy signs the identity
+// headers of a request with. it covers the user and group headers as they
+// are sent, the timestamp header, the method, the request URI with its query
+// string and the hex SHA-256 of the body, one per line
+func signIdentity(secret []byte, user string, groups string, timestamp string, method string, uri string, body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{user, groups, timestamp, method, uri, hex.EncodeToString(digest[:])}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signatureHeaders returns the names of the signature and timestamp headers
+func (C *Config) signatureHeaders() (string, string) {
+	signatureHeader := C.Authentication.HeaderSignature.SignatureHeader
+	if signatureHeader == "" {
+		signatureHeader = "X-Remote-Signature"
+	}
+	timestampHeader := C.Authentication.HeaderSignature.TimestampHeader
+	if timestampHeader == "" {
+		timestampHeader = "X-Remote-Timestamp"
+	}
+	return signatureHeader, timestampHeader
+}
+
+// headerValue returns the first value of the header, the one that is used
+func headerValue(r *http.Request, name string) (string, bool) {
+	if values, ok := r.Header[name]; ok && len(values) > 0 {
+		return values[0], true
+	}
+	return "", false
+}
+
+// checkSignature rejects identity headers that aren't signed, were changed
+// after they were signed, or were signed too long ago. requests without
+// identity headers are anonymous, and need no signature
+func (a *headerAuthenticator) checkSignature(r *http.Request) error {
+	signatureHeader, timestampHeader := a.C.signatureHeaders()
+	maxAge := time.Duration(a.C.Authentication.HeaderSignature.MaxAge) * time.Second
+	if maxAge <= 0 {
+		maxAge = time.Minute
+	}
+
+	user, hasUser := headerValue(r, a.C.UserHeaderName)
+	groups, hasGroups := headerValue(r, a.C.GroupHeaderName)
+	signature, signed := headerValue(r, signatureHeader)
+	if !signed {
+		if hasUser || hasGroups {
+			return &authError{reason: "identity headers are not signed"}
+		}
+		return nil
+	}
+
+	timestamp, _ := headerValue(r, timestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return &authError{reason: "identity headers have no valid " + timestampHeader}
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = getBody(r)
+		if err != nil {
+			return &authError{reason: "could not read the request body: " + err.Error()}
+		}
+	}
+	expected := signIdentity(a.secret, user, groups, timestamp, r.Method, r.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(expected)) {
+		return &authError{reason: "identity header signature is invalid"}
+	}
+
+	// stale signatures could be replayed, and so could ones from the future
+	age := time.Since(time.Unix(seconds, 0))
+	if age > maxAge || age < -maxAge {
+		return &authError{reason: "identity header signature is stale"}
+	}
+	return nil
+}
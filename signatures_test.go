@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// withHeaderSignature requires the identity headers to be signed
+func withHeaderSignature(t *testing.T) testOption {
+	return func(f *testFixture) {
+		f.C.Authentication.HeaderSignature.Enabled = true
+		f.C.Authentication.HeaderSignature.SecretFile = writeTestFile(t, "secret", []byte(testHMACSecret+"\n"))
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	a, err := newHeaderAuthenticator(getTestConfig(withHeaderSignature(t)))
+	if err != nil {
+		t.Fatal("could not get authenticator: ", err)
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	sign := func(user, groups, timestamp, method, uri string) string {
+		return signIdentity([]byte(testHMACSecret), user, groups, timestamp, method, uri, nil)
+	}
+
+	cases := []struct {
+		name      string
+		method    string
+		path      string
+		user      string
+		groups    string
+		timestamp string
+		signature string
+		err       string
+	}{
+		{"signed", "GET", "/test_deflek/_search", "alice", "CN=group2", now,
+			sign("alice", "CN=group2", now, "GET", "/test_deflek/_search"), ""},
+		{"upper case", "GET", "/test_deflek/_search", "alice", "CN=group2", now,
+			strings.ToUpper(sign("alice", "CN=group2", now, "GET", "/test_deflek/_search")), ""},
+		{"escaped path", "GET", "/%3Clogs-%7Bnow%2Fd%7D%3E/_search", "alice", "CN=group2", now,
+			sign("alice", "CN=group2", now, "GET", "/%3Clogs-%7Bnow%2Fd%7D%3E/_search"), ""},
+		{"anonymous", "GET", "/_search", "", "", "", "", ""},
+		{"unsigned", "GET", "/_search", "alice", "CN=group2", now, "", "identity headers are not signed"},
+		{"unsigned groups", "GET", "/_search", "", "CN=group2", "", "", "identity headers are not signed"},
+		{"tampered user", "GET", "/_search", "mallory", "CN=group2", now,
+			sign("alice", "CN=group2", now, "GET", "/_search"), "signature is invalid"},
+		{"tampered groups", "GET", "/_search", "alice", "CN=group2", now,
+			sign("alice", "CN=group1", now, "GET", "/_search"), "signature is invalid"},
+		{"other method", "DELETE", "/test_deflek", "alice", "CN=group2", now,
+			sign("alice", "CN=group2", now, "GET", "/test_deflek"), "signature is invalid"},
+		{"other path", "GET", "/secret_stuff/_search", "alice", "CN=group2", now,
+			sign("alice", "CN=group2", now, "GET", "/test_deflek/_search"), "signature is invalid"},
+		{"query", "GET", "/test_deflek/_search?q=tag:wow", "alice", "CN=group2", now,
+			sign("alice", "CN=group2", now, "GET", "/test_deflek/_search?q=tag:wow"), ""},
+		{"other query", "GET", "/test_deflek/_search?q=secret:true", "alice", "CN=group2", now,
+			sign("alice", "CN=group2", now, "GET", "/test_deflek/_search?q=tag:wow"), "signature is invalid"},
+		{"dropped query", "GET", "/test_deflek/_search?q=secret:true", "alice", "CN=group2", now,
+			sign("alice", "CN=group2", now, "GET", "/test_deflek/_search"), "signature is invalid"},
+		{"other secret", "GET", "/_search", "alice", "CN=group2", now,
+			signIdentity([]byte("another secret of at least 32 bytes"), "alice", "CN=group2", now, "GET", "/_search", nil),
+			"signature is invalid"},
+		{"no timestamp", "GET", "/_search", "alice", "CN=group2", "",
+			sign("alice", "CN=group2", "", "GET", "/_search"), "no valid X-Remote-Timestamp"},
+		{"stale", "GET", "/_search", "alice", "CN=group2", "1500000000",
+			sign("alice", "CN=group2", "1500000000", "GET", "/_search"), "signature is stale"},
+		{"future", "GET", "/_search", "alice", "CN=group2", "99999999999",
+			sign("alice", "CN=group2", "99999999999", "GET", "/_search"), "signature is stale"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, "http://localhost:9200"+c.path, nil)
+		if c.user != "" {
+			req.Header.Set("X-Remote-User", c.user)
+		}
+		if c.groups != "" {
+			req.Header.Set("X-Remote-Groups", c.groups)
+		}
+		if c.timestamp != "" {
+			req.Header.Set("X-Remote-Timestamp", c.timestamp)
+		}
+		if c.signature != "" {
+			req.Header.Set("X-Remote-Signature", c.signature)
+		}
+
+		id, err := a.authenticate(req)
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", c.name, err)
+			} else if id.user != c.user {
+				t.Errorf("%s: got user %s, expected %s", c.name, id.user, c.user)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got error %v, expected %s", c.name, err, c.err)
+		}
+	}
+}
+
+func TestCheckSignatureBody(t *testing.T) {
+	a, err := newHeaderAuthenticator(getTestConfig(withHeaderSignature(t)))
+	if err != nil {
+		t.Fatal("could not get authenticator: ", err)
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	body := `{"query":{"match_all":{}}}`
+	signature := signIdentity([]byte(testHMACSecret), "alice", "CN=group2", now, "POST", "/test_deflek/_search", []byte(body))
+
+	for _, c := range []struct {
+		body string
+		err  string
+	}{
+		{body, ""},
+		{`{"query":{"term":{"secret":true}}}`, "signature is invalid"},
+		{"", "signature is invalid"},
+	} {
+		req := httptest.NewRequest("POST", "/test_deflek/_search", strings.NewReader(c.body))
+		req.Header.Set("X-Remote-User", "alice")
+		req.Header.Set("X-Remote-Groups", "CN=group2")
+		req.Header.Set("X-Remote-Timestamp", now)
+		req.Header.Set("X-Remote-Signature", signature)
+
+		_, err := a.authenticate(req)
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("%q: %v", c.body, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%q: got error %v, expected %s", c.body, err, c.err)
+		}
+
+		// the body is still there to be forwarded
+		if got, _ := ioutil.ReadAll(req.Body); string(got) != c.body {
+			t.Errorf("%q: got body %q after the check", c.body, got)
+		}
+	}
+}
+
+func TestReadHeaderSecret(t *testing.T) {
+	if _, err := readHeaderSecret(""); err == nil {
+		t.Error("missing secret file accepted")
+	}
+	if _, err := readHeaderSecret(writeTestFile(t, "secret", []byte("hunter2\n"))); err == nil {
+		t.Error("short secret accepted")
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer upstream.Close()
+
+	c := getTestConfig(withHeaderSignature(t))
+	c.Target = upstream.URL
+	p := NewProx(c)
+
+	req := httptest.NewRequest("GET", "/test_deflek/_search", nil)
+	req.Header.Set("X-Remote-User", "mallory")
+	req.Header.Set("X-Remote-Groups", "CN=group2")
+	w := httptest.NewRecorder()
+	p.handleRequest(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d for forged headers, expected 401", w.Code)
+	}
+	expected := `{"error":{"root_cause":[{"type":"security_exception","reason":"identity headers are not signed"}],"type":"security_exception","reason":"identity headers are not signed"},"status":401}`
+	if diff := cmp.Diff(expected, w.Body.String()); diff != "" {
+		t.Errorf("unexpected body: (-want +got)\n%s", diff)
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Remote-User", "alice")
+	req.Header.Set("X-Remote-Timestamp", now)
+	req.Header.Set("X-Remote-Signature",
+		signIdentity([]byte(testHMACSecret), "alice", "CN=group2", now, "GET", "/test_deflek/_search", nil))
+	w = httptest.NewRecorder()
+	p.handleRequest(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d for signed headers, expected 200", w.Code)
+	}
+}
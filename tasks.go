@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	glob "github.com/ryanuber/go-glob"
+)
+
+// the header elasticsearch records on the tasks of a request
+const opaqueIDHeader = "X-Opaque-Id"
+
+// opaqueIDTag marks the tasks of a request with who made it. the owner is
+// escaped, so one owner can't pass for another with a `;`
+func opaqueIDTag(owner string) string {
+	return "deflek:" + url.QueryEscape(owner)
+}
+
+// tagOpaqueID sets the X-Opaque-Id of the request to the caller, keeping
+// the one the client sent after it
+func tagOpaqueID(ctx *requestContext) {
+	tag := opaqueIDTag(ctx.owner())
+	if client := ctx.r.Header.Get(opaqueIDHeader); client != "" {
+		tag += ";" + client
+	}
+	ctx.r.Header.Set(opaqueIDHeader, tag)
+}
+
+// ownsOpaqueID reports whether the X-Opaque-Id of a task was set for the
+// caller
+func (ctx *requestContext) ownsOpaqueID(opaqueID string) bool {
+	tag := opaqueIDTag(ctx.owner())
+	return opaqueID == tag || strings.HasPrefix(opaqueID, tag+";")
+}
+
+// esTask is the part of a task the owner is told by
+type esTask struct {
+	Headers map[string]string `json:"headers"`
+}
+
+func (ctx *requestContext) ownsTask(raw interface{}) bool {
+	task, ok := raw.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	headers, _ := task["headers"].(map[string]interface{})
+	opaqueID, _ := headers[opaqueIDHeader].(string)
+	return ctx.ownsOpaqueID(opaqueID)
+}
+
+// tasksGranted reports whether the caller can see and act on every task.
+// it takes `can_manage`, or a grant of the tasks API covering the action
+// through its actions. REST verbs only give the caller their own tasks
+func (ctx *requestContext) tasksGranted(action string) bool {
+	if ok, _ := canManage(ctx.r, ctx.C); ok {
+		return true
+	}
+	for _, whitelistedAPI := range ctx.whitelistedAPIs {
+		if glob.Glob(whitelistedAPI.Name, ctx.es.api) {
+			if actionPermitted(action, whitelistedAPI.Actions) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tasksPermitted limits the task APIs to the tasks of the caller, unless
+// they are granted every task
+func tasksPermitted(ctx *requestContext) (bool, error) {
+	action := ctx.action()
+	switch action {
+	case "cluster:monitor/tasks/lists", "cluster:monitor/task/get", "cluster:monitor/cat/tasks",
+		"cluster:admin/tasks/cancel":
+	default:
+		return true, nil
+	}
+	if ctx.tasksGranted(action) {
+		return true, nil
+	}
+
+	switch action {
+	case "cluster:monitor/tasks/lists":
+		ctx.responseMutators = append(ctx.responseMutators, ctx.filterTasks)
+
+	case "cluster:monitor/task/get":
+		ctx.responseMutators = append(ctx.responseMutators, ctx.ownTaskResponse)
+
+	case "cluster:monitor/cat/tasks":
+		// the text listing doesn't say who started the tasks
+		ctx.trace.Reason = "_cat/tasks shows every task, and requires monitor on _tasks"
+		return false, nil
+
+	case "cluster:admin/tasks/cancel":
+		id := ctx.es.params["task_id"]
+		if id == "" {
+			ctx.trace.Reason = "cancelling tasks without a task ID requires manage on _tasks"
+			return false, nil
+		}
+		var res struct {
+			Task esTask `json:"task"`
+		}
+		// tasks that can't be looked up can't be told apart from the
+		// tasks of others
+		if ctx.cluster == nil {
+			ctx.trace.Reason = "task " + id + " could not be looked up"
+			return false, nil
+		}
+		err := ctx.cluster.get("/_tasks/"+url.PathEscape(id), &res)
+		if err != nil {
+			ctx.trace.Reason = "task " + id + " could not be looked up: " + err.Error()
+			return false, nil
+		}
+		if !ctx.ownsOpaqueID(res.Task.Headers[opaqueIDHeader]) {
+			ctx.trace.Reason = "task " + id + " was not started by " + ctx.owner()
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// filterTasks removes the tasks of others from a task listing, which
+// groups them by node, by parent or not at all
+func (ctx *requestContext) filterTasks(res *http.Response, body []byte) ([]byte, error) {
+	if res.StatusCode != http.StatusOK {
+		return body, nil
+	}
+	var listing map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	err := decoder.Decode(&listing)
+	if err != nil {
+		return body, err
+	}
+
+	if nodes, ok := listing["nodes"].(map[string]interface{}); ok {
+		for _, node := range nodes {
+			if node, ok := node.(map[string]interface{}); ok {
+				node["tasks"] = ctx.ownTasks(node["tasks"])
+			}
+		}
+	}
+	if tasks, ok := listing["tasks"]; ok {
+		listing["tasks"] = ctx.ownTasks(tasks)
+	}
+
+	return marshalJSON(listing)
+}
+
+// ownTasks keeps the tasks of the caller, keyed by ID or in a list, along
+// with their own children
+func (ctx *requestContext) ownTasks(tasks interface{}) interface{} {
+	keep := func(task interface{}) bool {
+		if !ctx.ownsTask(task) {
+			return false
+		}
+		if task, ok := task.(map[string]interface{}); ok && task["children"] != nil {
+			task["children"] = ctx.ownTasks(task["children"])
+		}
+		return true
+	}
+
+	switch tasks := tasks.(type) {
+	case map[string]interface{}:
+		for id, task := range tasks {
+			if !keep(task) {
+				delete(tasks, id)
+			}
+		}
+		return tasks
+	case []interface{}:
+		owned := []interface{}{}
+		for _, task := range tasks {
+			if keep(task) {
+				owned = append(owned, task)
+			}
+		}
+		return owned
+	}
+	return tasks
+}
+
+// ownTaskResponse refuses to show the task of someone else
+func (ctx *requestContext) ownTaskResponse(res *http.Response, body []byte) ([]byte, error) {
+	if res.StatusCode != http.StatusOK {
+		return body, nil
+	}
+	var task struct {
+		Task esTask `json:"task"`
+	}
+	err := json.Unmarshal(body, &task)
+	if err != nil {
+		return body, err
+	}
+	if ctx.ownsOpaqueID(task.Task.Headers[opaqueIDHeader]) {
+		return body, nil
+	}
+
+	res.StatusCode = http.StatusForbidden
+	res.Status = http.StatusText(http.StatusForbidden)
+	reason := "action [" + ctx.action() + "] is unauthorized for task [" + ctx.es.params["task_id"] + "]"
+	return json.Marshal(esErrorResponse{securityException(reason), http.StatusForbidden})
+}
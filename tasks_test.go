@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTagOpaqueID(t *testing.T) {
+	var p Prox
+
+	ctx, err := getTestContext("/test_deflek/_search", "", "GET", withUser("alice;x"), withGroups("CN=group2"))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ctx.r.Header.Set("X-Opaque-Id", "kibana")
+	ok, err := p.checkRBAC(ctx)
+	if err != nil || !ok {
+		t.Fatalf("search denied: %v (%s)", err, ctx.trace.Reason)
+	}
+
+	expected := "deflek:user+alice%3Bx;kibana"
+	if got := ctx.r.Header.Get("X-Opaque-Id"); got != expected {
+		t.Errorf("got X-Opaque-Id %s, expected %s", got, expected)
+	}
+	if !ctx.ownsOpaqueID(expected) || ctx.ownsOpaqueID("deflek:user+alice") {
+		t.Error("opaque IDs told apart wrong")
+	}
+}
+
+func TestFilterTasks(t *testing.T) {
+	ctx, err := getTestContext("/_tasks", "", "GET", withUser("alice"), withGroups("CN=team-a"))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ok, err := tasksPermitted(ctx)
+	if err != nil || !ok || len(ctx.responseMutators) != 1 {
+		t.Fatalf("task listing not filtered: %v (%s)", err, ctx.trace.Reason)
+	}
+
+	mine := `"headers":{"X-Opaque-Id":"deflek:user+alice"}`
+	theirs := `"headers":{"X-Opaque-Id":"deflek:user+bob"}`
+	cases := []struct {
+		response string
+		expected string
+	}{
+		{
+			`{"nodes":{"n1":{"name":"n1","tasks":{"n1:1":{"id":1,` + mine + `},"n1:2":{"id":2,` + theirs + `},"n1:3":{"id":3}}}}}`,
+			`{"nodes":{"n1":{"name":"n1","tasks":{"n1:1":{` + mine + `,"id":1}}}}}`,
+		},
+		{
+			`{"tasks":{"n1:1":{"id":1,` + mine + `,"children":[{"id":4,` + theirs + `},{"id":5,` + mine + `}]}}}`,
+			`{"tasks":{"n1:1":{"children":[{` + mine + `,"id":5}],` + mine + `,"id":1}}}`,
+		},
+		{
+			`{"tasks":[{"id":1,` + theirs + `}]}`,
+			`{"tasks":[]}`,
+		},
+	}
+	for _, c := range cases {
+		got, err := ctx.responseMutators[0](&http.Response{StatusCode: http.StatusOK}, []byte(c.response))
+		if err != nil {
+			t.Errorf("%s: %v", c.response, err)
+		}
+		if diff := cmp.Diff(c.expected, string(got)); diff != "" {
+			t.Errorf("unexpected tasks: (-want +got)\n%s", diff)
+		}
+	}
+
+	// a grant of the tasks API through actions shows every task
+	ctx, _ = getTestContext("/_tasks", "", "GET", withUser("alice"), withGroups("CN=team-a"))
+	ctx.whitelistedAPIs = append(ctx.whitelistedAPIs, API{Name: "_tasks", Actions: []string{"monitor"}})
+	if ok, _ := tasksPermitted(ctx); !ok || len(ctx.responseMutators) != 0 {
+		t.Error("tasks filtered with monitor on _tasks")
+	}
+}
+
+func TestOwnTaskResponse(t *testing.T) {
+	ctx, err := getTestContext("/_tasks/n1:2", "", "GET", withUser("alice"), withGroups("CN=team-a"))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ok, err := tasksPermitted(ctx)
+	if err != nil || !ok || len(ctx.responseMutators) != 1 {
+		t.Fatalf("task not checked: %v (%s)", err, ctx.trace.Reason)
+	}
+
+	res := &http.Response{StatusCode: http.StatusOK}
+	body := `{"completed":false,"task":{"id":2,"headers":{"X-Opaque-Id":"deflek:user+alice"}}}`
+	got, _ := ctx.responseMutators[0](res, []byte(body))
+	if string(got) != body || res.StatusCode != http.StatusOK {
+		t.Errorf("own task refused: %d %s", res.StatusCode, got)
+	}
+
+	res = &http.Response{StatusCode: http.StatusOK}
+	body = `{"completed":false,"task":{"id":2,"headers":{"X-Opaque-Id":"deflek:user+bob"}}}`
+	got, _ = ctx.responseMutators[0](res, []byte(body))
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("task of someone else shown: %d %s", res.StatusCode, got)
+	}
+}
+
+func TestCancelTask(t *testing.T) {
+	cluster := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_tasks/n1:1":
+			fmt.Fprint(w, `{"task":{"id":1,"headers":{"X-Opaque-Id":"deflek:user+alice;kibana"}}}`)
+		case "/_tasks/n1:2":
+			fmt.Fprint(w, `{"task":{"id":2,"headers":{"X-Opaque-Id":"deflek:user+bob"}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer cluster.Close()
+	target, _ := url.Parse(cluster.URL)
+	cache := newIndexCache(target, http.DefaultTransport)
+
+	cases := []struct {
+		path      string
+		permitted bool
+	}{
+		{"/_tasks/n1:1/_cancel", true},
+		{"/_tasks/n1:2/_cancel", false},
+		{"/_tasks/n1:3/_cancel", false},
+		{"/_tasks/_cancel?actions=*search", false},
+	}
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, "", "POST", withUser("alice"), withGroups("CN=team-a"))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+		ctx.cluster = cache
+
+		ok, err := tasksPermitted(ctx)
+		if err != nil {
+			t.Errorf("%s: %v", c.path, err)
+		}
+		if ok != c.permitted {
+			t.Errorf("%s: got permitted %v, expected %v (%s)", c.path, ok, c.permitted, ctx.trace.Reason)
+		}
+	}
+}
+
+func TestTasksGranted(t *testing.T) {
+	cases := []struct {
+		name    string
+		granted bool
+	}{
+		{"_tasks", true},
+		{"_task*", true},
+		{"*", true},
+		{"_cat", false},
+	}
+	for _, c := range cases {
+		ctx, err := getTestContext("/_tasks", "", "GET", withGroups("CN=team-a"))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+		ctx.whitelistedAPIs = []API{{Name: c.name, Actions: []string{"monitor"}}}
+
+		if got := ctx.tasksGranted(ctx.action()); got != c.granted {
+			t.Errorf("%s: got granted %v, expected %v", c.name, got, c.granted)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// the kibana indices that get a copy per tenant, unless configured
+var defaultKibanaIndices = []string{".kibana", ".kibana_task_manager"}
+
+// kibanaIndices returns the kibana indices rewritten per tenant, longest
+// first so `.kibana_task_manager` isn't taken for a version of `.kibana`
+func kibanaIndices(C *Config) []string {
+	indices := append([]string{}, C.KibanaTenancy.Indices...)
+	if len(indices) == 0 {
+		indices = append(indices, defaultKibanaIndices...)
+	}
+	sort.Slice(indices, func(i, j int) bool { return len(indices[i]) > len(indices[j]) })
+	return indices
+}
+
+// tenantName makes a group name usable in an index name. groups are
+// matched case insensitively, so they are lowercased, and every byte but
+// letters and digits is escaped as `-` and its hex, so no two groups share
+// a tenant. the `tenant-` prefix keeps the indices of tenants apart from
+// the ones of kibana, like `.kibana_1` or `.kibana_task_manager`
+func tenantName(group string) string {
+	var b strings.Builder
+	b.WriteString("tenant-")
+	for _, c := range []byte(strings.ToLower(group)) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "-%02x", c)
+		}
+	}
+	return b.String()
+}
+
+// getTenant returns the tenant the request selected with the tenant header,
+// which has to be one of the groups of the user. without the header the
+// first group is the tenant
+func getTenant(r *http.Request, C *Config) (string, bool) {
+	groups := getGroups(r, C)
+	selected := strings.ToLower(strings.TrimSpace(r.Header.Get(C.KibanaTenancy.TenantHeader)))
+	if C.KibanaTenancy.TenantHeader == "" || selected == "" {
+		if len(groups) == 0 || groups[0] == "" {
+			return "", false
+		}
+		return tenantName(groups[0]), true
+	}
+	for _, group := range groups {
+		if strings.ToLower(group) == selected {
+			return tenantName(group), true
+		}
+	}
+	return "", false
+}
+
+// isVersionSuffix reports whether what follows a kibana index name makes it
+// a version of it, like the `_1` of `.kibana_1`
+func isVersionSuffix(suffix string) bool {
+	return len(suffix) > 1 && suffix[0] == '_' && suffix[1] >= '0' && suffix[1] <= '9'
+}
+
+// tenantIndex rewrites a kibana index name, or a version of it, to the one
+// of the tenant. other names are returned as they are
+func tenantIndex(ctx *requestContext, index string) string {
+	if ctx.tenant == "" || hasWildcard([]string{index}) {
+		return index
+	}
+	exclusion := strings.HasPrefix(index, "-")
+	name := strings.TrimPrefix(index, "-")
+	for _, base := range kibanaIndices(ctx.C) {
+		if name == base || (strings.HasPrefix(name, base) && isVersionSuffix(name[len(base):])) {
+			name = base + "_" + ctx.tenant + name[len(base):]
+			if exclusion {
+				return "-" + name
+			}
+			return name
+		}
+	}
+	return index
+}
+
+// logicalIndex returns the kibana index name behind an index of the tenant,
+// which is what gets authorized. other names are returned as they are
+func (ctx *requestContext) logicalIndex(index string) string {
+	if ctx.tenant == "" {
+		return index
+	}
+	for _, base := range kibanaIndices(ctx.C) {
+		prefix := base + "_" + ctx.tenant
+		if index == prefix || (strings.HasPrefix(index, prefix) && isVersionSuffix(index[len(prefix):])) {
+			return base + index[len(prefix):]
+		}
+	}
+	return index
+}
+
+// foreignKibanaIndex reports whether the index is a kibana index that isn't
+// the tenant's, like the ones of other tenants. wildcards that could match
+// them are refused too, unless they got resolved to concrete indices
+func (ctx *requestContext) foreignKibanaIndex(index string) bool {
+	if ctx.tenant == "" || ctx.logicalIndex(index) != index {
+		return false
+	}
+	if i := strings.Index(index, "*"); i >= 0 {
+		if i == 0 {
+			return false
+		}
+		prefix := index[:i]
+		for _, base := range kibanaIndices(ctx.C) {
+			if strings.HasPrefix(base, prefix) || strings.HasPrefix(prefix, base) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, base := range kibanaIndices(ctx.C) {
+		if index == base || strings.HasPrefix(index, base+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// mutateTenantPath rewrites the kibana indices in the path to the ones of
+// the tenant
+func mutateTenantPath(ctx *requestContext) error {
+	params := map[string]string{}
+	mutated := false
+	for name, value := range ctx.es.params {
+		params[name] = value
+		if !indexParams[name] {
+			continue
+		}
+		var indices []string
+		for _, index := range strings.Split(value, ",") {
+			indices = append(indices, tenantIndex(ctx, index))
+		}
+		if rewritten := strings.Join(indices, ","); rewritten != value {
+			params[name] = rewritten
+			mutated = true
+		}
+	}
+	if !mutated {
+		return nil
+	}
+
+	return setPath(ctx, ctx.es.route, params)
+}
+
+// mutateTenantBody rewrites the kibana indices named in the body to the
+// ones of the tenant
+func mutateTenantBody(ctx *requestContext) error {
+	if len(bytes.TrimSpace(ctx.body)) == 0 {
+		return nil
+	}
+
+	body, mutated, err := rewriteBodyIndices(ctx.action(), ctx.body, func(index string) []string {
+		return []string{tenantIndex(ctx, index)}
+	})
+	if err != nil || !mutated {
+		return err
+	}
+	setRequestBody(ctx, body)
+	return nil
+}
+
+// untenantResponse renames the kibana indices of the tenant in the response
+// back to the names the client asked for. only the `_index` of documents
+// and the index names keying index metadata, like the ones of GET /{index}
+// and its aliases, are renamed, so documents are left as they are
+func (ctx *requestContext) untenantResponse(res *http.Response, body []byte) ([]byte, error) {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if decoder.Decode(&v) != nil {
+		// not JSON, like _cat text, so there are no documents in it
+		return body, nil
+	}
+
+	changed := ctx.untenantValue(v)
+	if top, ok := v.(map[string]interface{}); ok {
+		changed = ctx.untenantKeys(top) || changed
+	}
+	if !changed {
+		return body, nil
+	}
+	return marshalJSON(v)
+}
+
+// untenantValue renames the `_index` fields and the aliases of the tenant,
+// skipping the contents of documents. reports whether anything changed
+func (ctx *requestContext) untenantValue(v interface{}) bool {
+	changed := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			switch key {
+			case "_source", "fields", "highlight":
+				continue
+			case "_index":
+				if index, ok := value.(string); ok {
+					if logical := ctx.logicalIndex(index); logical != index {
+						v[key] = logical
+						changed = true
+					}
+				}
+				continue
+			case "aliases":
+				if aliases, ok := value.(map[string]interface{}); ok {
+					changed = ctx.untenantKeys(aliases) || changed
+				}
+			}
+			changed = ctx.untenantValue(value) || changed
+		}
+	case []interface{}:
+		for _, value := range v {
+			changed = ctx.untenantValue(value) || changed
+		}
+	}
+	return changed
+}
+
+// untenantKeys renames the keys of an object keyed by index names
+func (ctx *requestContext) untenantKeys(object map[string]interface{}) bool {
+	renamed := map[string]string{}
+	for key := range object {
+		if logical := ctx.logicalIndex(key); logical != key {
+			renamed[key] = logical
+		}
+	}
+	for key, logical := range renamed {
+		object[logical] = object[key]
+		delete(object, key)
+	}
+	return len(renamed) > 0
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// withTenant enables kibana tenancy, picking the tenant with the header
+// unless it's empty
+func withTenant(tenant string) testOption {
+	return func(f *testFixture) {
+		f.C.KibanaTenancy.Enabled = true
+		f.C.KibanaTenancy.TenantHeader = "X-Kibana-Tenant"
+		if tenant != "" {
+			f.r.Header.Set("X-Kibana-Tenant", tenant)
+		}
+	}
+}
+
+func TestTenantIndex(t *testing.T) {
+	ctx, err := getTestContext("/_search", "", "GET", withGroups("CN=group2"), withTenant(""))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ctx.tenant = tenantName("group2")
+
+	cases := []struct {
+		index    string
+		expected string
+	}{
+		{".kibana", ".kibana_tenant-group2"},
+		{".kibana_1", ".kibana_tenant-group2_1"},
+		{".kibana_7.10.0_001", ".kibana_tenant-group2_7.10.0_001"},
+		{".kibana_task_manager", ".kibana_task_manager_tenant-group2"},
+		{".kibana_task_manager_1", ".kibana_task_manager_tenant-group2_1"},
+		{"-.kibana", "-.kibana_tenant-group2"},
+		{".kibana*", ".kibana*"},
+		{".kibana_tenant-group1", ".kibana_tenant-group1"},
+		{"test_deflek", "test_deflek"},
+	}
+
+	for _, c := range cases {
+		got := tenantIndex(ctx, c.index)
+		if got != c.expected {
+			t.Errorf("%s: got %s, expected %s", c.index, got, c.expected)
+		}
+		if logical := ctx.logicalIndex(got); got != c.index && logical != c.index && c.index[0] != '-' {
+			t.Errorf("%s: got logical index %s back", c.index, logical)
+		}
+	}
+
+	foreign := map[string]bool{
+		".kibana_tenant-group1": true, ".kibana": true, ".kibana_task_manager_1": true, ".kibana_tenant-group1*": true,
+		".kib*": true, ".kibana_tenant-group2": false, ".kibana_tenant-group2_1": false, "test_deflek": false, "*": false,
+	}
+	for index, expected := range foreign {
+		if got := ctx.foreignKibanaIndex(index); got != expected {
+			t.Errorf("%s: got foreign %v, expected %v", index, got, expected)
+		}
+	}
+}
+
+func TestGetTenant(t *testing.T) {
+	cases := []struct {
+		groups   string
+		header   string
+		expected string
+		ok       bool
+	}{
+		{"CN=group2", "", "tenant-group2", true},
+		{"CN=group2,CN=group1", "group1", "tenant-group1", true},
+		{"CN=group2,CN=group1", "GROUP1", "tenant-group1", true},
+		{"CN=group2", "group1", "", false},
+		{"CN=Team A", "", "tenant-team-20a", true},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext("/_search", "", "GET", withGroups(c.groups), withTenant(c.header))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+		tenant, ok := getTenant(ctx.r, ctx.C)
+		if tenant != c.expected || ok != c.ok {
+			t.Errorf("%s %s: got tenant %q %v, expected %q %v", c.groups, c.header, tenant, ok, c.expected, c.ok)
+		}
+	}
+}
+
+func TestTenantRequests(t *testing.T) {
+	cases := []struct {
+		groups    string
+		tenant    string
+		method    string
+		path      string
+		permitted bool
+		expected  string
+	}{
+		{"CN=group2", "", "GET", "/.kibana/_search", true, "/.kibana_tenant-group2/_search"},
+		{"CN=group2,CN=group1", "group1", "GET", "/.kibana/_search", true, "/.kibana_tenant-group1/_search"},
+		{"CN=group2", "group1", "GET", "/.kibana/_search", false, "/.kibana/_search"},
+		// other tenants can't be reached by their own names
+		{"CN=group2", "", "GET", "/.kibana_tenant-group1/_search", false, "/.kibana_tenant-group1/_search"},
+		{"CN=group2", "", "GET", "/test_deflek/_search", true, "/test_deflek/_search"},
+	}
+
+	var p Prox
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, "", c.method, withGroups(c.groups), withTenant(c.tenant))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+		ok, err := p.checkRBAC(ctx)
+		if err != nil {
+			t.Errorf("%s %s: %v", c.groups, c.path, err)
+		}
+		if ok != c.permitted {
+			t.Errorf("%s %s: got permitted %v, expected %v (%s)", c.groups, c.path, ok, c.permitted, ctx.trace.Reason)
+		}
+		if ctx.r.URL.Path != c.expected {
+			t.Errorf("%s %s: got path %s, expected %s", c.groups, c.path, ctx.r.URL.Path, c.expected)
+		}
+	}
+}
+
+func TestTenantWildcards(t *testing.T) {
+	cache := &indexCache{}
+	cache.set([]string{".kibana_tenant-group1", ".kibana_tenant-group1_1", ".kibana_tenant-group2", ".kibana_tenant-group2_1", "test_deflek"}, nil)
+
+	ctx, err := getTestContext("/.kibana*/_search", "", "GET", withGroups("CN=group2"), withTenant(""))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ctx.cluster = cache
+	var p Prox
+	ok, err := p.checkRBAC(ctx)
+	if err != nil || !ok {
+		t.Fatalf("wildcard over the tenant's kibana index denied: %v (%s)", err, ctx.trace.Reason)
+	}
+	if ctx.r.URL.Path != "/.kibana_tenant-group2/_search" {
+		t.Errorf("got path %s, expected /.kibana_tenant-group2/_search", ctx.r.URL.Path)
+	}
+
+	// without a view of the cluster, the wildcard could reach other tenants
+	ctx, err = getTestContext("/.kibana*/_search", "", "GET", withGroups("CN=group2"), withTenant(""))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ok, err = p.checkRBAC(ctx)
+	if err != nil || ok {
+		t.Errorf("wildcard over kibana indices permitted without a view of the cluster: %v", err)
+	}
+}
+
+func TestTenantBodies(t *testing.T) {
+	cases := []struct {
+		path     string
+		body     string
+		expected string
+	}{
+		{"/_msearch", "{\"index\":\".kibana\"}\n{\"query\":{\"match_all\":{}}}\n{\"index\":[\"test_deflek\"]}\n{}\n",
+			"{\"index\":\".kibana_tenant-group2\"}\n{\"query\":{\"match_all\":{}}}\n{\"index\":[\"test_deflek\"]}\n{}\n"},
+		{"/_mget", `{"docs":[{"_index":".kibana","_id":"config:6.2.1"},{"_index":"test_deflek","_id":"1"}]}`,
+			`{"docs":[{"_index":".kibana_tenant-group2","_id":"config:6.2.1"},{"_index":"test_deflek","_id":"1"}]}`},
+		{"/_bulk", "{\"index\":{\"_index\":\".kibana\",\"_id\":\"1\"}}\n{\"index\":\".kibana\"}\n",
+			"{\"index\":{\"_index\":\".kibana_tenant-group2\",\"_id\":\"1\"}}\n{\"index\":\".kibana\"}\n"},
+		{"/_aliases", `{"actions":[{"add":{"index":".kibana_1","alias":".kibana"}}]}`,
+			`{"actions":[{"add":{"index":".kibana_tenant-group2_1","alias":".kibana_tenant-group2"}}]}`},
+	}
+
+	for _, c := range cases {
+		ctx, err := getTestContext(c.path, c.body, "POST", withGroups("CN=group2"), withTenant(""))
+		if err != nil {
+			t.Fatal("could not get context: ", err)
+		}
+		ctx.tenant = tenantName("group2")
+		err = mutateTenantBody(ctx)
+		if err != nil {
+			t.Errorf("%s: %v", c.path, err)
+		}
+		if diff := cmp.Diff(c.expected, string(ctx.body)); diff != "" {
+			t.Errorf("%s: unexpected body: (-want +got)\n%s", c.path, diff)
+		}
+	}
+}
+
+func TestTenantName(t *testing.T) {
+	tenants := map[string]string{}
+	for _, group := range []string{"Team A", "team.a", "team_a", "team-a", "teama", "1", "task_manager", "security_session"} {
+		tenant := tenantName(group)
+		if other, ok := tenants[tenant]; ok {
+			t.Errorf("%s and %s share the tenant %s", group, other, tenant)
+		}
+		tenants[tenant] = group
+
+		// the indices of tenants aren't kibana's own, or versions of them
+		index := ".kibana_" + tenant
+		for _, own := range []string{".kibana_1", ".kibana_task_manager", ".kibana_security_session_1"} {
+			if index == own {
+				t.Errorf("%s: got kibana index %s", group, index)
+			}
+		}
+		if isVersionSuffix(strings.TrimPrefix(index, ".kibana")) {
+			t.Errorf("%s: got a version of .kibana %s", group, index)
+		}
+	}
+	if got := tenantName("Team A"); got != "tenant-team-20a" {
+		t.Errorf("got tenant %s, expected tenant-team-20a", got)
+	}
+}
+
+func TestUntenantResponse(t *testing.T) {
+	ctx, err := getTestContext("/_search", "", "GET", withGroups("CN=group2"), withTenant(""))
+	if err != nil {
+		t.Fatal("could not get context: ", err)
+	}
+	ctx.tenant = tenantName("group2")
+
+	body := `{".kibana_tenant-group2_1":{"aliases":{".kibana_tenant-group2":{}}},".kibana_task_manager_tenant-group2":{},` +
+		`"hits":[{"_index":".kibana_tenant-group2","_source":{"note":"moved from .kibana_tenant-group2","_index":".kibana_tenant-group2"}},` +
+		`{"_index":".kibana_tenant-group2x"},{"_index":".kibana_tenant-group2_foo"}]}`
+	expected := `{".kibana_1":{"aliases":{".kibana":{}}},".kibana_task_manager":{},` +
+		`"hits":[{"_index":".kibana","_source":{"_index":".kibana_tenant-group2","note":"moved from .kibana_tenant-group2"}},` +
+		`{"_index":".kibana_tenant-group2x"},{"_index":".kibana_tenant-group2_foo"}]}`
+
+	got, err := ctx.untenantResponse(&http.Response{StatusCode: http.StatusOK}, []byte(body))
+	if err != nil {
+		t.Error(err)
+	}
+	if diff := cmp.Diff(expected, string(got)); diff != "" {
+		t.Errorf("unexpected response: (-want +got)\n%s", diff)
+	}
+
+	// responses without the tenant's indices are left as they are
+	body = `{"hits" : [{"_index":"test_deflek"}]}`
+	got, _ = ctx.untenantResponse(&http.Response{StatusCode: http.StatusOK}, []byte(body))
+	if string(got) != body {
+		t.Errorf("got %s, expected it unchanged", got)
+	}
+}